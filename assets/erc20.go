@@ -26,6 +26,7 @@ import (
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"github.com/polynetwork/fabric-contract/utils"
 	"math/big"
+	"strconv"
 )
 
 const (
@@ -43,6 +44,15 @@ const (
 	EventApproval          = TokenId + "approve"
 	EventTransferOwnership = TokenId + "transferOwnerShip"
 
+	TokenMinter = TokenId + "-%s-Minter"
+
+	TokenMaxSupply = TokenId + "-MaxSupply"
+
+	EventMinterSet = TokenId + "minterSet"
+
+	TokenTrustedCCMs = TokenId + "-TrustedCCMs"
+	EventCCMChanged  = TokenId + "ccmChanged"
+
 	IsCrossChainOn = "is_cc_on"
 	LockProxyAddr  = "lockproxy_addr"
 	LockProxyKey   = "lockproxy_%s"
@@ -65,16 +75,29 @@ type ERC20 interface {
 
 type ERC20TokenImpl struct{}
 
-// args: name, symbol, decimal, totalsupply, [CCMChainCodeName, [lockProxyAddr, LPchaincodeName]]
+// args: name, symbol, decimal, totalsupply, [CCMChainCodeName, [lockProxyAddr, LPchaincodeName], [maxSupply]]
 func (token *ERC20TokenImpl) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	rawName, _ := stub.GetState(TokenName)
 	if len(rawName) != 0 {
+		// tokens deployed before permit get their domain when upgraded
+		if err := putDomain(stub); err != nil {
+			return shim.Error(err.Error())
+		}
 		return shim.Success(nil)
 	}
 
 	args := stub.GetStringArgs()
-	if 4 > len(args) || len(args) > 7 || len(args) == 6 {
-		return shim.Error("wrong args number and should be four, five or seven")
+	if 4 > len(args) || len(args) > 8 {
+		return shim.Error("wrong args number and should be four, five or seven, plus an optional maxSupply")
+	}
+	// maxSupply follows the cross chain args so it needs ccm, maybe empty, before it
+	var maxSupply *big.Int
+	if len(args) == 6 || len(args) == 8 {
+		var ok bool
+		if maxSupply, ok = big.NewInt(0).SetString(args[len(args)-1], 10); !ok || maxSupply.Sign() < 0 {
+			return shim.Error(fmt.Sprintf("failed to decode maxSupply: %s", args[len(args)-1]))
+		}
+		args = args[:len(args)-1]
 	}
 	if args[0] == "" {
 		return shim.Error(fmt.Sprintf("token name can't be empty"))
@@ -95,7 +118,8 @@ func (token *ERC20TokenImpl) Init(stub shim.ChaincodeStubInterface) pb.Response
 	if !ok {
 		return shim.Error(fmt.Sprintf("failed to decode totalSupply: %s", args[3]))
 	}
-	if totalSupply.Sign() != 1 {
+	// mapping asset bridged by burn and mint starts with nothing
+	if totalSupply.Sign() != 1 && !(len(args) == 7 && totalSupply.Sign() == 0) {
 		return shim.Error(fmt.Sprintf("token totalsupply must be positive"))
 	}
 
@@ -111,6 +135,14 @@ func (token *ERC20TokenImpl) Init(stub shim.ChaincodeStubInterface) pb.Response
 	if err := stub.PutState(TokenTotalSupply, totalSupply.Bytes()); err != nil {
 		return shim.Error(fmt.Sprintf("failed To put token totalsupply: %v", err))
 	}
+	if maxSupply != nil && maxSupply.Sign() > 0 {
+		if maxSupply.Cmp(totalSupply) < 0 {
+			return shim.Error(fmt.Sprintf("maxSupply %s is less than totalsupply %s", maxSupply.String(), totalSupply.String()))
+		}
+		if err := stub.PutState(TokenMaxSupply, maxSupply.Bytes()); err != nil {
+			return shim.Error(fmt.Sprintf("failed To put token maxSupply: %v", err))
+		}
+	}
 
 	owner, err := utils.GetMsgSenderAddress(stub)
 	if err != nil {
@@ -119,6 +151,9 @@ func (token *ERC20TokenImpl) Init(stub shim.ChaincodeStubInterface) pb.Response
 	if err = stub.PutState(TokenOwner, owner.Bytes()); err != nil {
 		return shim.Error(fmt.Sprintf("failed To put token owner: %v", err))
 	}
+	if err := putDomain(stub); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	var holder []byte
 	// if we get lockproxy address as args[5]
@@ -146,7 +181,10 @@ func (token *ERC20TokenImpl) Init(stub shim.ChaincodeStubInterface) pb.Response
 		holder = owner.Bytes()
 	}
 
-	if err = stub.PutState(balanceKey(holder), totalSupply.Bytes()); err != nil {
+	if totalSupply.Sign() == 0 {
+		return shim.Success(nil)
+	}
+	if err = putBalance(stub, holder, totalSupply); err != nil {
 		return shim.Error("failed To put all token To holder")
 	}
 	return shim.Success(nil)
@@ -199,6 +237,8 @@ func (token *ERC20TokenImpl) Invoke(stub shim.ChaincodeStubInterface) pb.Respons
 		return token.burn(stub, args)
 	case "proxyTransfer":
 		return token.proxyTransfer(stub, args)
+	case "proxyTransferFrom":
+		return token.proxyTransferFrom(stub, args)
 	case "setLockProxyChainCode":
 		return token.setLockProxyChainCode(stub, args)
 	case "getLockProxyChainCode":
@@ -207,6 +247,74 @@ func (token *ERC20TokenImpl) Invoke(stub shim.ChaincodeStubInterface) pb.Respons
 		return token.getCCM(stub)
 	case "changeCCM":
 		return token.changeCCM(stub, args)
+	case "rotateCCM":
+		return token.rotateCCM(stub, args)
+	case "setTrustedCCM":
+		return token.setTrustedCCM(stub, args)
+	case "removeTrustedCCM":
+		return token.removeTrustedCCM(stub, args)
+	case "getTrustedCCMs":
+		return token.getTrustedCCMs(stub)
+	case "proxyMint":
+		return token.proxyMint(stub, args)
+	case "proxyBurn":
+		return token.proxyBurn(stub, args)
+	case "setMinter":
+		return token.setMinter(stub, args)
+	case "delMinter":
+		return token.delMinter(stub, args)
+	case "isMinter":
+		return token.isMinter(stub, args)
+	case "burnParked":
+		return token.burnParked(stub, args)
+	case "freeze":
+		return token.freeze(stub, args)
+	case "unfreeze":
+		return token.unfreeze(stub, args)
+	case "isFrozen":
+		return token.isFrozen(stub, args)
+	case "setFreezeInbound":
+		return token.setFreezeInbound(stub, args)
+	case "getFreezeInbound":
+		return token.getFreezeInbound(stub)
+	case "wipeFrozen":
+		return token.wipeFrozen(stub, args)
+	case "getWipeRecord":
+		return token.getWipeRecord(stub, args)
+	case "listHolders":
+		return token.listHolders(stub, args)
+	case "holderCount":
+		return token.holderCount(stub)
+	case "balancesOf":
+		return token.balancesOf(stub, args)
+	case "listAllowances":
+		return token.listAllowances(stub, args)
+	case "reindexHolders":
+		return token.reindexHolders(stub, args)
+	case "getMaxSupply":
+		return token.getMaxSupply(stub)
+	case "setConfigurator":
+		return token.setConfigurator(stub, args)
+	case "delConfigurator":
+		return token.delConfigurator(stub, args)
+	case "isConfigurator":
+		return token.isConfigurator(stub, args)
+	case "configureMinter":
+		return token.configureMinter(stub, args)
+	case "removeMinter":
+		return token.removeMinter(stub, args)
+	case "minterAllowance":
+		return token.minterAllowance(stub, args)
+	case "getDomain":
+		return token.getDomain(stub)
+	case "nonces":
+		return token.nonces(stub, args)
+	case "permit":
+		return token.permit(stub, args)
+	case "transferWithAuthorization":
+		return token.transferWithAuthorization(stub, args)
+	case "authorizationState":
+		return token.authorizationState(stub, args)
 	case "delLockProxyChainCode":
 		return token.delLockProxyChainCode(stub, args)
 	}
@@ -265,14 +373,12 @@ func (token *ERC20TokenImpl) balanceOf(stub shim.ChaincodeStubInterface, args []
 	return shim.Success(balance)
 }
 
+// mint is called by the owner, or a minter within its mint allowance.
+// args: hex to, amount
 func (token *ERC20TokenImpl) mint(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
 	if len(args) != 2 {
 		return shim.Error("number of args should be 2")
 	}
-	if _, err := checkOwner(stub); err != nil {
-		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
-	}
-
 	amt, ok := big.NewInt(0).SetString(string(args[1]), 10)
 	if !ok {
 		return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[1]))
@@ -280,31 +386,33 @@ func (token *ERC20TokenImpl) mint(stub shim.ChaincodeStubInterface, args [][]byt
 	if amt.Sign() != 1 {
 		return shim.Error("amount should be positive")
 	}
+	minter, err := useMintAllowance(stub, amt)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	rawAcc, err := hex.DecodeString(string(args[0]))
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
 	}
-	key := balanceKey(rawAcc)
-	rawBal, err := stub.GetState(key)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed To get balance: %v", err))
+	if err := checkFrozen(stub, nil, rawAcc); err != nil {
+		return shim.Error(err.Error())
 	}
-	bal := big.NewInt(0).SetBytes(rawBal)
-	bal = bal.Add(bal, amt)
-
-	rawSupply, err := stub.GetState(TokenTotalSupply)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed To get totalsupply: %v", err))
+	if err := changeSupply(stub, rawAcc, amt); err != nil {
+		return shim.Error(err.Error())
 	}
-	ts := big.NewInt(0).SetBytes(rawSupply)
-	ts = ts.Add(ts, amt)
-
-	if err := stub.PutState(key, bal.Bytes()); err != nil {
-		return shim.Error(fmt.Sprintf("failed To update balance: %v", err))
+	// fabric keeps one event per tx, so a mint is told by the transfer event
+	rawEvent, err := json.Marshal(&MintEvent{
+		From:   common.Address{}.Bytes(),
+		To:     rawAcc,
+		Amount: amt.Bytes(),
+		Minter: minter,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
 	}
-	if err := stub.PutState(TokenTotalSupply, ts.Bytes()); err != nil {
-		return shim.Error(fmt.Sprintf("failed To update totalsupply: %v", err))
+	if err := stub.SetEvent(EventTranfer, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
 	}
 	return shim.Success(nil)
 }
@@ -332,6 +440,9 @@ func (token *ERC20TokenImpl) transferLogic(stub shim.ChaincodeStubInterface, fro
 	if amt.Sign() != 1 {
 		return shim.Error("amount should be positive")
 	}
+	if err := checkFrozen(stub, from, to); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fromKey := balanceKey(from)
 	rawFromBal, err := stub.GetState(fromKey)
@@ -353,16 +464,10 @@ func (token *ERC20TokenImpl) transferLogic(stub shim.ChaincodeStubInterface, fro
 	toBal := big.NewInt(0).SetBytes(rawToBal)
 	toBal = toBal.Add(toBal, amt)
 
-	if fromBal.Sign() == 0 {
-		if err := stub.DelState(fromKey); err != nil {
-			return shim.Error(fmt.Sprintf("failed To delete balance for From account: %v", err))
-		}
-	} else {
-		if err := stub.PutState(fromKey, fromBal.Bytes()); err != nil {
-			return shim.Error(fmt.Sprintf("failed To put balance for From account: %v", err))
-		}
+	if err := putBalance(stub, from, fromBal); err != nil {
+		return shim.Error(fmt.Sprintf("failed To put balance for From account: %v", err))
 	}
-	if err := stub.PutState(toKey, toBal.Bytes()); err != nil {
+	if err := putBalance(stub, to, toBal); err != nil {
 		return shim.Error(fmt.Sprintf("failed To put balance for receiver account: %v", err))
 	}
 
@@ -482,36 +587,10 @@ func (token *ERC20TokenImpl) proxyTransfer(stub shim.ChaincodeStubInterface, arg
 		return shim.Error("length 3 of args expected")
 	}
 
-	ccname, err := utils.GetCallingChainCodeName(stub)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get calling chaincode: %v", err))
-	}
-	ccmRec, err := stub.GetState(IsCrossChainOn)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get ccm: %v", err))
-	}
-	if len(ccmRec) == 0 {
-		return shim.Error("no ccm set in this crosschain asset")
-	}
-
-	originalArgs, err := utils.GetOriginalInputArgs(stub)
+	lpName, err := getCallingProxy(stub)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get original args: %v", err))
-	}
-	var lpName string
-	if string(ccmRec) == ccname {
-		rawProof, err := hex.DecodeString(string(originalArgs[1]))
-		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to decode proof to hex: %v", err))
-		}
-		lpName, err = GetWhatCCMCalling(rawProof)
-		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to get chaincode name which ccm calling: %v", err))
-		}
-	} else {
-		lpName = ccname
+		return shim.Error(err.Error())
 	}
-
 	lpAddr, err := stub.GetState(lockproxyKey(lpName))
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to get proxy address for chaincode %s: %v", lpName, err))
@@ -530,6 +609,153 @@ func (token *ERC20TokenImpl) proxyTransfer(stub shim.ChaincodeStubInterface, arg
 	return token.transferLogic(stub, args[0], args[1], amt)
 }
 
+// proxyTransferFrom is called by a lockproxy to lock funds of from with the
+// allowance from gave to the lockproxy address, which no one else can spend.
+// A chaincode has no identity of its own in fabric: a called chaincode sees the
+// creator of the tx, so transferFrom run by the lockproxy would spend what from
+// allowed the tx sender. The lockproxy can only be told by the calling chaincode
+// in the signed proposal, which getCallingProxy reads like proxyTransfer does.
+// args: from, to, amount bytes, to must be the lockproxy address
+func (token *ERC20TokenImpl) proxyTransferFrom(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if !isCCOn(stub) {
+		return shim.Error("not cross chain asset")
+	}
+	if len(args) != 3 {
+		return shim.Error("length 3 of args expected")
+	}
+	lpName, err := getCallingProxy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	lpAddr, err := stub.GetState(lockproxyKey(lpName))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get proxy address for chaincode %s: %v", lpName, err))
+	}
+	if len(lpAddr) == 0 {
+		return shim.Error(fmt.Sprintf("no proxy address for chaincode %s", lpName))
+	}
+	if !bytes.Equal(lpAddr, args[1]) {
+		return shim.Error(fmt.Sprintf("lockProxy address %s for %s not equal to %s",
+			hex.EncodeToString(lpAddr), lpName, hex.EncodeToString(args[1])))
+	}
+	amt := big.NewInt(0).SetBytes(args[2])
+	if err := spendAllowance(stub, args[0], lpAddr, amt); err != nil {
+		return shim.Error(err.Error())
+	}
+	logger.Infof("successful to call proxyTransferFrom for chaincode %s: (from: %x, amount: %s)",
+		lpName, args[0], amt.String())
+	return token.transferLogic(stub, args[0], lpAddr, amt)
+}
+
+// proxyMint is called by a minter lockproxy when unlocking in burn and mint mode.
+// args: to, amount bytes
+func (token *ERC20TokenImpl) proxyMint(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("length 2 of args expected")
+	}
+	lpName, err := checkMinter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt := big.NewInt(0).SetBytes(args[1])
+	if err := checkFrozen(stub, nil, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := changeSupply(stub, args[0], amt); err != nil {
+		return shim.Error(err.Error())
+	}
+	logger.Infof("successful to call proxyMint for chaincode %s: (to: %x, amount: %s)", lpName, args[0], amt.String())
+	return emitTransfer(stub, common.Address{}.Bytes(), args[0], amt)
+}
+
+// proxyBurn is called by a minter lockproxy when locking in burn and mint mode.
+// args: from, amount bytes
+func (token *ERC20TokenImpl) proxyBurn(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("length 2 of args expected")
+	}
+	lpName, err := checkMinter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt := big.NewInt(0).SetBytes(args[1])
+	if err := checkFrozen(stub, args[0], nil); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := changeSupply(stub, args[0], big.NewInt(0).Neg(amt)); err != nil {
+		return shim.Error(err.Error())
+	}
+	logger.Infof("successful to call proxyBurn for chaincode %s: (from: %x, amount: %s)", lpName, args[0], amt.String())
+	return emitTransfer(stub, args[0], common.Address{}.Bytes(), amt)
+}
+
+// args: lockproxy chaincode name
+func (token *ERC20TokenImpl) setMinter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("wrong args length and expect 1")
+	}
+	if !isCCOn(stub) {
+		return shim.Error("not cross chain asset")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if string(args[0]) == "" {
+		return shim.Error("chaincode name required")
+	}
+	if err := stub.PutState(minterKey(string(args[0])), []byte{1}); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put minter: %v", err))
+	}
+	return emitMinterSet(stub, string(args[0]), true)
+}
+
+func (token *ERC20TokenImpl) delMinter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("wrong args length and expect 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if err := stub.DelState(minterKey(string(args[0]))); err != nil {
+		return shim.Error(fmt.Sprintf("failed to del minter: %v", err))
+	}
+	return emitMinterSet(stub, string(args[0]), false)
+}
+
+func (token *ERC20TokenImpl) isMinter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("wrong args length and expect 1")
+	}
+	raw, _ := stub.GetState(minterKey(string(args[0])))
+	if len(raw) == 0 {
+		return shim.Success([]byte("false"))
+	}
+	return shim.Success([]byte("true"))
+}
+
+// burnParked burns the supply parked at LockProxyAddr of a mapping asset when
+// switching it to burn and mint mode. args: amount
+func (token *ERC20TokenImpl) burnParked(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	lpAddr, _ := stub.GetState(LockProxyAddr)
+	if len(lpAddr) == 0 {
+		return shim.Error("not mapping asset")
+	}
+	amt, ok := big.NewInt(0).SetString(string(args[0]), 10)
+	if !ok || amt.Sign() != 1 {
+		return shim.Error(fmt.Sprintf("wrong amount: %s", args[0]))
+	}
+	if err := changeSupply(stub, lpAddr, big.NewInt(0).Neg(amt)); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitTransfer(stub, lpAddr, common.Address{}.Bytes(), amt)
+}
+
 func (token *ERC20TokenImpl) transferOwnership(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("number of args should be 1")
@@ -566,6 +792,9 @@ func (token *ERC20TokenImpl) approve(stub shim.ChaincodeStubInterface, args [][]
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
 	}
+	if err := checkFrozen(stub, from.Bytes(), nil); err != nil {
+		return shim.Error(err.Error())
+	}
 	spender, err := hex.DecodeString(string(args[0]))
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to decode hex spender: %v", err))
@@ -605,6 +834,9 @@ func (token *ERC20TokenImpl) transferFrom(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
 	}
+	if err := checkFrozen(stub, spender.Bytes(), nil); err != nil {
+		return shim.Error(err.Error())
+	}
 	amt, ok := big.NewInt(0).SetString(string(args[2]), 10)
 	if !ok {
 		return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[2]))
@@ -614,23 +846,8 @@ func (token *ERC20TokenImpl) transferFrom(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to decode hex from: %v", err))
 	}
-	key := approveKey(from, spender.Bytes())
-	raw, err := stub.GetState(key)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed To get approve value for %s: %v", key, err))
-	}
-	val := big.NewInt(0).SetBytes(raw)
-	leftVal := val.Sub(val, amt)
-	if leftVal.Sign() == -1 {
-		return shim.Error(fmt.Sprintf("approved value %s is not enough To pay %s", val.String(), amt.String()))
-	} else if leftVal.Sign() == 0 {
-		if err := stub.DelState(key); err != nil {
-			return shim.Error(fmt.Sprintf("delete %s failed: %v", key, err))
-		}
-	} else {
-		if err = stub.PutState(key, leftVal.Bytes()); err != nil {
-			return shim.Error(fmt.Sprintf("failed To put %s: %v", key, err))
-		}
+	if err := spendAllowance(stub, from, spender.Bytes(), amt); err != nil {
+		return shim.Error(err.Error())
 	}
 
 	to, err := hex.DecodeString(string(args[1]))
@@ -700,6 +917,12 @@ func (token *ERC20TokenImpl) changeAllowance(stub shim.ChaincodeStubInterface, s
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
 	}
+	// a frozen account can still decrease its allowances
+	if amt.Sign() > 0 {
+		if err := checkFrozen(stub, from.Bytes(), nil); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	key := approveKey(from.Bytes(), spender)
 	raw, err := stub.GetState(key)
 	if err != nil {
@@ -723,6 +946,7 @@ func (token *ERC20TokenImpl) changeAllowance(stub shim.ChaincodeStubInterface, s
 	return shim.Success(nil)
 }
 
+// args: amount
 func (token *ERC20TokenImpl) burn(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("number of args should be 1")
@@ -731,41 +955,99 @@ func (token *ERC20TokenImpl) burn(stub shim.ChaincodeStubInterface, args [][]byt
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
 	}
-	rawSupply, err := stub.GetState(TokenTotalSupply)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed To get totalsupply: %v", err))
+	amt, ok := big.NewInt(0).SetString(string(args[0]), 10)
+	if !ok {
+		return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[0]))
 	}
-	ts := big.NewInt(0).SetBytes(rawSupply)
+	if amt.Sign() != 1 {
+		return shim.Error("amount should be positive")
+	}
+	if err := checkFrozen(stub, from.Bytes(), nil); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := changeSupply(stub, from.Bytes(), big.NewInt(0).Neg(amt)); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitTransfer(stub, from.Bytes(), common.Address{}.Bytes(), amt)
+}
 
-	amt, ok := big.NewInt(0).SetString(string(args[1]), 10)
-	if !ok {
-		return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[1]))
+func (token *ERC20TokenImpl) changeCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
 	}
-	if amt.Sign() == 0 {
-		return shim.Error("amount can't be zero")
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
 	}
-	ts = ts.Sub(ts, amt)
+	// the old ccm is not trusted any more, use rotateCCM to keep it for a while
+	return rotateCCM(stub, string(args[0]), 0)
+}
 
-	if err := stub.PutState(TokenTotalSupply, ts.Bytes()); err != nil {
-		return shim.Error(fmt.Sprintf("failed To update totalsupply: %v", err))
+// rotateCCM switches to a new ccm, the old one is still trusted for grace seconds
+// so that messages in flight can be delivered.
+// args: new ccm, grace seconds
+func (token *ERC20TokenImpl) rotateCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
 	}
-	return token.transferLogic(stub, from.Bytes(), common.Address{}.Bytes(), amt)
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	grace, err := strconv.ParseUint(string(args[1]), 10, 63)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse grace: %v", err))
+	}
+	return rotateCCM(stub, string(args[0]), int64(grace))
 }
 
-func (token *ERC20TokenImpl) changeCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+// setTrustedCCM trusts a ccm in [activeFrom, expiresAt), timestamps in seconds
+// and "0" expiresAt for no expiry.
+// args: ccm, activeFrom, expiresAt
+func (token *ERC20TokenImpl) setTrustedCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("number of args should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	t := &utils.TrustedCCM{Name: string(args[0])}
+	var err error
+	if t.ActiveFrom, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse activeFrom: %v", err))
+	}
+	if t.ExpiresAt, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse expiresAt: %v", err))
+	}
+	if t.Name == "" || (t.ExpiresAt != 0 && t.ExpiresAt <= t.ActiveFrom) {
+		return shim.Error("ccm is required and expiresAt should be after activeFrom")
+	}
+	return updateTrustedCCMs(stub, func(list []*utils.TrustedCCM) []*utils.TrustedCCM {
+		return utils.SetTrustedCCM(list, t)
+	})
+}
+
+// args: ccm
+func (token *ERC20TokenImpl) removeTrustedCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("number of args should be 1")
 	}
 	if _, err := checkOwner(stub); err != nil {
 		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
 	}
-	if len(args[0]) == 0 {
-		return shim.Error("ccm can't be nil")
+	return updateTrustedCCMs(stub, func(list []*utils.TrustedCCM) []*utils.TrustedCCM {
+		return utils.RemoveTrustedCCM(list, string(args[0]))
+	})
+}
+
+func (token *ERC20TokenImpl) getTrustedCCMs(stub shim.ChaincodeStubInterface) pb.Response {
+	list, err := utils.GetTrustedCCMs(stub, TokenTrustedCCMs)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	if err := stub.PutState(IsCrossChainOn, args[0]); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put state: %v", err))
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
 	}
-	return shim.Success(nil)
+	return shim.Success(raw)
 }
 
 func (token *ERC20TokenImpl) getOwner(stub shim.ChaincodeStubInterface) pb.Response {
@@ -809,6 +1091,155 @@ func (token *ERC20TokenImpl) isCrossChainOn(stub shim.ChaincodeStubInterface) pb
 	return shim.Success([]byte("true"))
 }
 
+// getCallingProxy returns the lockproxy calling this token directly or through ccm.
+func getCallingProxy(stub shim.ChaincodeStubInterface) (string, error) {
+	ccname, err := utils.GetCallingChainCodeName(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get calling chaincode: %v", err)
+	}
+	ccmRec, err := stub.GetState(IsCrossChainOn)
+	if err != nil {
+		return "", fmt.Errorf("failed to get ccm: %v", err)
+	}
+	if len(ccmRec) == 0 {
+		return "", fmt.Errorf("no ccm set in this crosschain asset")
+	}
+	if string(ccmRec) != ccname {
+		trusted, err := utils.IsTrustedCCM(stub, TokenTrustedCCMs, ccname)
+		if err != nil {
+			return "", err
+		}
+		if !trusted {
+			return ccname, nil
+		}
+	}
+
+	originalArgs, err := utils.GetOriginalInputArgs(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get original args: %v", err)
+	}
+	rawProof, err := hex.DecodeString(string(originalArgs[1]))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode proof to hex: %v", err)
+	}
+	lpName, err := GetWhatCCMCalling(rawProof)
+	if err != nil {
+		return "", fmt.Errorf("failed to get chaincode name which ccm calling: %v", err)
+	}
+	return lpName, nil
+}
+
+// spendAllowance takes amt from the allowance owner gave to spender.
+func spendAllowance(stub shim.ChaincodeStubInterface, owner, spender []byte, amt *big.Int) error {
+	key := approveKey(owner, spender)
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed To get approve value for %s: %v", key, err)
+	}
+	val := big.NewInt(0).SetBytes(raw)
+	leftVal := val.Sub(val, amt)
+	if leftVal.Sign() == -1 {
+		return fmt.Errorf("approved value %s is not enough To pay %s", val.String(), amt.String())
+	} else if leftVal.Sign() == 0 {
+		if err := stub.DelState(key); err != nil {
+			return fmt.Errorf("delete %s failed: %v", key, err)
+		}
+	} else {
+		if err = stub.PutState(key, leftVal.Bytes()); err != nil {
+			return fmt.Errorf("failed To put %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func checkMinter(stub shim.ChaincodeStubInterface) (string, error) {
+	if !isCCOn(stub) {
+		return "", fmt.Errorf("not cross chain asset")
+	}
+	lpName, err := getCallingProxy(stub)
+	if err != nil {
+		return "", err
+	}
+	raw, err := stub.GetState(minterKey(lpName))
+	if err != nil {
+		return "", fmt.Errorf("failed to get minter: %v", err)
+	}
+	if len(raw) == 0 {
+		return "", fmt.Errorf("chaincode %s is not minter", lpName)
+	}
+	return lpName, nil
+}
+
+// changeSupply mints to or burns from acc by delta.
+func changeSupply(stub shim.ChaincodeStubInterface, acc []byte, delta *big.Int) error {
+	if delta.Sign() == 0 {
+		return fmt.Errorf("amount can't be zero")
+	}
+	key := balanceKey(acc)
+	rawBal, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed To get balance: %v", err)
+	}
+	bal := big.NewInt(0).SetBytes(rawBal)
+	bal.Add(bal, delta)
+	if bal.Sign() < 0 {
+		return fmt.Errorf("balance %s is less than the amount %s", big.NewInt(0).SetBytes(rawBal).String(),
+			big.NewInt(0).Neg(delta).String())
+	}
+	rawSupply, err := stub.GetState(TokenTotalSupply)
+	if err != nil {
+		return fmt.Errorf("failed To get totalsupply: %v", err)
+	}
+	ts := big.NewInt(0).SetBytes(rawSupply)
+	ts.Add(ts, delta)
+	if delta.Sign() > 0 {
+		rawMax, err := stub.GetState(TokenMaxSupply)
+		if err != nil {
+			return fmt.Errorf("failed To get maxSupply: %v", err)
+		}
+		if len(rawMax) > 0 && ts.Cmp(big.NewInt(0).SetBytes(rawMax)) > 0 {
+			return fmt.Errorf("totalsupply %s would exceed maxSupply %s", ts.String(), big.NewInt(0).SetBytes(rawMax).String())
+		}
+	}
+
+	if err := putBalance(stub, acc, bal); err != nil {
+		return fmt.Errorf("failed To update balance: %v", err)
+	}
+	if err := stub.PutState(TokenTotalSupply, ts.Bytes()); err != nil {
+		return fmt.Errorf("failed To update totalsupply: %v", err)
+	}
+	return nil
+}
+
+func emitTransfer(stub shim.ChaincodeStubInterface, from, to []byte, amt *big.Int) pb.Response {
+	rawEvent, err := json.Marshal(&TransferEvent{
+		From:   from,
+		To:     to,
+		Amount: amt.Bytes(),
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventTranfer, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func emitMinterSet(stub shim.ChaincodeStubInterface, ccname string, isMinter bool) pb.Response {
+	rawEvent, err := json.Marshal(&MinterSetEvent{
+		Chaincode: ccname,
+		IsMinter:  isMinter,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventMinterSet, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
 func isCCOn(stub shim.ChaincodeStubInterface) bool {
 	val, _ := stub.GetState(IsCrossChainOn)
 	if len(val) == 0 {
@@ -840,6 +1271,67 @@ func approveKey(from, spender []byte) string {
 	return fmt.Sprintf(TokenApprove, hex.EncodeToString(from), hex.EncodeToString(spender))
 }
 
+func minterKey(ccname string) string {
+	return fmt.Sprintf(TokenMinter, ccname)
+}
+
 func lockproxyKey(ccname string) string {
 	return fmt.Sprintf(LockProxyKey, ccname)
 }
+
+func rotateCCM(stub shim.ChaincodeStubInterface, newCCM string, grace int64) pb.Response {
+	if newCCM == "" {
+		return shim.Error("ccm can't be nil")
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	list, err := utils.GetTrustedCCMs(stub, TokenTrustedCCMs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	oldCCM, err := stub.GetState(IsCrossChainOn)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get ccm: %v", err))
+	}
+	list = utils.RemoveTrustedCCM(list, newCCM)
+	if len(oldCCM) > 0 && string(oldCCM) != newCCM && grace > 0 {
+		list = utils.SetTrustedCCM(list, &utils.TrustedCCM{Name: string(oldCCM), ExpiresAt: now + grace})
+	}
+	if err := stub.PutState(IsCrossChainOn, []byte(newCCM)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state: %v", err))
+	}
+	return putTrustedCCMs(stub, newCCM, list, now)
+}
+
+func updateTrustedCCMs(stub shim.ChaincodeStubInterface, update func([]*utils.TrustedCCM) []*utils.TrustedCCM) pb.Response {
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	list, err := utils.GetTrustedCCMs(stub, TokenTrustedCCMs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ccm, err := stub.GetState(IsCrossChainOn)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get ccm: %v", err))
+	}
+	return putTrustedCCMs(stub, string(ccm), update(list), now)
+}
+
+func putTrustedCCMs(stub shim.ChaincodeStubInterface, ccm string, list []*utils.TrustedCCM, now int64) pb.Response {
+	list, err := utils.PutTrustedCCMs(stub, TokenTrustedCCMs, list, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rawEvent, err := json.Marshal(&CCMChangedEvent{CCM: ccm, Trusted: list})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventCCMChanged, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
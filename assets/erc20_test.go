@@ -18,15 +18,24 @@ package assets
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/peer"
 	utils2 "github.com/hyperledger/fabric/protos/utils"
 	"github.com/polynetwork/fabric-contract/utils"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/sha3"
 	"math/big"
+	"strconv"
 	"testing"
 )
 
@@ -71,7 +80,8 @@ zQW7eQxTo228awU1AIwsA95+
 	addr2 = "c5e917dc100b256f6f7150812b72ad60cbd50d53"
 )
 
-func prepareEnv(isLp string) (*ERC20TokenImpl, *utils.CCStubMock) {
+// prepareEnv inits a token with ccm "test" and maxSupply, "0" for no cap.
+func prepareEnv(maxSupply string) (*ERC20TokenImpl, *utils.CCStubMock) {
 	impl := &ERC20TokenImpl{}
 	mock := &utils.CCStubMock{
 		CA: rootCA,
@@ -83,7 +93,7 @@ func prepareEnv(isLp string) (*ERC20TokenImpl, *utils.CCStubMock) {
 		[]byte("18"),
 		[]byte("1000000000000000000000000000"),
 		[]byte("test"),
-		[]byte(isLp),
+		[]byte(maxSupply),
 	}
 	resp := impl.Init(mock)
 	if resp.Status != shim.OK {
@@ -94,14 +104,14 @@ func prepareEnv(isLp string) (*ERC20TokenImpl, *utils.CCStubMock) {
 }
 
 func TestERC20TokenImpl_name(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	resp := impl.name(mock)
 	assert.Equal(t, true, shim.OK == resp.Status, "wrong result")
 	assert.Equal(t, []byte("polyEth"), resp.Payload)
 }
 
 func TestERC20TokenImpl_decimal(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	resp := impl.decimal(mock)
 
 	assert.Equal(t, true, shim.OK == resp.Status, "wrong result")
@@ -109,7 +119,7 @@ func TestERC20TokenImpl_decimal(t *testing.T) {
 }
 
 func TestERC20TokenImpl_balanceOf(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	mock.Args = [][]byte{
 		[]byte(addr1),
 	}
@@ -121,7 +131,7 @@ func TestERC20TokenImpl_balanceOf(t *testing.T) {
 }
 
 func TestERC20TokenImpl_mint(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	mock.Args = [][]byte{
 		[]byte(addr2),
 		[]byte("10000"),
@@ -142,7 +152,7 @@ func TestERC20TokenImpl_mint(t *testing.T) {
 }
 
 func TestERC20TokenImpl_transfer(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	mock.Args = [][]byte{
 		[]byte(addr2),
 		[]byte("10000"),
@@ -165,7 +175,7 @@ func TestERC20TokenImpl_transfer(t *testing.T) {
 }
 
 func TestERC20TokenImpl_approve(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	mock.Args = [][]byte{
 		[]byte(addr2),
 		[]byte("10000"),
@@ -195,7 +205,7 @@ func TestERC20TokenImpl_approve(t *testing.T) {
 }
 
 func TestERC20TokenImpl_decreaseAllowance(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	mock.Args = [][]byte{
 		[]byte(addr2),
 		[]byte("10000"),
@@ -218,7 +228,7 @@ func TestERC20TokenImpl_decreaseAllowance(t *testing.T) {
 }
 
 func TestERC20TokenImpl_burn(t *testing.T) {
-	impl, mock := prepareEnv("false")
+	impl, mock := prepareEnv("0")
 	mock.Args = [][]byte{
 		[]byte("10000"),
 	}
@@ -232,8 +242,138 @@ func TestERC20TokenImpl_burn(t *testing.T) {
 	assert.Equal(t, big.NewInt(9000).Bytes(), resp.Payload)
 }
 
+func TestChangeSupply(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	acc := []byte{1, 2, 3}
+	assert.NoError(t, changeSupply(mock, acc, big.NewInt(100)))
+	assert.NoError(t, changeSupply(mock, acc, big.NewInt(-40)))
+	assert.Error(t, changeSupply(mock, acc, big.NewInt(-61)))
+	assert.Error(t, changeSupply(mock, acc, big.NewInt(0)))
+	assert.Equal(t, big.NewInt(60).Bytes(), mock.Mem[balanceKey(acc)])
+	assert.Equal(t, big.NewInt(60).Bytes(), mock.Mem[TokenTotalSupply])
+}
+
+func TestCheckSigner(t *testing.T) {
+	p := &Permit{Owner: make([]byte, 20), Spender: []byte{1}, Value: big.NewInt(100), Nonce: 1, Deadline: 100}
+	digest := p.digest([]byte("domain"))
+	assert.NotEqual(t, digest, p.digest([]byte("other")))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest)
+	assert.NoError(t, err)
+	owner := utils.GetAddrFromRaw(pub).Bytes()
+	sigArgs := [][]byte{[]byte(SchemeP256), []byte(hex.EncodeToString(sig)), []byte(hex.EncodeToString(pub))}
+	assert.NoError(t, checkSigner(owner, digest, sigArgs))
+	assert.Error(t, checkSigner(p.Owner, digest, sigArgs))
+	assert.Error(t, checkSigner(owner, p.digest(nil), sigArgs))
+
+	k1, err := btcec.NewPrivateKey(btcec.S256())
+	assert.NoError(t, err)
+	compact, err := btcec.SignCompact(btcec.S256(), k1, digest, false)
+	assert.NoError(t, err)
+	ethSig := append(compact[1:], compact[0])
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(k1.PubKey().SerializeUncompressed()[1:])
+	ethAddr := hash.Sum(nil)[12:]
+	sigArgs = [][]byte{[]byte(SchemeSecp256k1), []byte(hex.EncodeToString(ethSig))}
+	assert.NoError(t, checkSigner(ethAddr, digest, sigArgs))
+	assert.Error(t, checkSigner(owner, digest, sigArgs))
+}
+
+func TestMintAllowance(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	minter := []byte{1, 2, 3}
+	allowance, err := getMintAllowance(mock, minter)
+	assert.NoError(t, err)
+	assert.Nil(t, allowance)
+	assert.NoError(t, putMintAllowance(mock, minter, big.NewInt(0)))
+	allowance, err = getMintAllowance(mock, minter)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, allowance.Sign())
+
+	mock.Mem[TokenMaxSupply] = big.NewInt(100).Bytes()
+	assert.NoError(t, changeSupply(mock, minter, big.NewInt(100)))
+	assert.Error(t, changeSupply(mock, minter, big.NewInt(1)))
+	assert.NoError(t, changeSupply(mock, minter, big.NewInt(-10)))
+	assert.NoError(t, changeSupply(mock, minter, big.NewInt(10)))
+}
+
+func TestMintBurn_transferEvent(t *testing.T) {
+	net := utils.NewMockNet()
+	owner, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	alice, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), net.Deploy("peth", &ERC20TokenImpl{}, owner, "polyEth", "pEth", "18", "1000", "", "1600").Status)
+	transferEvent := func() *MintEvent {
+		assert.Equal(t, EventTranfer, net.Event.EventName)
+		event := &MintEvent{}
+		assert.NoError(t, json.Unmarshal(net.Event.Payload, event))
+		return event
+	}
+
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "mint", hex.EncodeToString(alice.Addr.Bytes()), "500").Status)
+	assert.Equal(t, &MintEvent{
+		From:   common.Address{}.Bytes(),
+		To:     alice.Addr.Bytes(),
+		Amount: big.NewInt(500).Bytes(),
+		Minter: owner.Addr.Bytes(),
+	}, transferEvent())
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", owner, "mint", hex.EncodeToString(alice.Addr.Bytes()), "101").Status)
+
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", alice, "burn", "200").Status)
+	assert.Equal(t, &MintEvent{
+		From:   alice.Addr.Bytes(),
+		To:     common.Address{}.Bytes(),
+		Amount: big.NewInt(200).Bytes(),
+	}, transferEvent())
+	assert.Equal(t, big.NewInt(1300).Bytes(), net.GetState("peth", TokenTotalSupply))
+}
+
+func TestHolderIndex(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	acc := []byte{1, 2, 3}
+	assert.NoError(t, putBalance(mock, acc, big.NewInt(10)))
+	assert.Equal(t, big.NewInt(10).Bytes(), mock.Mem[balanceKey(acc)])
+	assert.NoError(t, putBalance(mock, acc, big.NewInt(0)))
+	_, ok := mock.Mem[balanceKey(acc)]
+	assert.Equal(t, false, ok)
+
+	parsed, ok := parseBalanceKey(balanceKey(acc))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, acc, parsed)
+	_, ok = parseBalanceKey(approveKey(acc, acc))
+	assert.Equal(t, false, ok)
+	_, ok = parseBalanceKey(TokenTotalSupply)
+	assert.Equal(t, false, ok)
+
+	prefix := approveKey(acc, nil)
+	assert.Equal(t, TokenId+"-010203-Approve.", utils.PrefixEnd(prefix))
+	assert.Equal(t, true, approveKey(acc, []byte{0xff}) < utils.PrefixEnd(prefix))
+}
+
+func TestCheckFrozen(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	acc, other := []byte{1, 2, 3}, []byte{4, 5, 6}
+	mock.Mem[freezeKey(acc)] = []byte{1}
+	assert.Error(t, checkFrozen(mock, acc, other))
+	assert.NoError(t, checkFrozen(mock, other, acc))
+	mock.Mem[TokenFreezeInbound] = []byte{1}
+	assert.Error(t, checkFrozen(mock, other, acc))
+	assert.NoError(t, checkFrozen(mock, other, nil))
+
+	assert.NoError(t, changeSupply(mock, acc, big.NewInt(100)))
+	assert.NoError(t, moveBalance(mock, acc, other, big.NewInt(100)))
+	assert.Error(t, moveBalance(mock, acc, other, big.NewInt(1)))
+	assert.Equal(t, 0, len(mock.Mem[balanceKey(acc)]))
+	assert.Equal(t, big.NewInt(100).Bytes(), mock.Mem[balanceKey(other)])
+}
+
 //func TestERC20TokenImpl_bindProxyHash(t *testing.T) {
-//	impl, mock := prepareEnv("true")
+//	impl, mock := prepareEnv("0")
 //	mock.Args = [][]byte{
 //		[]byte("2"),
 //		[]byte(addr1),
@@ -250,7 +390,7 @@ func TestERC20TokenImpl_burn(t *testing.T) {
 //}
 //
 //func TestERC20TokenImpl_bindAssetHash(t *testing.T) {
-//	impl, mock := prepareEnv("true")
+//	impl, mock := prepareEnv("0")
 //	mock.Args = [][]byte{
 //		[]byte("2"),
 //		[]byte(addr1),
@@ -268,7 +408,7 @@ func TestERC20TokenImpl_burn(t *testing.T) {
 //}
 //
 //func TestERC20TokenImpl_lock(t *testing.T) {
-//	impl, mock := prepareEnv("true")
+//	impl, mock := prepareEnv("0")
 //	mock.Args = [][]byte{
 //		[]byte("ccm"),
 //	}
@@ -299,7 +439,7 @@ func TestERC20TokenImpl_burn(t *testing.T) {
 //}
 //
 //func TestERC20TokenImpl_unlock(t *testing.T) {
-//	impl, mock := prepareEnv("true")
+//	impl, mock := prepareEnv("0")
 //	mock.Args = [][]byte{
 //		[]byte("ccm1"),
 //	}
@@ -387,3 +527,246 @@ func TestERC20TokenImpl_Init(t *testing.T) {
 
 	fmt.Println(aa.String())
 }
+
+func TestFreeze_wipeFrozen(t *testing.T) {
+	net := utils.NewMockNet()
+	owner, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	officer, err := utils.NewMockUser("Org1MSP", map[string]string{TokenComplianceAttr: "true"})
+	assert.NoError(t, err)
+	alice, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	bob, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), net.Deploy("peth", &ERC20TokenImpl{}, owner, "polyEth", "pEth", "18", "1000", "").Status)
+	aliceHex, bobHex := hex.EncodeToString(alice.Addr.Bytes()), hex.EncodeToString(bob.Addr.Bytes())
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "transfer", aliceHex, "300").Status)
+
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", bob, "freeze", aliceHex).Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", officer, "wipeFrozen", aliceHex, "court order").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", officer, "freeze", aliceHex).Status)
+	assert.Equal(t, EventFreeze, net.Event.EventName)
+	event := &FreezeEvent{}
+	assert.NoError(t, json.Unmarshal(net.Event.Payload, event))
+	assert.Equal(t, &FreezeEvent{Account: alice.Addr.Bytes(), Frozen: true, Operator: hex.EncodeToString(officer.Addr.Bytes())}, event)
+	assert.Equal(t, "true", string(net.Invoke("peth", bob, "isFrozen", aliceHex).Payload))
+
+	// a frozen account can't send, but still receives until inbound is frozen
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", alice, "transfer", bobHex, "1").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "transfer", aliceHex, "100").Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", officer, "setFreezeInbound", "true").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "setFreezeInbound", "true").Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", owner, "transfer", aliceHex, "100").Status)
+
+	// wipe moves the balance to bob and leaves a record
+	net.Time = 1000
+	res := net.Invoke("peth", officer, "wipeFrozen", aliceHex, "court order", bobHex)
+	assert.Equal(t, int32(shim.OK), res.Status)
+	assert.Equal(t, EventWipeFrozen, net.Event.EventName)
+	assert.Equal(t, res.Payload, net.Event.Payload)
+	rec := &WipeRecord{}
+	assert.NoError(t, json.Unmarshal(res.Payload, rec))
+	assert.Equal(t, &WipeRecord{
+		Id:       net.Event.TxId,
+		Account:  aliceHex,
+		Amount:   "400",
+		To:       bobHex,
+		Reason:   "court order",
+		Operator: hex.EncodeToString(officer.Addr.Bytes()),
+		Time:     1000,
+	}, rec)
+	assert.Equal(t, res.Payload, net.Invoke("peth", bob, "getWipeRecord", rec.Id).Payload)
+	assert.Equal(t, big.NewInt(400).Bytes(), net.Invoke("peth", bob, "balanceOf", bobHex).Payload)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", officer, "wipeFrozen", aliceHex, "court order").Status)
+
+	// wipe without a to burns the balance
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", officer, "freeze", bobHex).Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "wipeFrozen", bobHex, "sanctioned").Status)
+	burnt := &WipeRecord{}
+	assert.NoError(t, json.Unmarshal(net.Event.Payload, burnt))
+	assert.Equal(t, "", burnt.To)
+	assert.Equal(t, big.NewInt(600).Bytes(), net.GetState("peth", TokenTotalSupply))
+
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", officer, "unfreeze", aliceHex).Status)
+	assert.Equal(t, "false", string(net.Invoke("peth", bob, "isFrozen", aliceHex).Payload))
+}
+
+func TestHolders_listAndBalances(t *testing.T) {
+	net := utils.NewMockNet()
+	owner, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), net.Deploy("peth", &ERC20TokenImpl{}, owner, "polyEth", "pEth", "18", "1000", "").Status)
+	balances := map[string]string{hex.EncodeToString(owner.Addr.Bytes()): "940"}
+	var last *utils.MockUser
+	for i := 1; i <= 3; i++ {
+		last, err = utils.NewMockUser("Org1MSP", nil)
+		assert.NoError(t, err)
+		acc := hex.EncodeToString(last.Addr.Bytes())
+		amt := strconv.Itoa(10 * i)
+		assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "transfer", acc, amt).Status)
+		assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "approve", acc, amt).Status)
+		balances[acc] = amt
+	}
+	assert.Equal(t, "4", string(net.Invoke("peth", owner, "holderCount").Payload))
+
+	listed := make(map[string]string)
+	bookmark := ""
+	for {
+		res := net.Invoke("peth", owner, "listHolders", "3", bookmark)
+		assert.Equal(t, int32(shim.OK), res.Status)
+		page := &HolderPage{}
+		assert.NoError(t, json.Unmarshal(res.Payload, page))
+		assert.True(t, len(page.Holders) <= 3)
+		for _, h := range page.Holders {
+			listed[h.Address] = h.Balance
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	assert.Equal(t, balances, listed)
+
+	var accs []string
+	for acc := range balances {
+		accs = append(accs, acc)
+	}
+	res := net.Invoke("peth", owner, append([]string{"balancesOf"}, accs...)...)
+	assert.Equal(t, int32(shim.OK), res.Status)
+	var hbs []*HolderBalance
+	assert.NoError(t, json.Unmarshal(res.Payload, &hbs))
+	assert.Len(t, hbs, len(accs))
+	for i, hb := range hbs {
+		assert.Equal(t, &HolderBalance{Address: accs[i], Balance: balances[accs[i]]}, hb)
+	}
+
+	res = net.Invoke("peth", owner, "listAllowances", hex.EncodeToString(owner.Addr.Bytes()))
+	assert.Equal(t, int32(shim.OK), res.Status)
+	allowances := &AllowancePage{}
+	assert.NoError(t, json.Unmarshal(res.Payload, allowances))
+	assert.Len(t, allowances.Allowances, 3)
+	for _, a := range allowances.Allowances {
+		assert.Equal(t, balances[a.Spender], a.Amount)
+	}
+
+	// an emptied balance leaves the index
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", last, "transfer", hex.EncodeToString(owner.Addr.Bytes()), "30").Status)
+	assert.Equal(t, "3", string(net.Invoke("peth", owner, "holderCount").Payload))
+}
+
+func TestMinter_allowances(t *testing.T) {
+	net := utils.NewMockNet()
+	owner, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	configurator, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	minter, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), net.Deploy("peth", &ERC20TokenImpl{}, owner, "polyEth", "pEth", "18", "1000", "", "1600").Status)
+	assert.Equal(t, big.NewInt(1600).Bytes(), net.Invoke("peth", owner, "getMaxSupply").Payload)
+	configuratorHex, minterHex := hex.EncodeToString(configurator.Addr.Bytes()), hex.EncodeToString(minter.Addr.Bytes())
+
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", configurator, "configureMinter", minterHex, "500").Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", configurator, "setConfigurator", configuratorHex).Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "setConfigurator", configuratorHex).Status)
+	assert.Equal(t, EventConfiguratorSet, net.Event.EventName)
+	assert.Equal(t, "true", string(net.Invoke("peth", owner, "isConfigurator", configuratorHex).Payload))
+
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", owner, "minterAllowance", minterHex).Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "1").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", configurator, "configureMinter", minterHex, "500").Status)
+	assert.Equal(t, EventMinterConfigured, net.Event.EventName)
+	event := &MinterConfiguredEvent{}
+	assert.NoError(t, json.Unmarshal(net.Event.Payload, event))
+	assert.Equal(t, &MinterConfiguredEvent{
+		Minter:       minter.Addr.Bytes(),
+		Allowance:    big.NewInt(500).Bytes(),
+		Configurator: configurator.Addr.Bytes(),
+	}, event)
+
+	// the minter spends its allowance down to zero and stays a minter
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "300").Status)
+	assert.Equal(t, big.NewInt(200).Bytes(), net.Invoke("peth", owner, "minterAllowance", minterHex).Payload)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "201").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "200").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "minterAllowance", minterHex).Status)
+	assert.Equal(t, big.NewInt(0).Bytes(), net.Invoke("peth", owner, "minterAllowance", minterHex).Payload)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "1").Status)
+
+	// allowances never lift the max supply
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", configurator, "configureMinter", minterHex, "500").Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "101").Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", minter, "mint", minterHex, "100").Status)
+	assert.Equal(t, big.NewInt(1600).Bytes(), net.GetState("peth", TokenTotalSupply))
+
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", configurator, "removeMinter", minterHex).Status)
+	assert.NoError(t, json.Unmarshal(net.Event.Payload, event))
+	assert.True(t, event.Removed)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", owner, "minterAllowance", minterHex).Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "delConfigurator", configuratorHex).Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", configurator, "configureMinter", minterHex, "500").Status)
+}
+
+func TestPermit_transferWithAuthorization(t *testing.T) {
+	net := utils.NewMockNet()
+	owner, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	relayer, err := utils.NewMockUser("Org1MSP", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), net.Deploy("peth", &ERC20TokenImpl{}, owner, "polyEth", "pEth", "18", "1000", "").Status)
+	domain, err := hex.DecodeString(string(net.Invoke("peth", relayer, "getDomain").Payload))
+	assert.NoError(t, err)
+	assert.Len(t, domain, 32)
+
+	// the holder signs off chain with a key that never sends a tx
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	holder := utils.GetAddrFromRaw(pub).Bytes()
+	sign := func(digest []byte) []string {
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest)
+		assert.NoError(t, err)
+		return []string{SchemeP256, hex.EncodeToString(sig), hex.EncodeToString(pub)}
+	}
+	holderHex, relayerHex := hex.EncodeToString(holder), hex.EncodeToString(relayer.Addr.Bytes())
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", owner, "transfer", holderHex, "500").Status)
+
+	net.Time = 1000
+	p := &Permit{Owner: holder, Spender: relayer.Addr.Bytes(), Value: big.NewInt(200), Nonce: 0, Deadline: 2000}
+	permitArgs := append([]string{"permit", holderHex, relayerHex, "200", "0", "2000"}, sign(p.digest(domain))...)
+	assert.Equal(t, "0", string(net.Invoke("peth", relayer, "nonces", holderHex).Payload))
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", relayer, append([]string{"permit", holderHex, relayerHex, "300"}, permitArgs[4:]...)...).Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", relayer, permitArgs...).Status)
+	assert.Equal(t, EventApproval, net.Event.EventName)
+	approval := &ApprovalEvent{}
+	assert.NoError(t, json.Unmarshal(net.Event.Payload, approval))
+	assert.Equal(t, &ApprovalEvent{From: holder, Spender: relayer.Addr.Bytes(), Amount: big.NewInt(200).Bytes()}, approval)
+	assert.Equal(t, "1", string(net.Invoke("peth", relayer, "nonces", holderHex).Payload))
+	assert.Equal(t, big.NewInt(200).Bytes(), net.Invoke("peth", relayer, "allowance", holderHex, relayerHex).Payload)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", relayer, permitArgs...).Status)
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", relayer, "transferFrom", holderHex, relayerHex, "200").Status)
+
+	// an expired permit is rejected even with the right nonce
+	p.Nonce, p.Deadline = 1, 999
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", relayer, append([]string{"permit", holderHex, relayerHex, "200", "1", "999"}, sign(p.digest(domain))...)...).Status)
+
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	assert.NoError(t, err)
+	nonceHex := hex.EncodeToString(nonce)
+	a := &TransferAuthorization{From: holder, To: relayer.Addr.Bytes(), Value: big.NewInt(100), ValidAfter: 1000, ValidBefore: 2000, Nonce: nonce}
+	authArgs := append([]string{"transferWithAuthorization", holderHex, relayerHex, "100", "1000", "2000", nonceHex}, sign(a.digest(domain))...)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", relayer, authArgs...).Status)
+	net.Time = 1001
+	assert.Equal(t, "false", string(net.Invoke("peth", relayer, "authorizationState", holderHex, nonceHex).Payload))
+	assert.Equal(t, int32(shim.OK), net.Invoke("peth", relayer, authArgs...).Status)
+	assert.Equal(t, EventTranfer, net.Event.EventName)
+	transfer := &TransferEvent{}
+	assert.NoError(t, json.Unmarshal(net.Event.Payload, transfer))
+	assert.Equal(t, &TransferEvent{From: holder, To: relayer.Addr.Bytes(), Amount: big.NewInt(100).Bytes()}, transfer)
+	assert.Equal(t, "true", string(net.Invoke("peth", relayer, "authorizationState", holderHex, nonceHex).Payload))
+	assert.NotEqual(t, int32(shim.OK), net.Invoke("peth", relayer, authArgs...).Status)
+	assert.Equal(t, big.NewInt(200).Bytes(), net.Invoke("peth", relayer, "balanceOf", holderHex).Payload)
+	assert.Equal(t, big.NewInt(300).Bytes(), net.Invoke("peth", relayer, "balanceOf", relayerHex).Payload)
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package assets
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+)
+
+const (
+	TokenFreezeInbound = TokenId + "-FreezeInbound"
+	TokenWipe          = TokenId + "-Wipe-%s"
+
+	EventFreeze     = TokenId + "freeze"
+	EventWipeFrozen = TokenId + "wipeFrozen"
+
+	// TokenComplianceAttr is the certificate attribute of compliance officers,
+	// who can freeze and wipe accounts besides the owner.
+	TokenComplianceAttr = "erc20.compliance"
+)
+
+// WipeRecord is kept for every wipeFrozen as the audit trail of seizures.
+type WipeRecord struct {
+	Id       string `json:"id"`
+	Account  string `json:"account"`
+	Amount   string `json:"amount"`
+	To       string `json:"to,omitempty"`
+	Reason   string `json:"reason"`
+	Operator string `json:"operator"`
+	Time     int64  `json:"time"`
+}
+
+// args: hex account
+func (token *ERC20TokenImpl) freeze(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	return token.setFrozen(stub, args, true)
+}
+
+// args: hex account
+func (token *ERC20TokenImpl) unfreeze(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	return token.setFrozen(stub, args, false)
+}
+
+func (token *ERC20TokenImpl) setFrozen(stub shim.ChaincodeStubInterface, args [][]byte, frozen bool) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	operator, err := checkFreezer(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	acc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	if frozen {
+		err = stub.PutState(freezeKey(acc), []byte{1})
+	} else {
+		err = stub.DelState(freezeKey(acc))
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to update freeze: %v", err))
+	}
+	rawEvent, err := json.Marshal(&FreezeEvent{
+		Account:  acc,
+		Frozen:   frozen,
+		Operator: operator,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventFreeze, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (token *ERC20TokenImpl) isFrozen(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	acc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	frozen, err := isFrozen(stub, acc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatBool(frozen)))
+}
+
+// setFreezeInbound decides if frozen accounts can still receive, "false" by default.
+// args: true|false
+func (token *ERC20TokenImpl) setFreezeInbound(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	block, err := strconv.ParseBool(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse bool: %v", err))
+	}
+	if block {
+		err = stub.PutState(TokenFreezeInbound, []byte{1})
+	} else {
+		err = stub.DelState(TokenFreezeInbound)
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to put freeze inbound: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (token *ERC20TokenImpl) getFreezeInbound(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(TokenFreezeInbound)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatBool(len(raw) > 0)))
+}
+
+// wipeFrozen seizes the whole balance of a frozen account, burning it or moving
+// it to the given account, and keeps a WipeRecord under the txid.
+// args: hex account, reason, [hex to]
+func (token *ERC20TokenImpl) wipeFrozen(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("number of args should be 2 or 3")
+	}
+	operator, err := checkFreezer(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	acc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	if len(args[1]) == 0 {
+		return shim.Error("reason is required")
+	}
+	frozen, err := isFrozen(stub, acc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !frozen {
+		return shim.Error(fmt.Sprintf("account %x is not frozen", acc))
+	}
+	rawBal, err := stub.GetState(balanceKey(acc))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get balance: %v", err))
+	}
+	bal := big.NewInt(0).SetBytes(rawBal)
+	if bal.Sign() == 0 {
+		return shim.Error(fmt.Sprintf("account %x has no balance", acc))
+	}
+
+	to := common.Address{}.Bytes()
+	if len(args) == 3 {
+		if to, err = hex.DecodeString(string(args[2])); err != nil {
+			return shim.Error(fmt.Sprintf("failed to decode hex to: %v", err))
+		}
+		if err := moveBalance(stub, acc, to, bal); err != nil {
+			return shim.Error(err.Error())
+		}
+	} else if err := changeSupply(stub, acc, big.NewInt(0).Neg(bal)); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rec := &WipeRecord{
+		Id:       stub.GetTxID(),
+		Account:  hex.EncodeToString(acc),
+		Amount:   bal.String(),
+		Reason:   string(args[1]),
+		Operator: operator,
+		Time:     now,
+	}
+	if len(args) == 3 {
+		rec.To = hex.EncodeToString(to)
+	}
+	rawRec, err := json.Marshal(rec)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(fmt.Sprintf(TokenWipe, rec.Id), rawRec); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put wipe record: %v", err))
+	}
+	logger.Infof("wipe frozen account %x: (amount: %s, to: %x, reason: %s, operator: %s)", acc, bal.String(), to, rec.Reason, operator)
+	if err := stub.SetEvent(EventWipeFrozen, rawRec); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(rawRec)
+}
+
+// args: wipe id (txid)
+func (token *ERC20TokenImpl) getWipeRecord(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	raw, err := stub.GetState(fmt.Sprintf(TokenWipe, string(args[0])))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(raw) == 0 {
+		return shim.Error(fmt.Sprintf("no wipe record %s", args[0]))
+	}
+	return shim.Success(raw)
+}
+
+// checkFreezer returns the hex address of the owner or a compliance officer.
+func checkFreezer(stub shim.ChaincodeStubInterface) (string, error) {
+	if owner, err := checkOwner(stub); err == nil {
+		return hex.EncodeToString(owner), nil
+	}
+	if err := cid.AssertAttributeValue(stub, TokenComplianceAttr, "true"); err != nil {
+		return "", fmt.Errorf("neither owner nor compliance officer: %v", err)
+	}
+	addr, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(addr.Bytes()), nil
+}
+
+func isFrozen(stub shim.ChaincodeStubInterface, acc []byte) (bool, error) {
+	raw, err := stub.GetState(freezeKey(acc))
+	if err != nil {
+		return false, fmt.Errorf("failed to get freeze: %v", err)
+	}
+	return len(raw) > 0, nil
+}
+
+// checkFrozen fails if from is frozen, or to is frozen and inbound is blocked.
+// Either can be nil.
+func checkFrozen(stub shim.ChaincodeStubInterface, from, to []byte) error {
+	if from != nil {
+		frozen, err := isFrozen(stub, from)
+		if err != nil {
+			return err
+		}
+		if frozen {
+			return fmt.Errorf("account %x is frozen", from)
+		}
+	}
+	if to == nil {
+		return nil
+	}
+	frozen, err := isFrozen(stub, to)
+	if err != nil || !frozen {
+		return err
+	}
+	block, err := stub.GetState(TokenFreezeInbound)
+	if err != nil {
+		return fmt.Errorf("failed to get freeze inbound: %v", err)
+	}
+	if len(block) > 0 {
+		return fmt.Errorf("account %x is frozen and can't receive", to)
+	}
+	return nil
+}
+
+// moveBalance moves amt from one account to another without the checks of transferLogic.
+func moveBalance(stub shim.ChaincodeStubInterface, from, to []byte, amt *big.Int) error {
+	if bytes.Equal(from, to) {
+		return fmt.Errorf("can't move to the same account")
+	}
+	rawFrom, err := stub.GetState(balanceKey(from))
+	if err != nil {
+		return fmt.Errorf("failed To get From balance: %v", err)
+	}
+	fromBal := big.NewInt(0).SetBytes(rawFrom)
+	if fromBal.Sub(fromBal, amt).Sign() < 0 {
+		return fmt.Errorf("From balance is less than the amount %s", amt.String())
+	}
+	rawTo, err := stub.GetState(balanceKey(to))
+	if err != nil {
+		return fmt.Errorf("failed To get receive account balance: %v", err)
+	}
+	toBal := big.NewInt(0).SetBytes(rawTo)
+	toBal.Add(toBal, amt)
+	if err := putBalance(stub, from, fromBal); err != nil {
+		return fmt.Errorf("failed To put balance for From account: %v", err)
+	}
+	if err := putBalance(stub, to, toBal); err != nil {
+		return fmt.Errorf("failed To put balance for receiver account: %v", err)
+	}
+	return nil
+}
+
+func freezeKey(acc []byte) string {
+	return fmt.Sprintf(TokenFreeze, hex.EncodeToString(acc))
+}
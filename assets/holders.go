@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package assets
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TokenHolderType indexes the accounts with a positive balance, [hex account].
+	TokenHolderType = TokenId + "-Holder"
+
+	DefaultPageSize = utils.DefaultPageSize
+	MaxBalancesOf   = 200
+	MaxReindex      = 1000
+)
+
+type HolderBalance struct {
+	Address string `json:"address"`
+	Balance string `json:"balance"`
+}
+
+type HolderPage struct {
+	Holders  []*HolderBalance `json:"holders"`
+	Bookmark string           `json:"bookmark"`
+}
+
+type Allowance struct {
+	Spender string `json:"spender"`
+	Amount  string `json:"amount"`
+}
+
+type AllowancePage struct {
+	Allowances []*Allowance `json:"allowances"`
+	Bookmark   string       `json:"bookmark"`
+}
+
+// args: [pageSize, [bookmark]]
+func (token *ERC20TokenImpl) listHolders(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	pageSize, bookmark, err := utils.ParsePageArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(TokenHolderType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query holders: %v", err))
+	}
+	defer iter.Close()
+	page := &HolderPage{Holders: make([]*HolderBalance, 0), Bookmark: meta.GetBookmark()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate holders: %v", err))
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 1 {
+			return shim.Error(fmt.Sprintf("wrong holder key %s: %v", kv.Key, err))
+		}
+		acc, err := hex.DecodeString(attrs[0])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to decode hex holder: %v", err))
+		}
+		hb, err := getHolderBalance(stub, acc)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Holders = append(page.Holders, hb)
+	}
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// holderCount walks the whole index, it's meant for queries and not for invokes.
+func (token *ERC20TokenImpl) holderCount(stub shim.ChaincodeStubInterface) pb.Response {
+	iter, err := stub.GetStateByPartialCompositeKey(TokenHolderType, []string{})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query holders: %v", err))
+	}
+	defer iter.Close()
+	count := uint64(0)
+	for iter.HasNext() {
+		if _, err := iter.Next(); err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate holders: %v", err))
+		}
+		count++
+	}
+	return shim.Success([]byte(strconv.FormatUint(count, 10)))
+}
+
+// args: hex account...
+func (token *ERC20TokenImpl) balancesOf(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) == 0 || len(args) > MaxBalancesOf {
+		return shim.Error(fmt.Sprintf("number of args should be 1 to %d", MaxBalancesOf))
+	}
+	res := make([]*HolderBalance, 0, len(args))
+	for _, arg := range args {
+		acc, err := hex.DecodeString(string(arg))
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to decode hex holder: %v", err))
+		}
+		hb, err := getHolderBalance(stub, acc)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		res = append(res, hb)
+	}
+	raw, err := json.Marshal(res)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// listAllowances walks the approve keys of owner, which share the same prefix.
+// args: hex owner, [pageSize, [bookmark]]
+func (token *ERC20TokenImpl) listAllowances(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("owner is required")
+	}
+	owner, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex owner: %v", err))
+	}
+	pageSize, bookmark, err := utils.ParsePageArgs(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	prefix := approveKey(owner, nil)
+	iter, meta, err := stub.GetStateByRangeWithPagination(prefix, utils.PrefixEnd(prefix), pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query allowances: %v", err))
+	}
+	defer iter.Close()
+	page := &AllowancePage{Allowances: make([]*Allowance, 0), Bookmark: meta.GetBookmark()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate allowances: %v", err))
+		}
+		page.Allowances = append(page.Allowances, &Allowance{
+			Spender: strings.TrimPrefix(kv.Key, prefix),
+			Amount:  big.NewInt(0).SetBytes(kv.Value).String(),
+		})
+	}
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// reindexHolders adds the balances written before the holder index existed, at
+// most limit keys from startKey. It returns the key to start the next call with,
+// empty when done. args: [startKey, [limit]]
+func (token *ERC20TokenImpl) reindexHolders(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) > 2 {
+		return shim.Error("number of args should be at most 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	prefix := TokenId + "-"
+	start := prefix
+	if len(args) > 0 && len(args[0]) > 0 {
+		start = string(args[0])
+	}
+	limit := MaxReindex
+	if len(args) == 2 {
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil || n <= 0 || n > MaxReindex {
+			return shim.Error(fmt.Sprintf("limit should be 1 to %d", MaxReindex))
+		}
+		limit = n
+	}
+	iter, err := stub.GetStateByRange(start, utils.PrefixEnd(prefix))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query balances: %v", err))
+	}
+	defer iter.Close()
+	next := ""
+	for n := 0; iter.HasNext(); n++ {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate balances: %v", err))
+		}
+		if n == limit {
+			next = kv.Key
+			break
+		}
+		acc, ok := parseBalanceKey(kv.Key)
+		if !ok || len(kv.Value) == 0 {
+			continue
+		}
+		if err := putHolder(stub, acc); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success([]byte(next))
+}
+
+// putBalance writes the balance of acc and keeps the holder index in step,
+// deleting both when the balance is zero.
+func putBalance(stub shim.ChaincodeStubInterface, acc []byte, bal *big.Int) error {
+	key, err := holderKey(stub, acc)
+	if err != nil {
+		return err
+	}
+	if bal.Sign() == 0 {
+		if err := stub.DelState(balanceKey(acc)); err != nil {
+			return err
+		}
+		return stub.DelState(key)
+	}
+	if err := stub.PutState(balanceKey(acc), bal.Bytes()); err != nil {
+		return err
+	}
+	// a blind write, so indexing an existing holder again doesn't add conflicts
+	return stub.PutState(key, []byte{1})
+}
+
+func putHolder(stub shim.ChaincodeStubInterface, acc []byte) error {
+	key, err := holderKey(stub, acc)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, []byte{1}); err != nil {
+		return fmt.Errorf("failed to put holder: %v", err)
+	}
+	return nil
+}
+
+func getHolderBalance(stub shim.ChaincodeStubInterface, acc []byte) (*HolderBalance, error) {
+	raw, err := stub.GetState(balanceKey(acc))
+	if err != nil {
+		return nil, fmt.Errorf("failed To get balance: %v", err)
+	}
+	return &HolderBalance{
+		Address: hex.EncodeToString(acc),
+		Balance: big.NewInt(0).SetBytes(raw).String(),
+	}, nil
+}
+
+func holderKey(stub shim.ChaincodeStubInterface, acc []byte) (string, error) {
+	key, err := stub.CreateCompositeKey(TokenHolderType, []string{hex.EncodeToString(acc)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create holder key: %v", err)
+	}
+	return key, nil
+}
+
+// parseBalanceKey returns the account of a TokenBalance key.
+func parseBalanceKey(key string) ([]byte, bool) {
+	prefix, suffix := TokenId+"-", "-Balance"
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) {
+		return nil, false
+	}
+	acc, err := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix))
+	if err != nil {
+		return nil, false
+	}
+	return acc, true
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package assets
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+)
+
+const (
+	TokenConfigurator  = TokenId + "-%s-Configurator"
+	TokenMintAllowance = TokenId + "-%s-MintAllowance"
+
+	EventConfiguratorSet  = TokenId + "configuratorSet"
+	EventMinterConfigured = TokenId + "minterConfigured"
+)
+
+func (token *ERC20TokenImpl) getMaxSupply(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(TokenMaxSupply)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(raw)
+}
+
+// args: hex account
+func (token *ERC20TokenImpl) setConfigurator(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	return token.changeConfigurator(stub, args, true)
+}
+
+// args: hex account
+func (token *ERC20TokenImpl) delConfigurator(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	return token.changeConfigurator(stub, args, false)
+}
+
+func (token *ERC20TokenImpl) changeConfigurator(stub shim.ChaincodeStubInterface, args [][]byte, enabled bool) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	acc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	if enabled {
+		err = stub.PutState(configuratorKey(acc), []byte{1})
+	} else {
+		err = stub.DelState(configuratorKey(acc))
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to update configurator: %v", err))
+	}
+	rawEvent, err := json.Marshal(&ConfiguratorSetEvent{
+		Account:        acc,
+		IsConfigurator: enabled,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventConfiguratorSet, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (token *ERC20TokenImpl) isConfigurator(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	acc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	raw, _ := stub.GetState(configuratorKey(acc))
+	return shim.Success([]byte(strconv.FormatBool(len(raw) > 0)))
+}
+
+// configureMinter makes the account a minter, or resets its mint allowance.
+// args: hex minter, allowance
+func (token *ERC20TokenImpl) configureMinter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
+	}
+	configurator, err := checkConfigurator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	minter, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex minter: %v", err))
+	}
+	allowance, ok := big.NewInt(0).SetString(string(args[1]), 10)
+	if !ok || allowance.Sign() < 0 {
+		return shim.Error(fmt.Sprintf("wrong allowance: %s", args[1]))
+	}
+	if err := putMintAllowance(stub, minter, allowance); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitMinterConfigured(stub, minter, allowance, false, configurator)
+}
+
+// args: hex minter
+func (token *ERC20TokenImpl) removeMinter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	configurator, err := checkConfigurator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	minter, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex minter: %v", err))
+	}
+	if err := stub.DelState(mintAllowanceKey(minter)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to del minter: %v", err))
+	}
+	return emitMinterConfigured(stub, minter, big.NewInt(0), true, configurator)
+}
+
+// minterAllowance returns the mint allowance left, failing if not a minter.
+// args: hex minter
+func (token *ERC20TokenImpl) minterAllowance(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	minter, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex minter: %v", err))
+	}
+	allowance, err := getMintAllowance(stub, minter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if allowance == nil {
+		return shim.Error(fmt.Sprintf("%x is not minter", minter))
+	}
+	return shim.Success(allowance.Bytes())
+}
+
+// useMintAllowance returns the address minting amt. The owner mints without
+// limit, a minter spends its allowance.
+func useMintAllowance(stub shim.ChaincodeStubInterface, amt *big.Int) ([]byte, error) {
+	sender, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed To get tx sender: %v", err)
+	}
+	owner, err := stub.GetState(TokenOwner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get owner: %v", err)
+	}
+	if bytes.Equal(sender.Bytes(), owner) {
+		return owner, nil
+	}
+	allowance, err := getMintAllowance(stub, sender.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if allowance == nil {
+		return nil, fmt.Errorf("%x is neither owner nor minter", sender.Bytes())
+	}
+	if allowance.Cmp(amt) < 0 {
+		return nil, fmt.Errorf("mint allowance %s is less than the amount %s", allowance.String(), amt.String())
+	}
+	if err := putMintAllowance(stub, sender.Bytes(), allowance.Sub(allowance, amt)); err != nil {
+		return nil, err
+	}
+	return sender.Bytes(), nil
+}
+
+// checkConfigurator returns the owner or a configurator calling.
+func checkConfigurator(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	if owner, err := checkOwner(stub); err == nil {
+		return owner, nil
+	}
+	sender, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed To get tx sender: %v", err)
+	}
+	raw, err := stub.GetState(configuratorKey(sender.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configurator: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%x is neither owner nor configurator", sender.Bytes())
+	}
+	return sender.Bytes(), nil
+}
+
+// getMintAllowance returns nil if acc is not a minter.
+func getMintAllowance(stub shim.ChaincodeStubInterface, acc []byte) (*big.Int, error) {
+	raw, err := stub.GetState(mintAllowanceKey(acc))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mint allowance: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return big.NewInt(0).SetBytes(raw), nil
+}
+
+// putMintAllowance keeps a leading zero byte so that a minter with nothing left
+// is still a minter.
+func putMintAllowance(stub shim.ChaincodeStubInterface, acc []byte, allowance *big.Int) error {
+	if err := stub.PutState(mintAllowanceKey(acc), append([]byte{0}, allowance.Bytes()...)); err != nil {
+		return fmt.Errorf("failed to put mint allowance: %v", err)
+	}
+	return nil
+}
+
+func emitMinterConfigured(stub shim.ChaincodeStubInterface, minter []byte, allowance *big.Int, removed bool, configurator []byte) pb.Response {
+	rawEvent, err := json.Marshal(&MinterConfiguredEvent{
+		Minter:       minter,
+		Allowance:    allowance.Bytes(),
+		Removed:      removed,
+		Configurator: configurator,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventMinterConfigured, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func configuratorKey(acc []byte) string {
+	return fmt.Sprintf(TokenConfigurator, hex.EncodeToString(acc))
+}
+
+func mintAllowanceKey(acc []byte) string {
+	return fmt.Sprintf(TokenMintAllowance, hex.EncodeToString(acc))
+}
@@ -0,0 +1,402 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package assets
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcom "github.com/polynetwork/poly/common"
+	"golang.org/x/crypto/sha3"
+	"math/big"
+	"strconv"
+)
+
+const (
+	TokenDomain        = TokenId + "-Domain"
+	TokenNonce         = TokenId + "-%s-Nonce"
+	TokenAuthorization = TokenId + "-%s-Authorization-%s"
+
+	// SchemeP256 is a fabric style key, the address is the sha256 of the DER
+	// public key like GetAddrFromRaw. SchemeSecp256k1 is an ethereum key and address.
+	SchemeP256      = "p256"
+	SchemeSecp256k1 = "secp256k1"
+
+	PermitMethod                    = "permit"
+	TransferWithAuthorizationMethod = "transferWithAuthorization"
+)
+
+// Permit is the approval signed by Owner off chain. Every owner has a sequential
+// nonce and the permit is valid until Deadline, a timestamp in seconds.
+type Permit struct {
+	Owner    []byte
+	Spender  []byte
+	Value    *big.Int
+	Nonce    uint64
+	Deadline uint64
+}
+
+// digest is sha256 of domain, method and the fields, which is signed by the owner.
+func (p *Permit) digest(domain []byte) []byte {
+	sink := pcom.NewZeroCopySink(nil)
+	sink.WriteVarBytes(domain)
+	sink.WriteString(PermitMethod)
+	sink.WriteVarBytes(p.Owner)
+	sink.WriteVarBytes(p.Spender)
+	sink.WriteVarBytes(p.Value.Bytes())
+	sink.WriteUint64(p.Nonce)
+	sink.WriteUint64(p.Deadline)
+	hash := sha256.Sum256(sink.Bytes())
+	return hash[:]
+}
+
+// TransferAuthorization is a transfer signed by From off chain, valid in
+// (ValidAfter, ValidBefore) and only once for the random 32 bytes Nonce.
+type TransferAuthorization struct {
+	From        []byte
+	To          []byte
+	Value       *big.Int
+	ValidAfter  uint64
+	ValidBefore uint64
+	Nonce       []byte
+}
+
+func (a *TransferAuthorization) digest(domain []byte) []byte {
+	sink := pcom.NewZeroCopySink(nil)
+	sink.WriteVarBytes(domain)
+	sink.WriteString(TransferWithAuthorizationMethod)
+	sink.WriteVarBytes(a.From)
+	sink.WriteVarBytes(a.To)
+	sink.WriteVarBytes(a.Value.Bytes())
+	sink.WriteUint64(a.ValidAfter)
+	sink.WriteUint64(a.ValidBefore)
+	sink.WriteVarBytes(a.Nonce)
+	hash := sha256.Sum256(sink.Bytes())
+	return hash[:]
+}
+
+// getDomain returns the domain signed in permits and authorizations, which is
+// unique for every token deployment.
+func (token *ERC20TokenImpl) getDomain(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(TokenDomain)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(hex.EncodeToString(raw)))
+}
+
+// args: hex owner
+func (token *ERC20TokenImpl) nonces(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	owner, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex owner: %v", err))
+	}
+	nonce, err := getNonce(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatUint(nonce, 10)))
+}
+
+// permit sets the allowance signed by owner, it can be submitted by anyone.
+// args: hex owner, hex spender, value, nonce, deadline, scheme, hex signature, [hex public key]
+func (token *ERC20TokenImpl) permit(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 7 && len(args) != 8 {
+		return shim.Error("number of args should be 7 or 8")
+	}
+	p := &Permit{}
+	var err error
+	if p.Owner, err = hex.DecodeString(string(args[0])); err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex owner: %v", err))
+	}
+	if p.Spender, err = hex.DecodeString(string(args[1])); err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex spender: %v", err))
+	}
+	var ok bool
+	if p.Value, ok = big.NewInt(0).SetString(string(args[2]), 10); !ok || p.Value.Sign() < 0 {
+		return shim.Error(fmt.Sprintf("wrong value: %s", args[2]))
+	}
+	if p.Nonce, err = strconv.ParseUint(string(args[3]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse nonce: %v", err))
+	}
+	if p.Deadline, err = strconv.ParseUint(string(args[4]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse deadline: %v", err))
+	}
+
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if uint64(now) > p.Deadline {
+		return shim.Error(fmt.Sprintf("permit expired at %d", p.Deadline))
+	}
+	domain, err := requireDomain(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkSigner(p.Owner, p.digest(domain), args[5:]); err != nil {
+		return shim.Error(err.Error())
+	}
+	nonce, err := getNonce(stub, p.Owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if nonce != p.Nonce {
+		return shim.Error(fmt.Sprintf("wrong nonce %d, expected %d", p.Nonce, nonce))
+	}
+	if err := stub.PutState(nonceKey(p.Owner), []byte(strconv.FormatUint(nonce+1, 10))); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put nonce: %v", err))
+	}
+	if err := checkFrozen(stub, p.Owner, nil); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key := approveKey(p.Owner, p.Spender)
+	if p.Value.Sign() == 0 {
+		err = stub.DelState(key)
+	} else {
+		err = stub.PutState(key, p.Value.Bytes())
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To put %s: %v", key, err))
+	}
+	rawEvent, err := json.Marshal(&ApprovalEvent{
+		Amount:  p.Value.Bytes(),
+		From:    p.Owner,
+		Spender: p.Spender,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventApproval, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// transferWithAuthorization transfers as signed by from, it can be submitted by anyone.
+// args: hex from, hex to, value, validAfter, validBefore, hex nonce, scheme, hex signature, [hex public key]
+func (token *ERC20TokenImpl) transferWithAuthorization(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 8 && len(args) != 9 {
+		return shim.Error("number of args should be 8 or 9")
+	}
+	a := &TransferAuthorization{}
+	var err error
+	if a.From, err = hex.DecodeString(string(args[0])); err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex from: %v", err))
+	}
+	if a.To, err = hex.DecodeString(string(args[1])); err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex to: %v", err))
+	}
+	var ok bool
+	if a.Value, ok = big.NewInt(0).SetString(string(args[2]), 10); !ok {
+		return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[2]))
+	}
+	if a.ValidAfter, err = strconv.ParseUint(string(args[3]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse validAfter: %v", err))
+	}
+	if a.ValidBefore, err = strconv.ParseUint(string(args[4]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse validBefore: %v", err))
+	}
+	if a.Nonce, err = hex.DecodeString(string(args[5])); err != nil || len(a.Nonce) != 32 {
+		return shim.Error(fmt.Sprintf("nonce should be 32 bytes in hex: %s", args[5]))
+	}
+
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if uint64(now) <= a.ValidAfter || uint64(now) >= a.ValidBefore {
+		return shim.Error(fmt.Sprintf("authorization is valid in (%d, %d) and now is %d", a.ValidAfter, a.ValidBefore, now))
+	}
+	domain, err := requireDomain(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkSigner(a.From, a.digest(domain), args[6:]); err != nil {
+		return shim.Error(err.Error())
+	}
+	key := authorizationKey(a.From, a.Nonce)
+	used, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get authorization state: %v", err))
+	}
+	if len(used) > 0 {
+		return shim.Error(fmt.Sprintf("authorization %x is used", a.Nonce))
+	}
+	if err := stub.PutState(key, []byte{1}); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put authorization state: %v", err))
+	}
+	// transferLogic checks frozen accounts and sets the transfer event
+	return token.transferLogic(stub, a.From, a.To, a.Value)
+}
+
+// args: hex from, hex nonce
+func (token *ERC20TokenImpl) authorizationState(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
+	}
+	from, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex from: %v", err))
+	}
+	nonce, err := hex.DecodeString(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex nonce: %v", err))
+	}
+	raw, err := stub.GetState(authorizationKey(from, nonce))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatBool(len(raw) > 0)))
+}
+
+// putDomain sets the domain once, from the channel and the txid of Init.
+func putDomain(stub shim.ChaincodeStubInterface) error {
+	raw, err := stub.GetState(TokenDomain)
+	if err != nil {
+		return fmt.Errorf("failed to get domain: %v", err)
+	}
+	if len(raw) > 0 {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(TokenId + "/" + stub.GetChannelID() + "/" + stub.GetTxID()))
+	if err := stub.PutState(TokenDomain, hash[:]); err != nil {
+		return fmt.Errorf("failed to put domain: %v", err)
+	}
+	return nil
+}
+
+// requireDomain fails for a token not upgraded yet, whose signatures could be
+// replayed on other tokens.
+func requireDomain(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	domain, err := stub.GetState(TokenDomain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain: %v", err)
+	}
+	if len(domain) == 0 {
+		return nil, fmt.Errorf("no domain, upgrade the chaincode first")
+	}
+	return domain, nil
+}
+
+// checkSigner verifies that the signature of digest is made by the key of addr.
+// sigArgs: scheme, hex signature, [hex public key]
+func checkSigner(addr, digest []byte, sigArgs [][]byte) error {
+	sig, err := hex.DecodeString(string(sigArgs[1]))
+	if err != nil {
+		return fmt.Errorf("failed to decode hex signature: %v", err)
+	}
+	var signer []byte
+	switch string(sigArgs[0]) {
+	case SchemeP256:
+		if len(sigArgs) != 3 {
+			return fmt.Errorf("public key is required for %s", SchemeP256)
+		}
+		pub, err := hex.DecodeString(string(sigArgs[2]))
+		if err != nil {
+			return fmt.Errorf("failed to decode hex public key: %v", err)
+		}
+		if signer, err = verifyP256(pub, digest, sig); err != nil {
+			return err
+		}
+	case SchemeSecp256k1:
+		if len(sigArgs) != 2 {
+			return fmt.Errorf("no public key is needed for %s", SchemeSecp256k1)
+		}
+		if signer, err = recoverSecp256k1(digest, sig); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown signature scheme %s", sigArgs[0])
+	}
+	if !bytes.Equal(signer, addr) {
+		return fmt.Errorf("signed by %x not %x", signer, addr)
+	}
+	return nil
+}
+
+// verifyP256 checks the ASN.1 signature by the DER public key and returns its address.
+func verifyP256(pub, digest, sig []byte) ([]byte, error) {
+	key, err := x509.ParsePKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("public key is not ECDSA P-256")
+	}
+	if !ecdsa.VerifyASN1(ecKey, digest, sig) {
+		return nil, fmt.Errorf("wrong signature")
+	}
+	return utils.GetAddrFromRaw(pub).Bytes(), nil
+}
+
+// recoverSecp256k1 recovers the ethereum address from the 65 bytes [R || S || V] signature.
+func recoverSecp256k1(digest, sig []byte) ([]byte, error) {
+	if len(sig) != 65 {
+		return nil, fmt.Errorf("signature should be 65 bytes")
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return nil, fmt.Errorf("wrong recovery id %d", sig[64])
+	}
+	compact := make([]byte, 0, 65)
+	compact = append(compact, 27+v)
+	compact = append(compact, sig[:64]...)
+	pub, _, err := btcec.RecoverCompact(btcec.S256(), compact, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover public key: %v", err)
+	}
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(pub.SerializeUncompressed()[1:])
+	return hash.Sum(nil)[12:], nil
+}
+
+func getNonce(stub shim.ChaincodeStubInterface, owner []byte) (uint64, error) {
+	raw, err := stub.GetState(nonceKey(owner))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get nonce: %v", err)
+	}
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(raw), 10, 64)
+}
+
+func nonceKey(owner []byte) string {
+	return fmt.Sprintf(TokenNonce, hex.EncodeToString(owner))
+}
+
+func authorizationKey(from, nonce []byte) string {
+	return fmt.Sprintf(TokenAuthorization, hex.EncodeToString(from), hex.EncodeToString(nonce))
+}
@@ -19,6 +19,7 @@ package assets
 import (
 	"errors"
 	"fmt"
+	"github.com/polynetwork/fabric-contract/utils"
 	"github.com/polynetwork/poly/common"
 	pcom "github.com/polynetwork/poly/native/service/cross_chain_manager/common"
 )
@@ -35,6 +36,42 @@ type ApprovalEvent struct {
 	Amount  []byte `json:"amount"`
 }
 
+type MinterSetEvent struct {
+	Chaincode string `json:"chaincode"`
+	IsMinter  bool   `json:"is_minter"`
+}
+
+// MintEvent is the transfer event of a mint, from the zero address, with the minter.
+type MintEvent struct {
+	From   []byte `json:"from"`
+	To     []byte `json:"to"`
+	Amount []byte `json:"amount"`
+	Minter []byte `json:"minter"`
+}
+
+type ConfiguratorSetEvent struct {
+	Account        []byte `json:"account"`
+	IsConfigurator bool   `json:"is_configurator"`
+}
+
+type MinterConfiguredEvent struct {
+	Minter       []byte `json:"minter"`
+	Allowance    []byte `json:"allowance"`
+	Removed      bool   `json:"removed"`
+	Configurator []byte `json:"configurator"`
+}
+
+type FreezeEvent struct {
+	Account  []byte `json:"account"`
+	Frozen   bool   `json:"frozen"`
+	Operator string `json:"operator"`
+}
+
+type CCMChangedEvent struct {
+	CCM     string              `json:"ccm"`
+	Trusted []*utils.TrustedCCM `json:"trusted"`
+}
+
 type TransferOwnershipEvent struct {
 	OldOwner []byte `json:"old_owner"`
 	NewOwner []byte `json:"new_owner"`
@@ -44,6 +44,7 @@ const (
 	ToPolyTx                  = "to_poly"
 	FromPolyTx                = "from_poly"
 	CallerLimitKey            = "ccm_caller_key"
+	ExtendedArgsKey           = "ccm_extended_args-%s"
 )
 
 var logger = shim.NewLogger("CrossChainManager")
@@ -123,11 +124,15 @@ func (manager *CrossChainManager) Invoke(stub shim.ChaincodeStubInterface) peer.
 		return manager.isAlreadyDone(stub, args)
 	case "getPolyConsensusPeers":
 		return manager.getPolyConsensusPeers(stub)
+	case "setExtendedArgs":
+		return manager.setExtendedArgs(stub, args)
+	case "isExtendedArgs":
+		return manager.isExtendedArgs(stub, args)
 	}
 
 	return shim.Error("Invalid invoke function name. Expecting " +
 		"\"initGenesisBlock\" \"changeBookKeeper\" \"crossChain\" \"verifyHeaderAndExecuteTx\" " +
-		"\"getPolyEpochHeight\" \"isAlreadyDone\" \"getPolyConsensusPeers\"")
+		"\"getPolyEpochHeight\" \"isAlreadyDone\" \"getPolyConsensusPeers\" \"setExtendedArgs\" \"isExtendedArgs\"")
 }
 
 func (manager *CrossChainManager) initGenesisBlock(stub shim.ChaincodeStubInterface, args [][]byte) peer.Response {
@@ -209,6 +214,52 @@ func (manager *CrossChainManager) getPolyEpochHeight(stub shim.ChaincodeStubInte
 	return shim.Success(val)
 }
 
+// setExtendedArgs lets a DApp receive the source of a message besides the args:
+// hex args, hex from contract, from chainId, hex cross chain id. Other DApps are
+// called with the hex args only. args: DApp chaincode, "true" or "false"
+func (manager *CrossChainManager) setExtendedArgs(stub shim.ChaincodeStubInterface, args [][]byte) peer.Response {
+	if len(args) != 2 {
+		return shim.Error(fmt.Sprintf("wrong number of args: get %d but 2 expected", len(args)))
+	}
+	sender, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get tx sender: %v", err))
+	}
+	rawDeployer, err := stub.GetState(CrossChainManagerDeployer)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get deployer: %v", err))
+	}
+	if !bytes.Equal(rawDeployer, sender.Bytes()) {
+		return shim.Error(fmt.Sprintf("only deployer can call this function"))
+	}
+	on, err := strconv.ParseBool(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse bool: %v", err))
+	}
+	key := fmt.Sprintf(ExtendedArgsKey, string(args[0]))
+	if !on {
+		if err := stub.DelState(key); err != nil {
+			return shim.Error(fmt.Sprintf("failed to delete extended args flag: %v", err))
+		}
+		return shim.Success(nil)
+	}
+	if err := stub.PutState(key, []byte("true")); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put extended args flag: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (manager *CrossChainManager) isExtendedArgs(stub shim.ChaincodeStubInterface, args [][]byte) peer.Response {
+	if len(args) != 1 {
+		return shim.Error(fmt.Sprintf("wrong number of args: get %d but 1 expected", len(args)))
+	}
+	raw, err := stub.GetState(fmt.Sprintf(ExtendedArgsKey, string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get extended args flag: %v", err))
+	}
+	return shim.Success([]byte(strconv.FormatBool(len(raw) != 0)))
+}
+
 func (manager *CrossChainManager) isAlreadyDone(stub shim.ChaincodeStubInterface, args [][]byte) peer.Response {
 	if len(args) != 1 {
 		return shim.Error(fmt.Sprintf("wrong number of args: get %d but 1 expected", len(args)))
@@ -466,6 +517,14 @@ func (manager *CrossChainManager) verifyHeaderAndExecuteTx(stub shim.ChaincodeSt
 	invokeArgs := make([][]byte, 2)
 	invokeArgs[0] = []byte(merkleValue.MakeTxParam.Method)
 	invokeArgs[1] = []byte(hex.EncodeToString(merkleValue.MakeTxParam.Args))
+	extended, err := stub.GetState(fmt.Sprintf(ExtendedArgsKey, string(merkleValue.MakeTxParam.ToContractAddress)))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get extended args flag: %v", err))
+	}
+	if len(extended) != 0 {
+		invokeArgs = append(invokeArgs, []byte(hex.EncodeToString(merkleValue.MakeTxParam.FromContractAddress)),
+			[]byte(strconv.FormatUint(merkleValue.FromChainID, 10)), []byte(hex.EncodeToString(merkleValue.MakeTxParam.CrossChainID)))
+	}
 	resp := stub.InvokeChaincode(string(merkleValue.MakeTxParam.ToContractAddress), invokeArgs, "")
 	if resp.Status != shim.OK {
 		return shim.Error(fmt.Sprintf("failed to call DApp %s from (from_chainID: %d, from_contract: %s): %s",
@@ -477,5 +536,7 @@ func (manager *CrossChainManager) verifyHeaderAndExecuteTx(stub shim.ChaincodeSt
 		merkleValue.FromChainID, hex.EncodeToString(merkleValue.MakeTxParam.FromContractAddress), string(merkleValue.MakeTxParam.ToContractAddress),
 		merkleValue.MakeTxParam.Method, merkleValue.MakeTxParam.Args)
 
-	return shim.Success(nil)
+	// events set by the DApp are dropped by fabric, so the DApp returns its event and
+	// it is passed on as the response, which is kept in the tx of the block
+	return shim.Success(resp.Payload)
 }
@@ -3,6 +3,7 @@ module github.com/polynetwork/fabric-contract
 go 1.15
 
 require (
+	github.com/btcsuite/btcd v0.20.1-beta
 	github.com/ethereum/go-ethereum v1.9.13
 	github.com/fsouza/go-dockerclient v1.6.5 // indirect
 	github.com/golang/protobuf v1.4.1
@@ -12,4 +13,5 @@ require (
 	github.com/polynetwork/poly v0.0.0-20201022033008-b0240c68a6bc
 	github.com/stretchr/testify v1.6.1
 	github.com/sykesm/zap-logfmt v0.0.4 // indirect
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
 )
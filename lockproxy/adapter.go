@@ -0,0 +1,465 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	AdapterKey = "adapter-%s"
+
+	AdapterProxyTransfer = "proxyTransfer"
+	AdapterTransferFrom  = "transferFrom"
+	AdapterUTXO          = "utxo"
+	AdapterBurnMint      = "burnMint"
+
+	ProxyBurn         = "proxyBurn"
+	ProxyMint         = "proxyMint"
+	ProxyTransferFrom = "proxyTransferFrom"
+
+	OperatorKey = "operator-%s-%s"
+	OperatorSet = "proxy_operator_set"
+
+	MaxTokenIds = 100
+)
+
+// TokenAdapter moves an asset between users and the lockproxy address, so tokens
+// not written against proxyTransfer can be bridged as well.
+type TokenAdapter interface {
+	// Lock moves the asset of param.From to lpAddr and returns the amount locked.
+	Lock(stub shim.ChaincodeStubInterface, param *lockParam, lpAddr []byte) (*big.Int, error)
+	// Release moves amt from lpAddr to the receiver.
+	Release(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error
+}
+
+// AdapterConfig is stored per token, no config means proxyTransfer.
+type AdapterConfig struct {
+	Kind          string `json:"kind"`
+	LockMethod    string `json:"lock_method"`
+	ReleaseMethod string `json:"release_method"`
+}
+
+// adapter builds the TokenAdapter, methods left empty take the default of the kind.
+// Fabric has no standard token interface, and nobody can sign for lpAddr, so the
+// transferFrom and utxo kinds only change how funds are locked: the token must
+// still release through a method trusting the calling lockproxy like proxyTransfer.
+func (ac *AdapterConfig) adapter() (TokenAdapter, error) {
+	switch ac.Kind {
+	case AdapterProxyTransfer:
+		return &proxyTransferAdapter{}, nil
+	case AdapterTransferFrom:
+		return &transferFromAdapter{
+			lockMethod:    defaultMethod(ac.LockMethod, "transferFrom"),
+			releaseMethod: defaultMethod(ac.ReleaseMethod, ProxyTransfer),
+		}, nil
+	case AdapterUTXO:
+		return &utxoAdapter{
+			lockMethod:    defaultMethod(ac.LockMethod, "transferTokens"),
+			releaseMethod: defaultMethod(ac.ReleaseMethod, ProxyTransfer),
+		}, nil
+	case AdapterBurnMint:
+		return &burnMintAdapter{}, nil
+	}
+	return nil, fmt.Errorf("unknown adapter kind %s", ac.Kind)
+}
+
+// proxyTransferAdapter is for tokens like assets.ERC20TokenImpl which trust the
+// lockproxy calling proxyTransfer(from, to, amount bytes).
+type proxyTransferAdapter struct{}
+
+func (a *proxyTransferAdapter) Lock(stub shim.ChaincodeStubInterface, param *lockParam, lpAddr []byte) (*big.Int, error) {
+	if len(param.TokenIds) > 0 {
+		return nil, fmt.Errorf("token %s is not locked by id", param.Token)
+	}
+	if err := transferToken(stub, param.Token, param.From, lpAddr, param.Amount); err != nil {
+		return nil, err
+	}
+	return param.Amount, nil
+}
+
+func (a *proxyTransferAdapter) Release(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error {
+	return transferToken(stub, token, lpAddr, to, amt)
+}
+
+// transferFromAdapter locks with lockMethod(hex from, hex lpAddr, decimal amount)
+// which the token must let the lockproxy call for the user. Nobody can approve
+// for lpAddr, so releasing calls releaseMethod like proxyTransfer.
+type transferFromAdapter struct {
+	lockMethod    string
+	releaseMethod string
+}
+
+func (a *transferFromAdapter) Lock(stub shim.ChaincodeStubInterface, param *lockParam, lpAddr []byte) (*big.Int, error) {
+	if len(param.TokenIds) > 0 {
+		return nil, fmt.Errorf("token %s is not locked by id", param.Token)
+	}
+	if _, err := invokeToken(stub, param.Token, a.lockMethod, []byte(hex.EncodeToString(param.From)),
+		[]byte(hex.EncodeToString(lpAddr)), []byte(param.Amount.String())); err != nil {
+		return nil, err
+	}
+	return param.Amount, nil
+}
+
+func (a *transferFromAdapter) Release(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error {
+	return proxyRelease(stub, token, a.releaseMethod, lpAddr, to, amt)
+}
+
+// utxoAdapter locks unspent tokens by id with lockMethod(hex lpAddr, ids...) which
+// returns the decimal value transferred. That signature and the default name
+// transferTokens are a convention of this lockproxy, not a standard the token can
+// be expected to have. Releasing calls releaseMethod like proxyTransfer and the
+// token chaincode picks the outputs of lpAddr to spend.
+type utxoAdapter struct {
+	lockMethod    string
+	releaseMethod string
+}
+
+func (a *utxoAdapter) Lock(stub shim.ChaincodeStubInterface, param *lockParam, lpAddr []byte) (*big.Int, error) {
+	if len(param.TokenIds) == 0 {
+		return nil, fmt.Errorf("token %s must be locked by id", param.Token)
+	}
+	args := make([][]byte, 0, len(param.TokenIds)+1)
+	args = append(args, []byte(hex.EncodeToString(lpAddr)))
+	for _, id := range param.TokenIds {
+		args = append(args, []byte(id))
+	}
+	payload, err := invokeToken(stub, param.Token, a.lockMethod, args...)
+	if err != nil {
+		return nil, err
+	}
+	amt, ok := big.NewInt(0).SetString(string(payload), 10)
+	if !ok || amt.Sign() != 1 {
+		return nil, fmt.Errorf("wrong value %s returned by %s", payload, param.Token)
+	}
+	return amt, nil
+}
+
+func (a *utxoAdapter) Release(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error {
+	return proxyRelease(stub, token, a.releaseMethod, lpAddr, to, amt)
+}
+
+// burnMintAdapter is for mapping assets like assets.ERC20TokenImpl which have made
+// this lockproxy a minter. Locking burns from the user and releasing mints to the
+// receiver, so nothing is held by lpAddr and the supply is what circulates here.
+type burnMintAdapter struct{}
+
+func (a *burnMintAdapter) Lock(stub shim.ChaincodeStubInterface, param *lockParam, lpAddr []byte) (*big.Int, error) {
+	if len(param.TokenIds) > 0 {
+		return nil, fmt.Errorf("token %s is not locked by id", param.Token)
+	}
+	if _, err := invokeToken(stub, param.Token, ProxyBurn, param.From, param.Amount.Bytes()); err != nil {
+		return nil, err
+	}
+	return param.Amount, nil
+}
+
+func (a *burnMintAdapter) Release(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error {
+	_, err := invokeToken(stub, token, ProxyMint, to, amt.Bytes())
+	return err
+}
+
+// allowanceAdapter locks with proxyTransferFrom(owner, lpAddr, amount bytes) of
+// the token, which spends the allowance the owner gave to lpAddr. Burn and mint
+// tokens are burned from lpAddr after. A token with transferFrom only doesn't
+// work: called by the lockproxy, it spends the allowance given to the tx sender.
+type allowanceAdapter struct {
+	inner TokenAdapter
+}
+
+func (a *allowanceAdapter) Lock(stub shim.ChaincodeStubInterface, param *lockParam, lpAddr []byte) (*big.Int, error) {
+	if len(param.TokenIds) > 0 {
+		return nil, fmt.Errorf("token %s is not locked by id", param.Token)
+	}
+	if _, ok := a.inner.(*utxoAdapter); ok {
+		return nil, fmt.Errorf("token %s can't be locked by allowance", param.Token)
+	}
+	if _, err := invokeToken(stub, param.Token, ProxyTransferFrom, param.From, lpAddr, param.Amount.Bytes()); err != nil {
+		return nil, err
+	}
+	if _, ok := a.inner.(*burnMintAdapter); ok {
+		burn := *param
+		burn.From = lpAddr
+		return a.inner.Lock(stub, &burn, lpAddr)
+	}
+	return param.Amount, nil
+}
+
+func (a *allowanceAdapter) Release(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error {
+	return a.inner.Release(stub, token, lpAddr, to, amt)
+}
+
+type OperatorEvent struct {
+	Holder   string `json:"holder"`
+	Operator string `json:"operator"`
+	Approved bool   `json:"approved"`
+}
+
+// lockFrom locks the funds of owner with the allowance owner gave to lpAddr. The
+// sender must be the owner or an operator the owner set, else anyone could send
+// the allowance to any receiver.
+// args: token, hex owner, toChainId, hex toAddress, amount, [memo]
+func (lp *LockProxy) lockFrom(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("args number should be 5 or 6")
+	}
+	owner, err := hex.DecodeString(string(args[1]))
+	if err != nil || len(owner) == 0 {
+		return shim.Error(fmt.Sprintf("failed to decode hex owner: %s", args[1]))
+	}
+	param, err := parseLockParam(stub, [][]byte{args[0], args[2], args[3], args[4]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !bytes.Equal(param.From, owner) {
+		approved, err := isOperator(stub, owner, param.From)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !approved {
+			return shim.Error(fmt.Sprintf("%x is not an operator of %x", param.From, owner))
+		}
+	}
+	param.Spender = param.From
+	param.From = owner
+	if len(args) == 6 {
+		if param.Memo, err = parseMemo(args[5]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return lp.lockLogic(stub, param)
+}
+
+// setOperator lets operator call lockFrom for the funds of the sender.
+// args: hex operator, true|false
+func (lp *LockProxy) setOperator(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	holder, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get tx sender: %v", err))
+	}
+	operator, err := decodeHexAddr(string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	approved, err := strconv.ParseBool(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse approved: %v", err))
+	}
+	key := getOperatorKey(holder.Bytes(), operator)
+	if approved {
+		err = stub.PutState(key, []byte{1})
+	} else {
+		err = stub.DelState(key)
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to update operator: %v", err))
+	}
+	rawEvent, err := json.Marshal(&OperatorEvent{
+		Holder:   hex.EncodeToString(holder.Bytes()),
+		Operator: hex.EncodeToString(operator),
+		Approved: approved,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(OperatorSet, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: hex holder, hex operator
+func (lp *LockProxy) isOperator(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	holder, err := decodeHexAddr(string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	operator, err := decodeHexAddr(string(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	approved, err := isOperator(stub, holder, operator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatBool(approved)))
+}
+
+// args: token, kind, [lockMethod, [releaseMethod]]
+func (lp *LockProxy) setAdapter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("args number should be 2 to 4")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	ac := &AdapterConfig{Kind: string(args[1])}
+	if len(args) > 2 {
+		ac.LockMethod = string(args[2])
+	}
+	if len(args) > 3 {
+		ac.ReleaseMethod = string(args[3])
+	}
+	if ac.LockMethod == ProxyTransfer {
+		return shim.Error(fmt.Sprintf("use kind %s for %s", AdapterProxyTransfer, ProxyTransfer))
+	}
+	if _, err := ac.adapter(); err != nil {
+		return shim.Error(err.Error())
+	}
+	key := getAdapterKey(string(args[0]))
+	if ac.Kind == AdapterProxyTransfer {
+		if err := stub.DelState(key); err != nil {
+			return shim.Error(fmt.Sprintf("failed to delete adapter: %v", err))
+		}
+		return shim.Success(nil)
+	}
+	raw, err := json.Marshal(ac)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(key, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put adapter: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getAdapter(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	ac, err := getAdapterConfig(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(ac)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: token, toChainId, hex toAddress, comma separated token ids
+func (lp *LockProxy) lockTokens(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("args number should be 4")
+	}
+	param, err := parseLockTarget(stub, args[:3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ids := strings.Split(string(args[3]), ",")
+	if len(ids) > MaxTokenIds {
+		return shim.Error(fmt.Sprintf("no more than %d token ids", MaxTokenIds))
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			return shim.Error(fmt.Sprintf("empty or duplicate token id in %s", args[3]))
+		}
+		seen[id] = true
+	}
+	param.TokenIds = ids
+	return lp.lockLogic(stub, param)
+}
+
+func getAdapterConfig(stub shim.ChaincodeStubInterface, token string) (*AdapterConfig, error) {
+	raw, err := stub.GetState(getAdapterKey(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get adapter: %v", err)
+	}
+	ac := &AdapterConfig{Kind: AdapterProxyTransfer}
+	if len(raw) == 0 {
+		return ac, nil
+	}
+	if err := json.Unmarshal(raw, ac); err != nil {
+		return nil, fmt.Errorf("failed to decode adapter: %v", err)
+	}
+	return ac, nil
+}
+
+func isOperator(stub shim.ChaincodeStubInterface, holder, operator []byte) (bool, error) {
+	raw, err := stub.GetState(getOperatorKey(holder, operator))
+	if err != nil {
+		return false, fmt.Errorf("failed to get operator: %v", err)
+	}
+	return len(raw) > 0, nil
+}
+
+func getTokenAdapter(stub shim.ChaincodeStubInterface, token string) (TokenAdapter, error) {
+	ac, err := getAdapterConfig(stub, token)
+	if err != nil {
+		return nil, err
+	}
+	return ac.adapter()
+}
+
+// releaseToken sends amt of token from lpAddr to the receiver through the adapter of the token.
+func releaseToken(stub shim.ChaincodeStubInterface, token string, lpAddr, to []byte, amt *big.Int) error {
+	adapter, err := getTokenAdapter(stub, token)
+	if err != nil {
+		return err
+	}
+	return adapter.Release(stub, token, lpAddr, to, amt)
+}
+
+// proxyRelease pays amt from lpAddr by method(from, to, amount bytes) of the token,
+// which must check the calling lockproxy as proxyTransfer does.
+func proxyRelease(stub shim.ChaincodeStubInterface, token, method string, lpAddr, to []byte, amt *big.Int) error {
+	_, err := invokeToken(stub, token, method, lpAddr, to, amt.Bytes())
+	return err
+}
+
+func invokeToken(stub shim.ChaincodeStubInterface, token, method string, args ...[]byte) ([]byte, error) {
+	invokeArgs := make([][]byte, 0, len(args)+1)
+	invokeArgs = append(invokeArgs, []byte(method))
+	invokeArgs = append(invokeArgs, args...)
+	resp := stub.InvokeChaincode(token, invokeArgs, "")
+	if resp.Status != shim.OK {
+		return nil, fmt.Errorf("%s of %s: %s", method, token, resp.GetMessage())
+	}
+	return resp.Payload, nil
+}
+
+func defaultMethod(method, def string) string {
+	if method == "" {
+		return def
+	}
+	return method
+}
+
+func getAdapterKey(token string) string {
+	return fmt.Sprintf(AdapterKey, token)
+}
+
+func getOperatorKey(holder, operator []byte) string {
+	return fmt.Sprintf(OperatorKey, hex.EncodeToString(holder), hex.EncodeToString(operator))
+}
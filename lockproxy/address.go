@@ -0,0 +1,280 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	pcommon "github.com/polynetwork/poly/common"
+	"strconv"
+	"strings"
+)
+
+const (
+	ChainFamilyKey = "chain_family-%d"
+
+	FamilyEVM      = "evm"
+	FamilyNeo      = "neo"
+	FamilyOntology = "ontology"
+	FamilyCosmos   = "cosmos"
+	FamilyFabric   = "fabric"
+
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// ChainFamily decides how the toAddress of lock is checked for a chain. Hrp is
+// the bech32 prefix of cosmos chains, Codec overrides the TxArgs codec of the family.
+type ChainFamily struct {
+	Family string `json:"family"`
+	Hrp    string `json:"hrp,omitempty"`
+	Codec  string `json:"codec,omitempty"`
+}
+
+// args: chainId, family, [hrp]. The codec set by setTxArgsCodec is kept.
+func (lp *LockProxy) setChainFamily(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("args number should be 2 or 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	cf, err := getFamily(stub, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if cf == nil {
+		cf = &ChainFamily{}
+	}
+	cf.Family, cf.Hrp = string(args[1]), ""
+	if len(args) == 3 {
+		cf.Hrp = string(args[2])
+	}
+	switch cf.Family {
+	case FamilyEVM, FamilyNeo, FamilyOntology, FamilyFabric:
+		if cf.Hrp != "" {
+			return shim.Error(fmt.Sprintf("hrp is only for %s", FamilyCosmos))
+		}
+	case FamilyCosmos:
+		if cf.Hrp == "" || strings.ToLower(cf.Hrp) != cf.Hrp {
+			return shim.Error("lower case hrp is required for cosmos")
+		}
+	default:
+		return shim.Error(fmt.Sprintf("unknown chain family %s", cf.Family))
+	}
+	raw, err := json.Marshal(cf)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(getChainFamilyKey(chainId), raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put chain family: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getChainFamily(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	raw, err := stub.GetState(getChainFamilyKey(chainId))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get chain family: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// getFamily returns nil if no family registered for the chain.
+func getFamily(stub shim.ChaincodeStubInterface, chainId uint64) (*ChainFamily, error) {
+	raw, err := stub.GetState(getChainFamilyKey(chainId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain family: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	cf := &ChainFamily{}
+	if err := json.Unmarshal(raw, cf); err != nil {
+		return nil, fmt.Errorf("failed to decode chain family: %v", err)
+	}
+	return cf, nil
+}
+
+// normalizeToAddress turns the toAddress given to lock into the bytes expected
+// by the target chain. Chains without family keep taking any hex.
+func normalizeToAddress(stub shim.ChaincodeStubInterface, chainId uint64, addr string) ([]byte, error) {
+	cf, err := getFamily(stub, chainId)
+	if err != nil {
+		return nil, err
+	}
+	if cf == nil {
+		raw, err := hex.DecodeString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hex toAddr: %v", err)
+		}
+		return raw, nil
+	}
+	return cf.normalize(addr)
+}
+
+func (cf *ChainFamily) normalize(addr string) ([]byte, error) {
+	switch cf.Family {
+	case FamilyEVM:
+		return parseEVMAddress(addr)
+	case FamilyFabric:
+		raw, err := hex.DecodeString(strings.TrimPrefix(addr, "0x"))
+		if err != nil || len(raw) != 20 {
+			return nil, fmt.Errorf("wrong fabric address %s", addr)
+		}
+		return raw, nil
+	case FamilyNeo, FamilyOntology:
+		// base58 address or 0x prefixed script hash shown by explorers
+		var (
+			a   pcommon.Address
+			err error
+		)
+		if strings.HasPrefix(addr, "0x") {
+			a, err = pcommon.AddressFromHexString(addr[2:])
+		} else {
+			a, err = pcommon.AddressFromBase58(addr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("wrong %s address %s: %v", cf.Family, addr, err)
+		}
+		return a[:], nil
+	case FamilyCosmos:
+		hrp, raw, err := decodeBech32(addr)
+		if err != nil {
+			return nil, fmt.Errorf("wrong cosmos address %s: %v", addr, err)
+		}
+		if hrp != cf.Hrp {
+			return nil, fmt.Errorf("wrong prefix %s of cosmos address and %s expected", hrp, cf.Hrp)
+		}
+		if len(raw) != 20 && len(raw) != 32 {
+			return nil, fmt.Errorf("wrong length %d of cosmos address", len(raw))
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("unknown chain family %s", cf.Family)
+}
+
+// parseEVMAddress checks the EIP-55 checksum if the address is in mixed case.
+func parseEVMAddress(addr string) ([]byte, error) {
+	if !strings.HasPrefix(addr, "0x") && !strings.HasPrefix(addr, "0X") {
+		addr = "0x" + addr
+	}
+	if !common.IsHexAddress(addr) {
+		return nil, fmt.Errorf("wrong evm address %s", addr)
+	}
+	a := common.HexToAddress(addr)
+	body := addr[2:]
+	if strings.ToLower(body) != body && strings.ToUpper(body) != body && a.Hex()[2:] != body {
+		return nil, fmt.Errorf("wrong EIP-55 checksum of evm address %s", addr)
+	}
+	return a.Bytes(), nil
+}
+
+// decodeBech32 decodes and verifies a bech32 string, returning hrp and the data in 8 bits.
+func decodeBech32(s string) (string, []byte, error) {
+	if len(s) > 90 {
+		return "", nil, fmt.Errorf("too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, fmt.Errorf("mixed case")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, fmt.Errorf("wrong separator position")
+	}
+	hrp := s[:pos]
+	data := make([]byte, 0, len(s)-pos-1)
+	for _, c := range s[pos+1:] {
+		d := strings.IndexRune(bech32Charset, c)
+		if d < 0 {
+			return "", nil, fmt.Errorf("invalid character %c", c)
+		}
+		data = append(data, byte(d))
+	}
+	if bech32Polymod(append(bech32HrpExpand(hrp), data...)) != 1 {
+		return "", nil, fmt.Errorf("wrong checksum")
+	}
+	raw, err := convertBits(data[:len(data)-6], 5, 8)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, raw, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	res := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		res = append(res, hrp[i]>>5)
+	}
+	res = append(res, 0)
+	for i := 0; i < len(hrp); i++ {
+		res = append(res, hrp[i]&31)
+	}
+	return res
+}
+
+// convertBits regroups bits without padding, the left bits must be zero.
+func convertBits(data []byte, from, to uint) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	res := make([]byte, 0, len(data)*int(from)/int(to))
+	for _, d := range data {
+		acc = acc<<from | uint32(d)
+		bits += from
+		for bits >= to {
+			bits -= to
+			res = append(res, byte(acc>>bits&(1<<to-1)))
+		}
+	}
+	if bits >= from || acc&(1<<bits-1) != 0 {
+		return nil, fmt.Errorf("wrong padding")
+	}
+	return res, nil
+}
+
+func getChainFamilyKey(chainId uint64) string {
+	return fmt.Sprintf(ChainFamilyKey, chainId)
+}
@@ -0,0 +1,550 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	ApprovalConfigKey    = "approval_config"
+	ApprovalThresholdKey = "approval_threshold-%s"
+	PendingUnlockKey     = "pending_unlock-%s"
+	PendingIndexType     = "pending_unlock"
+	UnlockQueued         = "proxy_unlock_queued"
+	UnlockApproved       = "proxy_unlock_approved"
+	UnlockVetoed         = "proxy_unlock_vetoed"
+	UnlockExecuted       = "proxy_unlock_executed"
+	UnlockRequeued       = "proxy_unlock_requeued"
+	UnlockCancelled      = "proxy_unlock_cancelled"
+
+	PendingStatusPending   = "pending"
+	PendingStatusExecuted  = "executed"
+	PendingStatusVetoed    = "vetoed"
+	PendingStatusCancelled = "cancelled"
+
+	ResolveRequeue = "requeue"
+	ResolveCancel  = "cancel"
+)
+
+// Approver is an org admin identified by the MSP ID and the address derived
+// from the certificate.
+type Approver struct {
+	MspId   string `json:"msp_id"`
+	Address string `json:"address"`
+}
+
+func (a *Approver) id() string {
+	return a.MspId + "/" + strings.ToLower(a.Address)
+}
+
+// ApprovalConfig says an unlock queued is released by approvers of Threshold
+// different MSPs, or by anyone after Delay seconds without veto. Zero Delay means
+// approvals only.
+type ApprovalConfig struct {
+	Approvers []*Approver `json:"approvers"`
+	Threshold int         `json:"threshold"`
+	Delay     int64       `json:"delay"`
+}
+
+func (ac *ApprovalConfig) validate() error {
+	if len(ac.Approvers) == 0 {
+		return fmt.Errorf("no approvers")
+	}
+	if ac.Delay < 0 {
+		return fmt.Errorf("delay can't be negative")
+	}
+	seen := make(map[string]bool)
+	msps := make(map[string]bool)
+	for _, a := range ac.Approvers {
+		raw, err := hex.DecodeString(a.Address)
+		if a.MspId == "" || err != nil || len(raw) != 20 {
+			return fmt.Errorf("wrong approver %s/%s", a.MspId, a.Address)
+		}
+		if seen[a.id()] {
+			return fmt.Errorf("duplicate approver %s", a.id())
+		}
+		seen[a.id()] = true
+		msps[a.MspId] = true
+	}
+	if ac.Threshold <= 0 || ac.Threshold > len(msps) {
+		return fmt.Errorf("threshold should be in [1, %d], the number of MSPs", len(msps))
+	}
+	return nil
+}
+
+func (ac *ApprovalConfig) isApprover(id string) bool {
+	for _, a := range ac.Approvers {
+		if a.id() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingUnlock is an unlock over the threshold of its asset waiting for approval,
+// or an entry of a batch which anyone can execute when Claimable. Id is the txid
+// of the unlock, followed by the index for a batch. The locked liquidity is taken
+// when it's queued.
+type PendingUnlock struct {
+	Id           string   `json:"id"`
+	Token        string   `json:"token"`
+	FromChainId  uint64   `json:"from_chain_id"`
+	FromAddress  []byte   `json:"from_address,omitempty"`
+	ToAddress    []byte   `json:"to_address"`
+	Amount       *big.Int `json:"amount"`
+	CallData     []byte   `json:"call_data"`
+	CrossChainId string   `json:"cross_chain_id"`
+	Memo         string   `json:"memo,omitempty"`
+	Approvals    []string `json:"approvals"`
+	VetoedBy     string   `json:"vetoed_by"`
+	Status       string   `json:"status"`
+	CreatedAt    int64    `json:"created_at"`
+	Claimable    bool     `json:"claimable,omitempty"`
+}
+
+type PendingUnlockPage struct {
+	Records  []*PendingUnlock `json:"records"`
+	Bookmark string           `json:"bookmark"`
+}
+
+type PendingUnlockEvent struct {
+	Id       string   `json:"id"`
+	Token    string   `json:"token"`
+	Amount   *big.Int `json:"amount"`
+	Approver string   `json:"approver"`
+	// CallFailed is set when executing the unlock, see UnlockEvent
+	CallFailed string `json:"call_failed,omitempty"`
+}
+
+// args: threshold, delay seconds, json approvers
+func (lp *LockProxy) setApprovers(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	threshold, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse threshold: %v", err))
+	}
+	delay, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse delay: %v", err))
+	}
+	ac := &ApprovalConfig{Threshold: threshold, Delay: delay}
+	if err := json.Unmarshal(args[2], &ac.Approvers); err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode approvers: %v", err))
+	}
+	if err := ac.validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(ac)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(ApprovalConfigKey, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put approval config: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getApprovers(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(ApprovalConfigKey)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get approval config: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: token, amount. Unlocks of at least amount are queued, "0" turns it off.
+func (lp *LockProxy) setApprovalThreshold(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	amt, ok := big.NewInt(0).SetString(string(args[1]), 10)
+	if !ok || amt.Sign() < 0 {
+		return shim.Error(fmt.Sprintf("wrong threshold: %s", args[1]))
+	}
+	if amt.Sign() > 0 {
+		if _, err := getApprovalConfig(stub); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if err := putBigInt(stub, getApprovalThresholdKey(string(args[0])), amt); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put approval threshold: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getApprovalThreshold(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	raw, err := stub.GetState(getApprovalThresholdKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get approval threshold: %v", err))
+	}
+	return shim.Success([]byte(big.NewInt(0).SetBytes(raw).String()))
+}
+
+// args: pending unlock id
+func (lp *LockProxy) approveUnlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	pu, approver, err := checkApprover(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, id := range pu.Approvals {
+		if id == approver {
+			return shim.Error(fmt.Sprintf("%s already approved %s", approver, pu.Id))
+		}
+	}
+	pu.Approvals = append(pu.Approvals, approver)
+	if err := putPendingUnlock(stub, pu); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitPendingUnlock(stub, UnlockApproved, pu, approver, "")
+}
+
+// args: pending unlock id. A vetoed unlock keeps the locked liquidity taken till
+// owner resolves it after investigation.
+func (lp *LockProxy) vetoUnlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	pu, approver, err := checkApprover(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pu.VetoedBy = approver
+	if err := setPendingStatus(stub, pu, PendingStatusVetoed); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitPendingUnlock(stub, UnlockVetoed, pu, approver, "")
+}
+
+// resolveUnlock lets owner decide on a vetoed unlock: requeue puts it back to wait
+// for approvals again, with the delay counted from now, and cancel drops it and
+// gives the liquidity taken back to its chain. args: pending unlock id, requeue|cancel
+func (lp *LockProxy) resolveUnlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	pu, err := getPendingUnlock(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pu.Status != PendingStatusVetoed {
+		return shim.Error(fmt.Sprintf("unlock %s is %s, not vetoed", pu.Id, pu.Status))
+	}
+	switch string(args[1]) {
+	case ResolveRequeue:
+		now, err := utils.GetTxTime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		pu.Approvals = make([]string, 0)
+		pu.VetoedBy = ""
+		pu.CreatedAt = now
+		if err := setPendingStatus(stub, pu, PendingStatusPending); err != nil {
+			return shim.Error(err.Error())
+		}
+		return emitPendingUnlock(stub, UnlockRequeued, pu, "", "")
+	case ResolveCancel:
+		if err := addLocked(stub, pu.Token, pu.FromChainId, pu.Amount); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := setPendingStatus(stub, pu, PendingStatusCancelled); err != nil {
+			return shim.Error(err.Error())
+		}
+		return emitPendingUnlock(stub, UnlockCancelled, pu, "", "")
+	default:
+		return shim.Error(fmt.Sprintf("unknown resolution %s", args[1]))
+	}
+}
+
+// executeUnlock can be called by anyone once the unlock is approved or the delay
+// passed, or at once for a claimable entry of a batch.
+func (lp *LockProxy) executeUnlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	pu, err := getPendingUnlock(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pu.Status != PendingStatusPending {
+		return shim.Error(fmt.Sprintf("unlock %s is already %s", pu.Id, pu.Status))
+	}
+	if !pu.Claimable {
+		if err := checkApproved(stub, pu); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	_, callFailed, err := releaseUnlock(stub, pu.Token, pu.FromAddress, pu.ToAddress, pu.Amount, pu.CallData)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := setPendingStatus(stub, pu, PendingStatusExecuted); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitPendingUnlock(stub, UnlockExecuted, pu, "", callFailed)
+}
+
+func (lp *LockProxy) getPendingUnlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	raw, err := stub.GetState(getPendingUnlockKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get pending unlock: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: status, [pageSize, [bookmark]]
+func (lp *LockProxy) listPendingUnlocks(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) < 1 {
+		return shim.Error("args number should be at least 1")
+	}
+	status := string(args[0])
+	if status != PendingStatusPending && status != PendingStatusExecuted && status != PendingStatusVetoed &&
+		status != PendingStatusCancelled {
+		return shim.Error(fmt.Sprintf("unknown status %s", status))
+	}
+	pageSize, bookmark, err := utils.ParsePageArgs(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(PendingIndexType,
+		[]string{status}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query pending unlocks: %v", err))
+	}
+	defer iter.Close()
+	page := &PendingUnlockPage{Records: make([]*PendingUnlock, 0), Bookmark: meta.GetBookmark()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate pending unlocks: %v", err))
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 2 {
+			return shim.Error(fmt.Sprintf("wrong pending unlock index %s: %v", kv.Key, err))
+		}
+		pu, err := getPendingUnlock(stub, attrs[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Records = append(page.Records, pu)
+	}
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// checkApproved tells if the unlock has enough approvals or waited for the delay.
+func checkApproved(stub shim.ChaincodeStubInterface, pu *PendingUnlock) error {
+	ac, err := getApprovalConfig(stub)
+	if err != nil {
+		return err
+	}
+	msps := make(map[string]bool)
+	for _, id := range pu.Approvals {
+		// approvers removed from config don't count
+		if ac.isApprover(id) {
+			msps[id[:strings.LastIndex(id, "/")]] = true
+		}
+	}
+	approvals := len(msps)
+	if approvals >= ac.Threshold {
+		return nil
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if ac.Delay == 0 || now < pu.CreatedAt+ac.Delay {
+		return fmt.Errorf("unlock %s is approved by %d of %d MSPs", pu.Id, approvals, ac.Threshold)
+	}
+	return nil
+}
+
+// needApproval tells if an unlock of amt must wait in the queue.
+func needApproval(stub shim.ChaincodeStubInterface, token string, amt *big.Int) (bool, error) {
+	raw, err := stub.GetState(getApprovalThresholdKey(token))
+	if err != nil {
+		return false, fmt.Errorf("failed to get approval threshold: %v", err)
+	}
+	if len(raw) == 0 {
+		return false, nil
+	}
+	return amt.Cmp(big.NewInt(0).SetBytes(raw)) >= 0, nil
+}
+
+func queueUnlock(stub shim.ChaincodeStubInterface, pu *PendingUnlock) error {
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+	pu.Approvals = make([]string, 0)
+	pu.Status = PendingStatusPending
+	pu.CreatedAt = now
+	return putPendingUnlock(stub, pu)
+}
+
+// checkApprover returns the pending unlock and the id of the calling approver.
+func checkApprover(stub shim.ChaincodeStubInterface, id string) (*PendingUnlock, string, error) {
+	ac, err := getApprovalConfig(stub)
+	if err != nil {
+		return nil, "", err
+	}
+	mspId, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+	addr, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return nil, "", err
+	}
+	approver := (&Approver{MspId: mspId, Address: hex.EncodeToString(addr.Bytes())}).id()
+	if !ac.isApprover(approver) {
+		return nil, "", fmt.Errorf("%s is not approver", approver)
+	}
+	pu, err := getPendingUnlock(stub, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if pu.Status != PendingStatusPending {
+		return nil, "", fmt.Errorf("unlock %s is already %s", pu.Id, pu.Status)
+	}
+	return pu, approver, nil
+}
+
+func getApprovalConfig(stub shim.ChaincodeStubInterface) (*ApprovalConfig, error) {
+	raw, err := stub.GetState(ApprovalConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get approval config: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("approvers not set")
+	}
+	ac := &ApprovalConfig{}
+	if err := json.Unmarshal(raw, ac); err != nil {
+		return nil, fmt.Errorf("failed to decode approval config: %v", err)
+	}
+	return ac, nil
+}
+
+func setPendingStatus(stub shim.ChaincodeStubInterface, pu *PendingUnlock, status string) error {
+	key, err := pendingIndexKey(stub, pu)
+	if err != nil {
+		return err
+	}
+	if err := stub.DelState(key); err != nil {
+		return fmt.Errorf("failed to delete pending unlock index: %v", err)
+	}
+	pu.Status = status
+	return putPendingUnlock(stub, pu)
+}
+
+func putPendingUnlock(stub shim.ChaincodeStubInterface, pu *PendingUnlock) error {
+	raw, err := json.Marshal(pu)
+	if err != nil {
+		return fmt.Errorf("failed to json marshal: %v", err)
+	}
+	if err := stub.PutState(getPendingUnlockKey(pu.Id), raw); err != nil {
+		return fmt.Errorf("failed to put pending unlock: %v", err)
+	}
+	key, err := pendingIndexKey(stub, pu)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, []byte{0}); err != nil {
+		return fmt.Errorf("failed to put pending unlock index: %v", err)
+	}
+	return nil
+}
+
+func getPendingUnlock(stub shim.ChaincodeStubInterface, id string) (*PendingUnlock, error) {
+	raw, err := stub.GetState(getPendingUnlockKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending unlock %s: %v", id, err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no pending unlock %s found", id)
+	}
+	pu := &PendingUnlock{}
+	if err := json.Unmarshal(raw, pu); err != nil {
+		return nil, fmt.Errorf("failed to decode pending unlock %s: %v", id, err)
+	}
+	return pu, nil
+}
+
+func emitPendingUnlock(stub shim.ChaincodeStubInterface, name string, pu *PendingUnlock, approver, callFailed string) pb.Response {
+	rawEvent, err := json.Marshal(&PendingUnlockEvent{
+		Id:         pu.Id,
+		Token:      pu.Token,
+		Amount:     pu.Amount,
+		Approver:   approver,
+		CallFailed: callFailed,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(name, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func pendingIndexKey(stub shim.ChaincodeStubInterface, pu *PendingUnlock) (string, error) {
+	key, err := stub.CreateCompositeKey(PendingIndexType, []string{pu.Status, pu.Id})
+	if err != nil {
+		return "", fmt.Errorf("failed to create pending unlock index key: %v", err)
+	}
+	return key, nil
+}
+
+func getApprovalThresholdKey(token string) string {
+	return fmt.Sprintf(ApprovalThresholdKey, token)
+}
+
+func getPendingUnlockKey(id string) string {
+	return fmt.Sprintf(PendingUnlockKey, id)
+}
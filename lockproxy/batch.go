@@ -0,0 +1,478 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	pcommon "github.com/polynetwork/poly/common"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+const (
+	BatchSizeKey     = "batch_size-%s-%d"
+	BatchEntryType   = "batch_entry"
+	BatchRecordKey   = "batch_record-%s"
+	EventUnlockBatch = "UnlockBatchEvent"
+	MaxBatchSize     = 500
+)
+
+// BatchEntry is a lock waiting in the batch of (token, chainId), Amount is in
+// remote decimals after fee.
+type BatchEntry struct {
+	LockId    string   `json:"lock_id"`
+	ToAddress []byte   `json:"to_address"`
+	Amount    *big.Int `json:"amount"`
+}
+
+// BatchTxArgs is the cross chain message of unlockBatch. Amounts are written
+// with the codec of the chain like TxArgs.
+type BatchTxArgs struct {
+	ToAssetHash []byte
+	ToAddresses [][]byte
+	Amounts     []*big.Int
+}
+
+func (args *BatchTxArgs) serialize(sink *pcommon.ZeroCopySink, codec TxArgsCodec) error {
+	sink.WriteVarBytes(args.ToAssetHash)
+	sink.WriteVarUint(uint64(len(args.ToAddresses)))
+	for i, addr := range args.ToAddresses {
+		sink.WriteVarBytes(addr)
+		if err := codec.writeAmount(sink, args.Amounts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (args *BatchTxArgs) deserialize(source *pcommon.ZeroCopySource, codec TxArgsCodec) error {
+	assetHash, eof := source.NextVarBytes()
+	if eof {
+		return fmt.Errorf("BatchTxArgs.Deserialization NextVarBytes AssetHash error:%s", io.ErrUnexpectedEOF)
+	}
+	n, eof := source.NextVarUint()
+	if eof {
+		return fmt.Errorf("BatchTxArgs.Deserialization NextVarUint length error:%s", io.ErrUnexpectedEOF)
+	}
+	if n == 0 || n > MaxBatchSize {
+		return fmt.Errorf("BatchTxArgs.Deserialization length should be in [1, %d]", MaxBatchSize)
+	}
+	addrs := make([][]byte, 0, n)
+	amts := make([]*big.Int, 0, n)
+	for i := uint64(0); i < n; i++ {
+		addr, eof := source.NextVarBytes()
+		if eof {
+			return fmt.Errorf("BatchTxArgs.Deserialization NextVarBytes No.%d ToAddress error:%s", i, io.ErrUnexpectedEOF)
+		}
+		amt, err := codec.readAmount(source)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		amts = append(amts, amt)
+	}
+	args.ToAssetHash = assetHash
+	args.ToAddresses = addrs
+	args.Amounts = amts
+	return nil
+}
+
+// setBatchSize turns on batching for locks of token toward chainId. The lock
+// making size of them queued sends them in one message. "0" turns it off and the
+// locks left can be flushed by anyone.
+// args: token, chainId, size
+func (lp *LockProxy) setBatchSize(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	size, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil || size > MaxBatchSize {
+		return shim.Error(fmt.Sprintf("batch size should be in [0, %d]", MaxBatchSize))
+	}
+	key := getBatchSizeKey(string(args[0]), chainId)
+	if size == 0 {
+		err = stub.DelState(key)
+	} else {
+		err = stub.PutState(key, args[2])
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to put batch size: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: token, chainId
+func (lp *LockProxy) getBatch(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	entries, err := getBatchEntries(stub, string(args[0]), chainId, MaxBatchSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// flushBatch sends the queued locks of (token, chainId) in one message. A full
+// batch is sent by the lock filling it, so this is for the locks left after the
+// size is lowered or batching is turned off: anyone can call it once the batch
+// size is reached, the owner at any time.
+// args: token, chainId
+func (lp *LockProxy) flushBatch(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	token := string(args[0])
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	batchSize, err := getBatchSize(stub, token, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if batchSize > 0 {
+		queued, err := getBatchEntries(stub, token, chainId, int(batchSize))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if uint64(len(queued)) < batchSize {
+			if _, err := checkOwner(stub); err != nil {
+				return shim.Error(fmt.Sprintf("%d locks queued, less than batch size %d", len(queued), batchSize))
+			}
+		}
+	}
+	ids, err := flushBatch(stub, token, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(ids)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// unlockBatch is called by ccm like unlock. A tx can't read back its writes, so
+// paying several receivers from lpAddr here would take only the last amount from
+// it. The limits and locked liquidity are taken for the sum, then each entry is
+// queued, claimable by anyone with executeUnlock or waiting for approval.
+// args: hex batch args, hex from contract, from chainId, [hex cross chain id], or
+// hex batch args only from a ccm not upgraded yet
+func (lp *LockProxy) unlockBatch(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	msg, err := ParseCCMArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := CheckFromProxy(stub, msg); err != nil {
+		return shim.Error(err.Error())
+	}
+	fromChainId := msg.FromChainId
+	codec, err := getTxArgsCodec(stub, fromChainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	batch := &BatchTxArgs{}
+	if err := batch.deserialize(pcommon.NewZeroCopySource(msg.Args), codec); err != nil {
+		return shim.Error(fmt.Sprintf("failed to deserialize batch args: %v", err))
+	}
+	token := string(batch.ToAssetHash)
+	amts := make([]*big.Int, 0, len(batch.Amounts))
+	total := big.NewInt(0)
+	for i, amt := range batch.Amounts {
+		local, err := toLocalAmount(stub, fromChainId, token, amt)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to unlock No.%d of batch: %v", i, err))
+		}
+		amts = append(amts, local)
+		total.Add(total, local)
+	}
+	if err := checkLimit(stub, DirectionUnlock, token, fromChainId, amts...); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addLocked(stub, token, fromChainId, big.NewInt(0).Neg(total)); err != nil {
+		return shim.Error(err.Error())
+	}
+	events := make([]*UnlockEvent, 0, len(batch.ToAddresses))
+	for i, addr := range batch.ToAddresses {
+		queued, err := needApproval(stub, token, amts[i])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		pu := &PendingUnlock{
+			Id:           fmt.Sprintf("%s-%d", stub.GetTxID(), i),
+			Token:        token,
+			FromChainId:  fromChainId,
+			ToAddress:    addr,
+			Amount:       amts[i],
+			CrossChainId: msg.CrossChainId,
+			Claimable:    !queued,
+		}
+		if err := queueUnlock(stub, pu); err != nil {
+			return shim.Error(fmt.Sprintf("failed to queue No.%d of batch: %v", i, err))
+		}
+		events = append(events, &UnlockEvent{
+			ToAsset:      token,
+			ToAddress:    hex.EncodeToString(addr),
+			Amount:       amts[i].String(),
+			FromChainId:  fromChainId,
+			CrossChainId: msg.CrossChainId,
+			PendingId:    pu.Id,
+		})
+	}
+	rawEvent, err := json.Marshal(events)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventUnlockBatch, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(rawEvent)
+}
+
+// queueLock finishes a lock in batching mode, the funds are locked and the lock
+// recorded now. The lock filling the batch sends it with the locks queued before,
+// the others write a key of their own only. Each lock reads the queue to know,
+// so locks of the same batch in a block may fail with a phantom read conflict
+// and have to be sent again.
+func (lp *LockProxy) queueLock(stub shim.ChaincodeStubInterface, param *lockParam, batchSize uint64, toAsset []byte,
+	netAmt, remoteAmt, fee *big.Int) pb.Response {
+	if err := addLocked(stub, param.Token, param.ChainId, netAmt); err != nil {
+		return shim.Error(err.Error())
+	}
+	rec, err := recordLock(stub, param, netAmt, fee)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to record lock: %v", err))
+	}
+	entry := &BatchEntry{LockId: rec.Id, ToAddress: param.ToAddress, Amount: remoteAmt}
+	queued, err := getBatchEntries(stub, param.Token, param.ChainId, int(batchSize))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if uint64(len(queued))+1 >= batchSize {
+		return lp.sendFullBatch(stub, param, rec, append(queued, entry), toAsset, remoteAmt, fee)
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	key, err := batchEntryKey(stub, param.Token, param.ChainId, rec.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(key, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put batch entry: %v", err))
+	}
+	event := newLockEvent(stub, param, toAsset, remoteAmt, fee)
+	event.CrossChainId = ""
+	rawEvent, err := json.Marshal(event)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	// nothing is sent yet, so the LockEvent is the event of the tx
+	if err := stub.SetEvent(EventLock, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(rawEvent)
+}
+
+// sendFullBatch sends the entries with the lock rec of this tx last, which is
+// not queued. The LockEvent of rec follows the message like a lock sent alone.
+func (lp *LockProxy) sendFullBatch(stub shim.ChaincodeStubInterface, param *lockParam, rec *LockRecord,
+	entries []*BatchEntry, toAsset []byte, remoteAmt, fee *big.Int) pb.Response {
+	rec.BatchId = stub.GetTxID()
+	if err := putLockRecord(stub, rec); err != nil {
+		return shim.Error(err.Error())
+	}
+	rawEvent, err := json.Marshal(newLockEvent(stub, param, toAsset, remoteAmt, fee))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if _, err := sendBatch(stub, param.Token, param.ChainId, entries, rawEvent); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(rawEvent)
+}
+
+// flushBatch sends up to MaxBatchSize queued locks and returns their ids.
+func flushBatch(stub shim.ChaincodeStubInterface, token string, chainId uint64) ([]string, error) {
+	entries, err := getBatchEntries(stub, token, chainId, MaxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no lock queued for %s to chain %d", token, chainId)
+	}
+	return sendBatch(stub, token, chainId, entries, nil)
+}
+
+// sendBatch sends entries in one message and returns their lock ids. The batch id
+// is the txid, which the destination acknowledges. event is appended to the
+// message like sendCrossChain does.
+func sendBatch(stub shim.ChaincodeStubInterface, token string, chainId uint64, entries []*BatchEntry,
+	event []byte) ([]string, error) {
+	toAsset, err := GetAssetBinding(stub, chainId, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get toAsset: %v", err)
+	}
+	toProxy, err := GetProxyBinding(stub, chainId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get toProxy: %v", err)
+	}
+	if len(toAsset) == 0 || len(toProxy) == 0 {
+		return nil, fmt.Errorf("no binding for %s to chain %d", token, chainId)
+	}
+
+	batch := &BatchTxArgs{ToAssetHash: toAsset}
+	ids := make([]string, 0, len(entries))
+	batchId := stub.GetTxID()
+	for _, entry := range entries {
+		batch.ToAddresses = append(batch.ToAddresses, entry.ToAddress)
+		batch.Amounts = append(batch.Amounts, entry.Amount)
+		ids = append(ids, entry.LockId)
+		// the lock of this tx is not queued and its record is written by the caller
+		if entry.LockId == batchId {
+			continue
+		}
+		if err := removeBatchEntry(stub, token, chainId, entry.LockId); err != nil {
+			return nil, err
+		}
+		rec, err := getLockRecord(stub, entry.LockId)
+		if err != nil {
+			return nil, err
+		}
+		rec.BatchId = batchId
+		if err := putLockRecord(stub, rec); err != nil {
+			return nil, err
+		}
+	}
+	codec, err := getTxArgsCodec(stub, chainId)
+	if err != nil {
+		return nil, err
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	if err := batch.serialize(sink, codec); err != nil {
+		return nil, fmt.Errorf("failed to serialize batch args: %v", err)
+	}
+	if err := sendCrossChain(stub, chainId, toProxy, "unlockBatch", sink.Bytes(), event); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to json marshal: %v", err)
+	}
+	if err := stub.PutState(getBatchRecordKey(batchId), raw); err != nil {
+		return nil, fmt.Errorf("failed to put batch record: %v", err)
+	}
+	logger.Infof("batch flushed: (token: %s, to_chainID: %d, batch_id: %s, size: %d)", token, chainId, batchId, len(ids))
+	return ids, nil
+}
+
+// getBatchLockIds returns the locks sent in batch id, nil if id is not a batch.
+func getBatchLockIds(stub shim.ChaincodeStubInterface, id string) ([]string, error) {
+	raw, err := stub.GetState(getBatchRecordKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get batch record: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var ids []string
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return nil, fmt.Errorf("failed to decode batch record: %v", err)
+	}
+	return ids, nil
+}
+
+func getBatchSize(stub shim.ChaincodeStubInterface, token string, chainId uint64) (uint64, error) {
+	raw, err := stub.GetState(getBatchSizeKey(token, chainId))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get batch size: %v", err)
+	}
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(raw), 10, 64)
+}
+
+func getBatchEntries(stub shim.ChaincodeStubInterface, token string, chainId uint64, limit int) ([]*BatchEntry, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(BatchEntryType, []string{token, strconv.FormatUint(chainId, 10)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query batch: %v", err)
+	}
+	defer iter.Close()
+	entries := make([]*BatchEntry, 0)
+	for iter.HasNext() && len(entries) < limit {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate batch: %v", err)
+		}
+		entry := &BatchEntry{}
+		if err := json.Unmarshal(kv.Value, entry); err != nil {
+			return nil, fmt.Errorf("failed to decode batch entry %s: %v", kv.Key, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func removeBatchEntry(stub shim.ChaincodeStubInterface, token string, chainId uint64, lockId string) error {
+	key, err := batchEntryKey(stub, token, chainId, lockId)
+	if err != nil {
+		return err
+	}
+	if err := stub.DelState(key); err != nil {
+		return fmt.Errorf("failed to delete batch entry: %v", err)
+	}
+	return nil
+}
+
+func batchEntryKey(stub shim.ChaincodeStubInterface, token string, chainId uint64, lockId string) (string, error) {
+	key, err := stub.CreateCompositeKey(BatchEntryType, []string{token, strconv.FormatUint(chainId, 10), lockId})
+	if err != nil {
+		return "", fmt.Errorf("failed to create batch entry key: %v", err)
+	}
+	return key, nil
+}
+
+func getBatchSizeKey(token string, chainId uint64) string {
+	return fmt.Sprintf(BatchSizeKey, token, chainId)
+}
+
+func getBatchRecordKey(id string) string {
+	return fmt.Sprintf(BatchRecordKey, id)
+}
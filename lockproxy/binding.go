@@ -0,0 +1,438 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProxyBindType   = "proxy"
+	AssetBindType   = "asset"
+	DefaultPageSize = utils.DefaultPageSize
+	MaxMigrate      = 1000
+)
+
+type ProxyBinding struct {
+	ChainId   uint64 `json:"chain_id"`
+	ProxyHash string `json:"proxy_hash"`
+}
+
+type AssetBinding struct {
+	Token     string         `json:"token"`
+	ChainId   uint64         `json:"chain_id"`
+	AssetHash string         `json:"asset_hash"`
+	Decimals  *AssetDecimals `json:"decimals,omitempty"`
+}
+
+type ProxyBindingPage struct {
+	Bindings []*ProxyBinding `json:"bindings"`
+	Bookmark string          `json:"bookmark"`
+}
+
+type AssetBindingPage struct {
+	Bindings []*AssetBinding `json:"bindings"`
+	Bookmark string          `json:"bookmark"`
+}
+
+type ProxyConfig struct {
+	Owner         string          `json:"owner"`
+	Manager       string          `json:"manager"`
+	LockProxyAddr string          `json:"lock_proxy_addr"`
+	ProxyBindings []*ProxyBinding `json:"proxy_bindings"`
+	AssetBindings []*AssetBinding `json:"asset_bindings"`
+}
+
+// args: [pageSize, [bookmark]]
+func (lp *LockProxy) listProxyBindings(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	pageSize, bookmark, err := utils.ParsePageArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(ProxyBindType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query proxy bindings: %v", err))
+	}
+	defer iter.Close()
+	page := &ProxyBindingPage{Bindings: make([]*ProxyBinding, 0), Bookmark: meta.GetBookmark()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate proxy bindings: %v", err))
+		}
+		b, err := decodeProxyBinding(stub, kv.Key, kv.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Bindings = append(page.Bindings, b)
+	}
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: token, [pageSize, [bookmark]]
+func (lp *LockProxy) listAssetBindings(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return shim.Error("token chaincode name is required")
+	}
+	pageSize, bookmark, err := utils.ParsePageArgs(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(AssetBindType, []string{string(args[0])}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query asset bindings: %v", err))
+	}
+	defer iter.Close()
+	page := &AssetBindingPage{Bindings: make([]*AssetBinding, 0), Bookmark: meta.GetBookmark()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate asset bindings: %v", err))
+		}
+		b, err := decodeAssetBinding(stub, kv.Key, kv.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Bindings = append(page.Bindings, b)
+	}
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+func (lp *LockProxy) unbindProxyHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	key, err := proxyBindCompositeKey(stub, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.DelState(key); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete proxy: %v", err))
+	}
+	if err := stub.DelState(getProxyBindKey(chainId)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete proxy: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: token, chainId
+func (lp *LockProxy) unbindAssetHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	token := string(args[0])
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	key, err := assetBindCompositeKey(stub, chainId, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, k := range []string{key, getAssetBindKey(chainId, token), getAssetDecimalsKey(chainId, token)} {
+		if err := stub.DelState(k); err != nil {
+			return shim.Error(fmt.Sprintf("failed to delete asset: %v", err))
+		}
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getConfig(stub shim.ChaincodeStubInterface) pb.Response {
+	conf := &ProxyConfig{
+		ProxyBindings: make([]*ProxyBinding, 0),
+		AssetBindings: make([]*AssetBinding, 0),
+	}
+	owner, err := stub.GetState(ProxyOwner)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get owner: %v", err))
+	}
+	conf.Owner = hex.EncodeToString(owner)
+	ccm, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get cross chain manager name: %v", err))
+	}
+	conf.Manager = string(ccm)
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+	conf.LockProxyAddr = hex.EncodeToString(lpAddr)
+
+	proxyIter, err := stub.GetStateByPartialCompositeKey(ProxyBindType, []string{})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query proxy bindings: %v", err))
+	}
+	defer proxyIter.Close()
+	for proxyIter.HasNext() {
+		kv, err := proxyIter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate proxy bindings: %v", err))
+		}
+		b, err := decodeProxyBinding(stub, kv.Key, kv.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		conf.ProxyBindings = append(conf.ProxyBindings, b)
+	}
+
+	assetIter, err := stub.GetStateByPartialCompositeKey(AssetBindType, []string{})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query asset bindings: %v", err))
+	}
+	defer assetIter.Close()
+	for assetIter.HasNext() {
+		kv, err := assetIter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate asset bindings: %v", err))
+		}
+		b, err := decodeAssetBinding(stub, kv.Key, kv.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		conf.AssetBindings = append(conf.AssetBindings, b)
+	}
+
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// migrateBindings moves the bindings stored before composite keys, at most limit
+// keys from startKey, so that they are listed. The asset bindings are moved first,
+// then the proxy bindings. It returns the key to start the next call with, empty
+// when done. args: [startKey, [limit]]
+func (lp *LockProxy) migrateBindings(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) > 2 {
+		return shim.Error("number of args should be at most 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	start := ""
+	if len(args) > 0 {
+		start = string(args[0])
+	}
+	limit := MaxMigrate
+	if len(args) == 2 {
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil || n <= 0 || n > MaxMigrate {
+			return shim.Error(fmt.Sprintf("limit should be 1 to %d", MaxMigrate))
+		}
+		limit = n
+	}
+	n := 0
+	for _, prefix := range []string{AssetBindType + "-", ProxyBindType + "-"} {
+		end := utils.PrefixEnd(prefix)
+		if start >= end {
+			continue
+		}
+		from := prefix
+		if start > from {
+			from = start
+		}
+		iter, err := stub.GetStateByRange(from, end)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to query legacy bindings: %v", err))
+		}
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return shim.Error(fmt.Sprintf("failed to iterate legacy bindings: %v", err))
+			}
+			if n == limit {
+				iter.Close()
+				return shim.Success([]byte(kv.Key))
+			}
+			n++
+			if err := migrateBinding(stub, kv.Key, kv.Value); err != nil {
+				iter.Close()
+				return shim.Error(fmt.Sprintf("failed to migrate %s: %v", kv.Key, err))
+			}
+		}
+		iter.Close()
+	}
+	return shim.Success(nil)
+}
+
+// migrateBinding writes a legacy binding under its composite key, unless it was bound
+// again since, and deletes the legacy key. Keys not in a legacy format are skipped.
+func migrateBinding(stub shim.ChaincodeStubInterface, key string, val []byte) error {
+	if rest := strings.TrimPrefix(key, ProxyBindType+"-"); rest != key {
+		chainId, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil {
+			return nil
+		}
+		ck, err := proxyBindCompositeKey(stub, chainId)
+		if err != nil {
+			return err
+		}
+		return moveBinding(stub, key, ck, val)
+	}
+	rest := strings.TrimPrefix(key, AssetBindType+"-")
+	idx := strings.Index(rest, "-")
+	if rest == key || idx <= 0 || idx == len(rest)-1 {
+		return nil
+	}
+	chainId, err := strconv.ParseUint(rest[:idx], 10, 64)
+	if err != nil {
+		return nil
+	}
+	ck, err := assetBindCompositeKey(stub, chainId, rest[idx+1:])
+	if err != nil {
+		return err
+	}
+	return moveBinding(stub, key, ck, val)
+}
+
+func moveBinding(stub shim.ChaincodeStubInterface, legacy, key string, val []byte) error {
+	cur, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if len(cur) == 0 && len(val) != 0 {
+		if err := stub.PutState(key, val); err != nil {
+			return err
+		}
+	}
+	return stub.DelState(legacy)
+}
+
+func PutProxyBinding(stub shim.ChaincodeStubInterface, chainId uint64, hash []byte) error {
+	key, err := proxyBindCompositeKey(stub, chainId)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, hash); err != nil {
+		return err
+	}
+	return stub.DelState(getProxyBindKey(chainId))
+}
+
+// GetProxyBinding reads the binding of chainId, falling back to the key used before
+// bindings were stored with composite keys.
+func GetProxyBinding(stub shim.ChaincodeStubInterface, chainId uint64) ([]byte, error) {
+	key, err := proxyBindCompositeKey(stub, chainId)
+	if err != nil {
+		return nil, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) != 0 {
+		return val, nil
+	}
+	return stub.GetState(getProxyBindKey(chainId))
+}
+
+func PutAssetBinding(stub shim.ChaincodeStubInterface, chainId uint64, token string, hash []byte) error {
+	key, err := assetBindCompositeKey(stub, chainId, token)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, hash); err != nil {
+		return err
+	}
+	return stub.DelState(getAssetBindKey(chainId, token))
+}
+
+func GetAssetBinding(stub shim.ChaincodeStubInterface, chainId uint64, token string) ([]byte, error) {
+	key, err := assetBindCompositeKey(stub, chainId, token)
+	if err != nil {
+		return nil, err
+	}
+	val, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) != 0 {
+		return val, nil
+	}
+	return stub.GetState(getAssetBindKey(chainId, token))
+}
+
+func decodeProxyBinding(stub shim.ChaincodeStubInterface, key string, val []byte) (*ProxyBinding, error) {
+	_, attrs, err := stub.SplitCompositeKey(key)
+	if err != nil || len(attrs) != 1 {
+		return nil, fmt.Errorf("wrong proxy binding key %s: %v", key, err)
+	}
+	chainId, err := strconv.ParseUint(attrs[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chainId of key %s: %v", key, err)
+	}
+	return &ProxyBinding{ChainId: chainId, ProxyHash: hex.EncodeToString(val)}, nil
+}
+
+func decodeAssetBinding(stub shim.ChaincodeStubInterface, key string, val []byte) (*AssetBinding, error) {
+	_, attrs, err := stub.SplitCompositeKey(key)
+	if err != nil || len(attrs) != 2 {
+		return nil, fmt.Errorf("wrong asset binding key %s: %v", key, err)
+	}
+	chainId, err := strconv.ParseUint(attrs[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chainId of key %s: %v", key, err)
+	}
+	ad, err := getAssetDecimals(stub, chainId, attrs[0])
+	if err != nil {
+		return nil, err
+	}
+	return &AssetBinding{Token: attrs[0], ChainId: chainId, AssetHash: hex.EncodeToString(val), Decimals: ad}, nil
+}
+
+func proxyBindCompositeKey(stub shim.ChaincodeStubInterface, chainId uint64) (string, error) {
+	key, err := stub.CreateCompositeKey(ProxyBindType, []string{strconv.FormatUint(chainId, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create proxy binding key: %v", err)
+	}
+	return key, nil
+}
+
+func assetBindCompositeKey(stub shim.ChaincodeStubInterface, chainId uint64, token string) (string, error) {
+	key, err := stub.CreateCompositeKey(AssetBindType, []string{token, strconv.FormatUint(chainId, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create asset binding key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	pcommon "github.com/polynetwork/poly/common"
+	"io"
+	"math/big"
+)
+
+const (
+	MaxCallDataLen   = 4096
+	CallTargetType   = "call_target"
+	CallTargetSet    = "proxy_call_target_set"
+	CallTargetRemove = "proxy_call_target_removed"
+)
+
+// FabricCall is the call data understood by this lockproxy when unlocking. The
+// chaincode and method must be listed by setCallTarget. Chaincode is invoked with
+// (Method, token, hex toAddress, amount, Args...) and the funds go to the address
+// of the target instead of ToAddress, it is up to the target to credit ToAddress.
+// If the target is not listed or the call fails, the funds go to ToAddress.
+type FabricCall struct {
+	Chaincode string
+	Method    string
+	Args      [][]byte
+}
+
+func (fc *FabricCall) Serialization(sink *pcommon.ZeroCopySink) {
+	sink.WriteString(fc.Chaincode)
+	sink.WriteString(fc.Method)
+	sink.WriteVarUint(uint64(len(fc.Args)))
+	for _, arg := range fc.Args {
+		sink.WriteVarBytes(arg)
+	}
+}
+
+func (fc *FabricCall) Deserialization(source *pcommon.ZeroCopySource) error {
+	chaincode, eof := source.NextString()
+	if eof {
+		return fmt.Errorf("FabricCall.Deserialization NextString Chaincode error:%s", io.ErrUnexpectedEOF)
+	}
+	method, eof := source.NextString()
+	if eof {
+		return fmt.Errorf("FabricCall.Deserialization NextString Method error:%s", io.ErrUnexpectedEOF)
+	}
+	n, eof := source.NextVarUint()
+	if eof {
+		return fmt.Errorf("FabricCall.Deserialization NextVarUint length error:%s", io.ErrUnexpectedEOF)
+	}
+	if n > source.Len() {
+		return fmt.Errorf("FabricCall.Deserialization too many args: %d", n)
+	}
+	args := make([][]byte, 0, n)
+	for i := uint64(0); i < n; i++ {
+		arg, eof := source.NextVarBytes()
+		if eof {
+			return fmt.Errorf("FabricCall.Deserialization NextVarBytes No.%d arg error:%s", i, io.ErrUnexpectedEOF)
+		}
+		args = append(args, arg)
+	}
+	if chaincode == "" || method == "" {
+		return fmt.Errorf("FabricCall.Deserialization chaincode and method are required")
+	}
+
+	fc.Chaincode = chaincode
+	fc.Method = method
+	fc.Args = args
+	return nil
+}
+
+// args: token, toChainId, hex toAddress, amount, hex callData, [memo]
+func (lp *LockProxy) lockWithData(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("args number should be 5 or 6")
+	}
+	param, err := parseLockParam(stub, args[:4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callData, err := hex.DecodeString(string(args[4]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex call data: %v", err))
+	}
+	if len(callData) == 0 || len(callData) > MaxCallDataLen {
+		return shim.Error(fmt.Sprintf("length of call data should be in [1, %d]", MaxCallDataLen))
+	}
+	param.CallData = callData
+	if len(args) == 6 {
+		if param.Memo, err = parseMemo(args[5]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return lp.lockLogic(stub, param)
+}
+
+// CallTarget is a chaincode method allowed in call data. Address is the account
+// of the chaincode receiving the unlocked funds before it is invoked.
+type CallTarget struct {
+	Chaincode string `json:"chaincode"`
+	Method    string `json:"method"`
+	Address   string `json:"address"`
+}
+
+// setCallTarget allows call data to invoke method of chaincode. The call runs
+// under the identity of the relayer with ccm as the top-level chaincode, so only
+// list methods built to be called this way.
+// args: chaincode, method, hex address of the chaincode
+func (lp *LockProxy) setCallTarget(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if len(args[0]) == 0 || len(args[1]) == 0 {
+		return shim.Error("chaincode and method are required")
+	}
+	// the token trusts these methods called during unlock
+	switch method := string(args[1]); method {
+	case ProxyTransfer, ProxyTransferFrom, ProxyMint, ProxyBurn:
+		return shim.Error(fmt.Sprintf("method %s can't be a call target", method))
+	}
+	addr, err := decodeHexAddr(string(args[2]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := getCallTargetKey(stub, string(args[0]), string(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	target := &CallTarget{
+		Chaincode: string(args[0]),
+		Method:    string(args[1]),
+		Address:   hex.EncodeToString(addr),
+	}
+	raw, err := json.Marshal(target)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(key, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put call target: %v", err))
+	}
+	if err := stub.SetEvent(CallTargetSet, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: chaincode, method
+func (lp *LockProxy) removeCallTarget(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	key, err := getCallTargetKey(stub, string(args[0]), string(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.DelState(key); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete call target: %v", err))
+	}
+	raw, err := json.Marshal(&CallTarget{Chaincode: string(args[0]), Method: string(args[1])})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(CallTargetRemove, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: chaincode, method
+func (lp *LockProxy) getCallTarget(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	key, err := getCallTargetKey(stub, string(args[0]), string(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get call target: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// parseCallData decodes call data and returns the address its target receives funds at.
+func parseCallData(stub shim.ChaincodeStubInterface, callData []byte) (*FabricCall, []byte, error) {
+	call := &FabricCall{}
+	if err := call.Deserialization(pcommon.NewZeroCopySource(callData)); err != nil {
+		return nil, nil, err
+	}
+	key, err := getCallTargetKey(stub, call.Chaincode, call.Method)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get call target: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil, fmt.Errorf("method %s of chaincode %s is not an allowed call target", call.Method, call.Chaincode)
+	}
+	target := &CallTarget{}
+	if err := json.Unmarshal(raw, target); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode call target: %v", err)
+	}
+	addr, err := hex.DecodeString(target.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode hex address of call target: %v", err)
+	}
+	return call, addr, nil
+}
+
+// invokeCallData calls the target in call data, the funds are sent to its address
+// in the same tx if it succeeds. The writes of a failed call are not rolled back,
+// so a target should fail before writing.
+func invokeCallData(stub shim.ChaincodeStubInterface, call *FabricCall, token string, toAddr []byte, amt *big.Int) error {
+	invokeArgs := make([][]byte, 0, len(call.Args)+4)
+	invokeArgs = append(invokeArgs, []byte(call.Method), []byte(token), []byte(hex.EncodeToString(toAddr)), []byte(amt.String()))
+	invokeArgs = append(invokeArgs, call.Args...)
+	resp := stub.InvokeChaincode(call.Chaincode, invokeArgs, "")
+	if resp.Status != shim.OK {
+		return fmt.Errorf("chaincode %s method %s: %s", call.Chaincode, call.Method, resp.GetMessage())
+	}
+	return nil
+}
+
+func getCallTargetKey(stub shim.ChaincodeStubInterface, chaincode, method string) (string, error) {
+	key, err := stub.CreateCompositeKey(CallTargetType, []string{chaincode, method})
+	if err != nil {
+		return "", fmt.Errorf("failed to create call target key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcommon "github.com/polynetwork/poly/common"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+const (
+	CodecFixed32 = "fixed32"
+	CodecNeoVM   = "neovm"
+)
+
+// TxArgsCodec is how the amount of TxArgs is laid out for the VM of the other chain.
+type TxArgsCodec interface {
+	writeAmount(sink *pcommon.ZeroCopySink, amt *big.Int) error
+	readAmount(source *pcommon.ZeroCopySource) (*big.Int, error)
+}
+
+// fixed32Codec is the 32 bytes little-endian uint256 of EVM lockproxy.
+type fixed32Codec struct{}
+
+func (c fixed32Codec) writeAmount(sink *pcommon.ZeroCopySink, amt *big.Int) error {
+	raw, err := PadFixedBytes(amt, 32)
+	if err != nil {
+		return err
+	}
+	sink.WriteBytes(raw)
+	return nil
+}
+
+func (c fixed32Codec) readAmount(source *pcommon.ZeroCopySource) (*big.Int, error) {
+	value, eof := source.NextBytes(32)
+	if eof {
+		return nil, fmt.Errorf("Args.Deserialization NextBytes Value error:%s", io.ErrUnexpectedEOF)
+	}
+	amt, err := UnpadFixedBytes(value, 32)
+	if err != nil {
+		return nil, fmt.Errorf("faield to get amount: %v", err)
+	}
+	return amt, nil
+}
+
+// neoVMCodec writes the amount as var bytes of a NeoVM integer.
+type neoVMCodec struct{}
+
+func (c neoVMCodec) writeAmount(sink *pcommon.ZeroCopySink, amt *big.Int) error {
+	if amt.Sign() < 0 {
+		return fmt.Errorf("negative amount %s", amt.String())
+	}
+	sink.WriteVarBytes(utils.BigIntToNeoBytes(amt))
+	return nil
+}
+
+func (c neoVMCodec) readAmount(source *pcommon.ZeroCopySource) (*big.Int, error) {
+	value, eof := source.NextVarBytes()
+	if eof {
+		return nil, fmt.Errorf("Args.Deserialization NextVarBytes Value error:%s", io.ErrUnexpectedEOF)
+	}
+	amt := utils.BigIntFromNeoBytes(value)
+	if amt.Sign() < 0 || amt.BitLen() > 255 {
+		return nil, fmt.Errorf("wrong amount %s", amt.String())
+	}
+	return amt, nil
+}
+
+func newTxArgsCodec(name string) (TxArgsCodec, error) {
+	switch name {
+	case CodecFixed32:
+		return fixed32Codec{}, nil
+	case CodecNeoVM:
+		return neoVMCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %s", name)
+}
+
+// codecName is the codec set for the family or the default one of the family.
+func (cf *ChainFamily) codecName() string {
+	if cf.Codec != "" {
+		return cf.Codec
+	}
+	switch cf.Family {
+	case FamilyNeo, FamilyOntology:
+		return CodecNeoVM
+	}
+	return CodecFixed32
+}
+
+// args: chainId, codec. The chain must have a family registered, an empty
+// codec goes back to the default one of the family.
+func (lp *LockProxy) setTxArgsCodec(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	if len(args[1]) > 0 {
+		if _, err := newTxArgsCodec(string(args[1])); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	cf, err := getFamily(stub, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if cf == nil {
+		return shim.Error(fmt.Sprintf("no family registered for chain %d", chainId))
+	}
+	cf.Codec = string(args[1])
+	raw, err := json.Marshal(cf)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(getChainFamilyKey(chainId), raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put chain family: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// getTxArgsCodec returns fixed32 for chains without family.
+func getTxArgsCodec(stub shim.ChaincodeStubInterface, chainId uint64) (TxArgsCodec, error) {
+	cf, err := getFamily(stub, chainId)
+	if err != nil {
+		return nil, err
+	}
+	if cf == nil {
+		return fixed32Codec{}, nil
+	}
+	return newTxArgsCodec(cf.codecName())
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strings"
+)
+
+const (
+	DeniedKey        = "denied-%s"
+	HeldKey          = "held-%s-%s"
+	ComplianceAttr   = "lockproxy.compliance"
+	DenylistUpdated  = "proxy_denylist_updated"
+	HeldReleased     = "proxy_held_released"
+	DenylistAdd      = "add"
+	DenylistRemove   = "remove"
+	MaxDenylistBatch = 200
+)
+
+type DenylistEvent struct {
+	Op        string   `json:"op"`
+	Addresses []string `json:"addresses"`
+	Officer   string   `json:"officer"`
+}
+
+type HeldReleasedEvent struct {
+	Token  string   `json:"token"`
+	Owner  string   `json:"owner"`
+	To     string   `json:"to"`
+	Amount *big.Int `json:"amount"`
+}
+
+// updateDenylist adds or removes addresses in a batch. Addresses are hex, Fabric
+// senders and remote addresses in the raw bytes carried by cross chain messages.
+// args: add|remove, hex address...
+func (lp *LockProxy) updateDenylist(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) < 2 || len(args) > MaxDenylistBatch+1 {
+		return shim.Error(fmt.Sprintf("args number should be 2 to %d", MaxDenylistBatch+1))
+	}
+	officer, err := checkCompliance(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	op := string(args[0])
+	if op != DenylistAdd && op != DenylistRemove {
+		return shim.Error(fmt.Sprintf("op should be %s or %s", DenylistAdd, DenylistRemove))
+	}
+	addrs := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		addr, err := decodeHexAddr(string(arg))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		key := getDeniedKey(addr)
+		if op == DenylistAdd {
+			err = stub.PutState(key, []byte{1})
+		} else {
+			err = stub.DelState(key)
+		}
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to update denylist: %v", err))
+		}
+		addrs = append(addrs, hex.EncodeToString(addr))
+	}
+	rawEvent, err := json.Marshal(&DenylistEvent{Op: op, Addresses: addrs, Officer: officer})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(DenylistUpdated, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) isDenied(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	addr, err := decodeHexAddr(string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	denied, err := isDenied(stub, addr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied {
+		return shim.Success([]byte("true"))
+	}
+	return shim.Success([]byte("false"))
+}
+
+// args: token, hex owner
+func (lp *LockProxy) getHeld(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	owner, err := decodeHexAddr(string(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := stub.GetState(getHeldKey(string(args[0]), owner))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get held funds: %v", err))
+	}
+	return shim.Success([]byte(big.NewInt(0).SetBytes(raw).String()))
+}
+
+// releaseHeld pays out funds held for a denied address once compliance decides
+// where they go, e.g. back to the owner after delisting or to a seizure account.
+// args: token, hex owner, hex to, amount
+func (lp *LockProxy) releaseHeld(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("args number should be 4")
+	}
+	officer, err := checkCompliance(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	token := string(args[0])
+	owner, err := decodeHexAddr(string(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := decodeHexAddr(string(args[2]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, ok := big.NewInt(0).SetString(string(args[3]), 10)
+	if !ok || amt.Sign() != 1 {
+		return shim.Error(fmt.Sprintf("wrong amount: %s", args[3]))
+	}
+	if denied, err := isDenied(stub, to); err != nil {
+		return shim.Error(err.Error())
+	} else if denied {
+		return shim.Error(fmt.Sprintf("address %x is denied", to))
+	}
+	if err := addHeld(stub, token, owner, big.NewInt(0).Neg(amt)); err != nil {
+		return shim.Error(err.Error())
+	}
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+	if err := releaseToken(stub, token, lpAddr, to, amt); err != nil {
+		return shim.Error(fmt.Sprintf("failed to release held funds: %v", err))
+	}
+	logger.Infof("held funds released by %s: (token: %s, owner: %x, to: %x, amount: %s)",
+		officer, token, owner, to, amt.String())
+
+	rawEvent, err := json.Marshal(&HeldReleasedEvent{
+		Token:  token,
+		Owner:  hex.EncodeToString(owner),
+		To:     hex.EncodeToString(to),
+		Amount: amt,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(HeldReleased, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// checkScreening fails the lock if the sender, the spender or the receiver is denied.
+// Only these parties are known here, see payOut for unlocks.
+func checkScreening(stub shim.ChaincodeStubInterface, param *lockParam) error {
+	for _, addr := range [][]byte{param.From, param.Spender, param.ToAddress} {
+		denied, err := isDenied(stub, addr)
+		if err != nil {
+			return err
+		}
+		if denied {
+			return fmt.Errorf("address %x is denied", addr)
+		}
+	}
+	return nil
+}
+
+// payOut releases amt of owner to the address to, or keeps it at lpAddr as held
+// funds of owner if owner or the source sender from is denied, so that the cross
+// chain message is never stuck. from is nil if the message doesn't carry it.
+func payOut(stub shim.ChaincodeStubInterface, token string, lpAddr, from, owner, to []byte, amt *big.Int) (bool, error) {
+	denied, err := anyDenied(stub, from, owner)
+	if err != nil {
+		return false, err
+	}
+	if denied {
+		return true, addHeld(stub, token, owner, amt)
+	}
+	return false, releaseToken(stub, token, lpAddr, to, amt)
+}
+
+func checkCompliance(stub shim.ChaincodeStubInterface) (string, error) {
+	if err := cid.AssertAttributeValue(stub, ComplianceAttr, "true"); err != nil {
+		return "", fmt.Errorf("not compliance officer: %v", err)
+	}
+	addr, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(addr.Bytes()), nil
+}
+
+func isDenied(stub shim.ChaincodeStubInterface, addr []byte) (bool, error) {
+	if len(addr) == 0 {
+		return false, nil
+	}
+	raw, err := stub.GetState(getDeniedKey(addr))
+	if err != nil {
+		return false, fmt.Errorf("failed to get denylist: %v", err)
+	}
+	return len(raw) > 0, nil
+}
+
+func anyDenied(stub shim.ChaincodeStubInterface, addrs ...[]byte) (bool, error) {
+	for _, addr := range addrs {
+		denied, err := isDenied(stub, addr)
+		if err != nil || denied {
+			return denied, err
+		}
+	}
+	return false, nil
+}
+
+func addHeld(stub shim.ChaincodeStubInterface, token string, owner []byte, delta *big.Int) error {
+	key := getHeldKey(token, owner)
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get held funds: %v", err)
+	}
+	held := big.NewInt(0).SetBytes(raw)
+	held.Add(held, delta)
+	if held.Sign() < 0 {
+		return fmt.Errorf("held funds %s of %x is less than %s", big.NewInt(0).SetBytes(raw).String(),
+			owner, big.NewInt(0).Neg(delta).String())
+	}
+	if err := putBigInt(stub, key, held); err != nil {
+		return fmt.Errorf("failed to put held funds: %v", err)
+	}
+	return nil
+}
+
+func decodeHexAddr(s string) ([]byte, error) {
+	addr, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), "0x"))
+	if err != nil || len(addr) == 0 {
+		return nil, fmt.Errorf("wrong hex address %s", s)
+	}
+	return addr, nil
+}
+
+func getDeniedKey(addr []byte) string {
+	return fmt.Sprintf(DeniedKey, hex.EncodeToString(addr))
+}
+
+func getHeldKey(token string, owner []byte) string {
+	return fmt.Sprintf(HeldKey, token, hex.EncodeToString(owner))
+}
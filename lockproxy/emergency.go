@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+)
+
+const (
+	EmergencyDelayKey     = "emergency_delay"
+	EmergencyOpKey        = "emergency_op-%s"
+	EmergencyScheduled    = "proxy_emergency_scheduled"
+	EmergencyExecuted     = "proxy_emergency_executed"
+	EmergencyCancelled    = "proxy_emergency_cancelled"
+	EmergencyDelayChanged = "proxy_emergency_delay_changed"
+	DefaultEmergencyDelay = 2 * 24 * 3600
+	MinEmergencyDelay     = 3600
+
+	EmergencyWithdraw = "withdraw"
+	EmergencyMigrate  = "migrate"
+
+	EmergencyStatusScheduled = "scheduled"
+	EmergencyStatusExecuted  = "executed"
+	EmergencyStatusCancelled = "cancelled"
+)
+
+// EmergencyOp moves Amount of Token out of LockProxyAddr once ExecutableAt is
+// reached, to To for a withdrawal or to the LockProxyAddr of Successor for a
+// migration. The locked liquidity of ChainId is reduced as well, so that the
+// totals keep matching the balance of LockProxyAddr.
+type EmergencyOp struct {
+	Id           string   `json:"id"`
+	Kind         string   `json:"kind"`
+	Token        string   `json:"token"`
+	To           []byte   `json:"to"`
+	Successor    string   `json:"successor"`
+	Amount       *big.Int `json:"amount"`
+	ChainId      uint64   `json:"chain_id"`
+	ExecutableAt int64    `json:"executable_at"`
+	Status       string   `json:"status"`
+}
+
+// EmergencyDelay is Delay from EffectiveAt on and Previous before, so that a
+// shorter delay can't be used to rush an operation through before it's noticed.
+type EmergencyDelay struct {
+	Delay       int64 `json:"delay"`
+	Previous    int64 `json:"previous"`
+	EffectiveAt int64 `json:"effective_at"`
+}
+
+func (ed *EmergencyDelay) at(now int64) int64 {
+	if now < ed.EffectiveAt {
+		return ed.Previous
+	}
+	return ed.Delay
+}
+
+// setEmergencyDelay raises the delay at once, a shorter one takes effect after
+// the delay in force now. args: delay seconds, no less than MinEmergencyDelay
+func (lp *LockProxy) setEmergencyDelay(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	delay, err := strconv.ParseUint(string(args[0]), 10, 63)
+	if err != nil || delay < MinEmergencyDelay {
+		return shim.Error(fmt.Sprintf("delay should be no less than %d", MinEmergencyDelay))
+	}
+	ed, err := getEmergencyDelay(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	cur := ed.at(now)
+	ed = &EmergencyDelay{Delay: int64(delay), Previous: cur, EffectiveAt: now}
+	if ed.Delay < cur {
+		ed.EffectiveAt = now + cur
+	}
+	raw, err := json.Marshal(ed)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(EmergencyDelayKey, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put emergency delay: %v", err))
+	}
+	if err := stub.SetEvent(EmergencyDelayChanged, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getEmergencyDelay(stub shim.ChaincodeStubInterface) pb.Response {
+	ed, err := getEmergencyDelay(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(ed)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: token, hex to, amount, chainId
+func (lp *LockProxy) scheduleEmergencyWithdraw(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("args number should be 4")
+	}
+	to, err := hex.DecodeString(string(args[1]))
+	if err != nil || len(to) == 0 {
+		return shim.Error(fmt.Sprintf("failed to decode hex to: %s", args[1]))
+	}
+	return scheduleEmergency(stub, &EmergencyOp{Kind: EmergencyWithdraw, Token: string(args[0]), To: to}, args[2:])
+}
+
+// migrateLiquidity schedules moving the pool to a successor lockproxy chaincode.
+// args: token, successor chaincode, amount, chainId
+func (lp *LockProxy) migrateLiquidity(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("args number should be 4")
+	}
+	if len(args[1]) == 0 {
+		return shim.Error("successor chaincode is required")
+	}
+	return scheduleEmergency(stub, &EmergencyOp{Kind: EmergencyMigrate, Token: string(args[0]), Successor: string(args[1])}, args[2:])
+}
+
+func (lp *LockProxy) executeEmergency(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	op, err := getEmergencyOp(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if op.Status != EmergencyStatusScheduled {
+		return shim.Error(fmt.Sprintf("emergency %s is already %s", op.Id, op.Status))
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now < op.ExecutableAt {
+		return shim.Error(fmt.Sprintf("emergency %s can be executed after %d", op.Id, op.ExecutableAt))
+	}
+	to := op.To
+	if op.Kind == EmergencyMigrate {
+		resp := stub.InvokeChaincode(op.Successor, [][]byte{[]byte("getLockProxyAddr")}, "")
+		if resp.Status != shim.OK {
+			return shim.Error(fmt.Sprintf("failed to get LockProxyAddr of %s: %s", op.Successor, resp.GetMessage()))
+		}
+		if len(resp.Payload) == 0 {
+			return shim.Error(fmt.Sprintf("no LockProxyAddr of %s", op.Successor))
+		}
+		to = resp.Payload
+	}
+	// scheduled before the chainId was required
+	if op.ChainId == 0 {
+		return shim.Error(fmt.Sprintf("emergency %s has no chainId, cancel and schedule it again", op.Id))
+	}
+	if err := addLocked(stub, op.Token, op.ChainId, big.NewInt(0).Neg(op.Amount)); err != nil {
+		return shim.Error(err.Error())
+	}
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+	if err := releaseToken(stub, op.Token, lpAddr, to, op.Amount); err != nil {
+		return shim.Error(fmt.Sprintf("failed to move %s of %s to %x: %v", op.Amount.String(), op.Token, to, err))
+	}
+	op.To = to
+	op.Status = EmergencyStatusExecuted
+	return putEmergencyOp(stub, op, EmergencyExecuted)
+}
+
+func (lp *LockProxy) cancelEmergency(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	op, err := getEmergencyOp(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if op.Status != EmergencyStatusScheduled {
+		return shim.Error(fmt.Sprintf("emergency %s is already %s", op.Id, op.Status))
+	}
+	op.Status = EmergencyStatusCancelled
+	return putEmergencyOp(stub, op, EmergencyCancelled)
+}
+
+func (lp *LockProxy) getEmergency(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	raw, err := stub.GetState(getEmergencyOpKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get emergency: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// scheduleEmergency fills op with args amount, chainId and saves it with the txid.
+func scheduleEmergency(stub shim.ChaincodeStubInterface, op *EmergencyOp, args [][]byte) pb.Response {
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if op.Token == "" {
+		return shim.Error("token chaincode name is required")
+	}
+	ac, err := getAdapterConfig(stub, op.Token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if ac.Kind == AdapterBurnMint {
+		return shim.Error(fmt.Sprintf("nothing of %s is held by LockProxyAddr", op.Token))
+	}
+	amt, ok := big.NewInt(0).SetString(string(args[0]), 10)
+	if !ok || amt.Sign() != 1 {
+		return shim.Error(fmt.Sprintf("wrong amount: %s", args[0]))
+	}
+	op.Amount = amt
+	if op.ChainId, err = strconv.ParseUint(string(args[1]), 10, 64); err != nil || op.ChainId == 0 {
+		return shim.Error(fmt.Sprintf("wrong chainId: %s", args[1]))
+	}
+	ed, err := getEmergencyDelay(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	op.Id = stub.GetTxID()
+	op.ExecutableAt = now + ed.at(now)
+	op.Status = EmergencyStatusScheduled
+	return putEmergencyOp(stub, op, EmergencyScheduled)
+}
+
+func putEmergencyOp(stub shim.ChaincodeStubInterface, op *EmergencyOp, event string) pb.Response {
+	raw, err := json.Marshal(op)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.PutState(getEmergencyOpKey(op.Id), raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put emergency: %v", err))
+	}
+	if err := stub.SetEvent(event, raw); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+func getEmergencyOp(stub shim.ChaincodeStubInterface, id string) (*EmergencyOp, error) {
+	raw, err := stub.GetState(getEmergencyOpKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get emergency %s: %v", id, err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no emergency %s found", id)
+	}
+	op := &EmergencyOp{}
+	if err := json.Unmarshal(raw, op); err != nil {
+		return nil, fmt.Errorf("failed to decode emergency %s: %v", id, err)
+	}
+	return op, nil
+}
+
+// getEmergencyDelay reads the delay, which was stored as decimal seconds before
+// changes were delayed.
+func getEmergencyDelay(stub shim.ChaincodeStubInterface) (*EmergencyDelay, error) {
+	raw, err := stub.GetState(EmergencyDelayKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get emergency delay: %v", err)
+	}
+	if len(raw) == 0 {
+		return &EmergencyDelay{Delay: DefaultEmergencyDelay, Previous: DefaultEmergencyDelay}, nil
+	}
+	if delay, err := strconv.ParseInt(string(raw), 10, 64); err == nil {
+		return &EmergencyDelay{Delay: delay, Previous: delay}, nil
+	}
+	ed := &EmergencyDelay{}
+	if err := json.Unmarshal(raw, ed); err != nil {
+		return nil, fmt.Errorf("failed to decode emergency delay: %v", err)
+	}
+	return ed, nil
+}
+
+func getEmergencyOpKey(id string) string {
+	return fmt.Sprintf(EmergencyOpKey, id)
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+const (
+	ProxyTreasury = "proxy_treasury"
+	FeeConfigKey  = "fee-%d-%s"
+	FeeAccruedKey = "fee-accrued-%s"
+	FeeSet        = "proxy_fee_set"
+	FeeWithdraw   = "proxy_fee_withdraw"
+	TreasurySet   = "proxy_treasury_set"
+	FeeKindNone   = "none"
+	FeeKindFlat   = "flat"
+	FeeKindBps    = "bps"
+	FeeKindTiered = "tiered"
+	FeeBpsDenom   = 10000
+)
+
+// FeeTier applies to every amount greater than or equal to From until the next tier.
+type FeeTier struct {
+	From *big.Int `json:"from"`
+	Flat *big.Int `json:"flat"`
+	Bps  uint64   `json:"bps"`
+}
+
+type FeeConfig struct {
+	Kind  string     `json:"kind"`
+	Flat  *big.Int   `json:"flat,omitempty"`
+	Bps   uint64     `json:"bps,omitempty"`
+	Tiers []*FeeTier `json:"tiers,omitempty"`
+}
+
+func (fc *FeeConfig) calc(amt *big.Int) *big.Int {
+	switch fc.Kind {
+	case FeeKindFlat:
+		return big.NewInt(0).Set(fc.Flat)
+	case FeeKindBps:
+		return bpsOf(amt, fc.Bps)
+	case FeeKindTiered:
+		var tier *FeeTier
+		for _, t := range fc.Tiers {
+			if amt.Cmp(t.From) < 0 {
+				break
+			}
+			tier = t
+		}
+		if tier == nil {
+			return big.NewInt(0)
+		}
+		fee := bpsOf(amt, tier.Bps)
+		if tier.Flat != nil {
+			fee.Add(fee, tier.Flat)
+		}
+		return fee
+	}
+	return big.NewInt(0)
+}
+
+func (fc *FeeConfig) validate() error {
+	switch fc.Kind {
+	case FeeKindFlat:
+		if fc.Flat == nil || fc.Flat.Sign() != 1 {
+			return fmt.Errorf("flat fee should be positive")
+		}
+	case FeeKindBps:
+		if fc.Bps == 0 || fc.Bps >= FeeBpsDenom {
+			return fmt.Errorf("bps should be in (0, %d)", FeeBpsDenom)
+		}
+	case FeeKindTiered:
+		if len(fc.Tiers) == 0 {
+			return fmt.Errorf("no tiers")
+		}
+		for i, t := range fc.Tiers {
+			if t.From == nil || t.From.Sign() == -1 {
+				return fmt.Errorf("No.%d tier: from should be non-negative", i)
+			}
+		}
+		sort.Slice(fc.Tiers, func(i, j int) bool {
+			return fc.Tiers[i].From.Cmp(fc.Tiers[j].From) < 0
+		})
+		for i, t := range fc.Tiers {
+			if t.Bps >= FeeBpsDenom {
+				return fmt.Errorf("No.%d tier: bps should be less than %d", i, FeeBpsDenom)
+			}
+			if t.Flat != nil && t.Flat.Sign() == -1 {
+				return fmt.Errorf("No.%d tier: flat should be non-negative", i)
+			}
+			if i > 0 && t.From.Cmp(fc.Tiers[i-1].From) == 0 {
+				return fmt.Errorf("No.%d tier: duplicate from %s", i, t.From.String())
+			}
+		}
+	default:
+		return fmt.Errorf("unknown fee kind %s", fc.Kind)
+	}
+	return nil
+}
+
+type FeeSetEvent struct {
+	Token   string     `json:"token"`
+	ChainId uint64     `json:"chain_id"`
+	Fee     *FeeConfig `json:"fee"`
+}
+
+type FeeWithdrawEvent struct {
+	Token    string `json:"token"`
+	Treasury []byte `json:"treasury"`
+	Amount   []byte `json:"amount"`
+}
+
+type TreasurySetEvent struct {
+	OldTreasury []byte `json:"old_treasury"`
+	NewTreasury []byte `json:"new_treasury"`
+}
+
+// args: token, chainId, kind, [flat amount | bps | tiers in json]
+func (lp *LockProxy) setFee(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("args number should be 3 or 4")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	token := string(args[0])
+	if token == "" {
+		return shim.Error("token chaincode name is required")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+
+	fc := &FeeConfig{Kind: string(args[2])}
+	if fc.Kind == FeeKindNone {
+		if err := stub.DelState(getFeeConfigKey(chainId, token)); err != nil {
+			return shim.Error(fmt.Sprintf("failed to delete fee: %v", err))
+		}
+	} else {
+		if len(args) != 4 {
+			return shim.Error(fmt.Sprintf("fee value is required for kind %s", fc.Kind))
+		}
+		switch fc.Kind {
+		case FeeKindFlat:
+			flat, ok := big.NewInt(0).SetString(string(args[3]), 10)
+			if !ok {
+				return shim.Error(fmt.Sprintf("failed to decode flat fee: %s", args[3]))
+			}
+			fc.Flat = flat
+		case FeeKindBps:
+			bps, err := strconv.ParseUint(string(args[3]), 10, 64)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to parse bps: %v", err))
+			}
+			fc.Bps = bps
+		case FeeKindTiered:
+			if err := json.Unmarshal(args[3], &fc.Tiers); err != nil {
+				return shim.Error(fmt.Sprintf("failed to decode tiers: %v", err))
+			}
+		}
+		if err := fc.validate(); err != nil {
+			return shim.Error(fmt.Sprintf("invalid fee: %v", err))
+		}
+		raw, err := json.Marshal(fc)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+		}
+		if err := stub.PutState(getFeeConfigKey(chainId, token), raw); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put fee: %v", err))
+		}
+	}
+
+	rawEvent, err := json.Marshal(&FeeSetEvent{
+		Token:   token,
+		ChainId: chainId,
+		Fee:     fc,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(FeeSet, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getFee(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	raw, err := stub.GetState(getFeeConfigKey(chainId, string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get fee: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+func (lp *LockProxy) setTreasury(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	treasury, err := hex.DecodeString(string(args[0]))
+	if err != nil || len(treasury) != 20 {
+		return shim.Error(fmt.Sprintf("wrong treasury address: %s", args[0]))
+	}
+	old, err := stub.GetState(ProxyTreasury)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get treasury: %v", err))
+	}
+	if err := stub.PutState(ProxyTreasury, treasury); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put treasury: %v", err))
+	}
+	rawEvent, err := json.Marshal(&TreasurySetEvent{
+		OldTreasury: old,
+		NewTreasury: treasury,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(TreasurySet, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getTreasury(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(ProxyTreasury)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get treasury: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+func (lp *LockProxy) getAccruedFee(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	raw, err := stub.GetState(getFeeAccruedKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get accrued fee: %v", err))
+	}
+	return shim.Success(big.NewInt(0).SetBytes(raw).Bytes())
+}
+
+// args: token, [amount]. Withdraw all accrued fee if no amount given.
+func (lp *LockProxy) withdrawFee(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("args number should be 1 or 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	token := string(args[0])
+	treasury, err := stub.GetState(ProxyTreasury)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get treasury: %v", err))
+	}
+	if len(treasury) == 0 {
+		return shim.Error("no treasury set")
+	}
+
+	key := getFeeAccruedKey(token)
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get accrued fee: %v", err))
+	}
+	accrued := big.NewInt(0).SetBytes(raw)
+	amt := big.NewInt(0).Set(accrued)
+	if len(args) == 2 {
+		var ok bool
+		amt, ok = big.NewInt(0).SetString(string(args[1]), 10)
+		if !ok {
+			return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[1]))
+		}
+	}
+	if amt.Sign() != 1 {
+		return shim.Error("amount should be positive")
+	}
+	if amt.Cmp(accrued) > 0 {
+		return shim.Error(fmt.Sprintf("accrued fee %s is less than the amount %s", accrued.String(), amt.String()))
+	}
+	if err := putBigInt(stub, key, accrued.Sub(accrued, amt)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to update accrued fee: %v", err))
+	}
+
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+	if err := releaseToken(stub, token, lpAddr, treasury, amt); err != nil {
+		return shim.Error(fmt.Sprintf("failed to withdraw fee: %v", err))
+	}
+
+	rawEvent, err := json.Marshal(&FeeWithdrawEvent{
+		Token:    token,
+		Treasury: treasury,
+		Amount:   amt.Bytes(),
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(FeeWithdraw, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// chargeFee calculates the fee of a lock and adds it to the accrued fee of token.
+// The fee stays in the pool of lockproxy address until it's withdrawn to treasury.
+func chargeFee(stub shim.ChaincodeStubInterface, token string, chainId uint64, amt *big.Int) (*big.Int, error) {
+	raw, err := stub.GetState(getFeeConfigKey(chainId, token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee config: %v", err)
+	}
+	if len(raw) == 0 {
+		return big.NewInt(0), nil
+	}
+	fc := &FeeConfig{}
+	if err := json.Unmarshal(raw, fc); err != nil {
+		return nil, fmt.Errorf("failed to decode fee config: %v", err)
+	}
+	fee := fc.calc(amt)
+	if fee.Cmp(amt) >= 0 {
+		return nil, fmt.Errorf("amount %s is not enough to pay fee %s", amt.String(), fee.String())
+	}
+	if fee.Sign() == 0 {
+		return fee, nil
+	}
+
+	key := getFeeAccruedKey(token)
+	rawAccrued, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrued fee: %v", err)
+	}
+	accrued := big.NewInt(0).SetBytes(rawAccrued)
+	if err := putBigInt(stub, key, accrued.Add(accrued, fee)); err != nil {
+		return nil, fmt.Errorf("failed to update accrued fee: %v", err)
+	}
+	return fee, nil
+}
+
+func bpsOf(amt *big.Int, bps uint64) *big.Int {
+	res := big.NewInt(0).Mul(amt, big.NewInt(0).SetUint64(bps))
+	return res.Div(res, big.NewInt(FeeBpsDenom))
+}
+
+func getFeeConfigKey(chainId uint64, token string) string {
+	return fmt.Sprintf(FeeConfigKey, chainId, token)
+}
+
+func getFeeAccruedKey(token string) string {
+	return fmt.Sprintf(FeeAccruedKey, token)
+}
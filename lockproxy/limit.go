@@ -0,0 +1,260 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+)
+
+const (
+	LimitKey         = "limit-%s-%d-%s"
+	VolumeKey        = "volume-%s-%d-%s"
+	LimitSet         = "proxy_limit_set"
+	DirectionLock    = "lock"
+	DirectionUnlock  = "unlock"
+	VolumeWindow     = 24 * 3600
+	VolumeBucketSize = 3600
+)
+
+// Limit for one direction of (asset, chain). Nil field means no limit.
+type Limit struct {
+	Min      *big.Int `json:"min,omitempty"`
+	Max      *big.Int `json:"max,omitempty"`
+	DailyCap *big.Int `json:"daily_cap,omitempty"`
+}
+
+// VolumeBucket is the amount transferred in an hour starting from Start.
+type VolumeBucket struct {
+	Start  int64    `json:"start"`
+	Amount *big.Int `json:"amount"`
+}
+
+type LimitSetEvent struct {
+	Direction string `json:"direction"`
+	Token     string `json:"token"`
+	ChainId   uint64 `json:"chain_id"`
+	Limit     *Limit `json:"limit"`
+}
+
+// args: direction, token, chainId, min, max, dailyCap. Use "0" for no limit.
+func (lp *LockProxy) setLimit(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 6 {
+		return shim.Error("args number should be 6")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	direction := string(args[0])
+	if direction != DirectionLock && direction != DirectionUnlock {
+		return shim.Error(fmt.Sprintf("direction should be %s or %s", DirectionLock, DirectionUnlock))
+	}
+	token := string(args[1])
+	if token == "" {
+		return shim.Error("token chaincode name is required")
+	}
+	chainId, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+
+	vals := make([]*big.Int, 3)
+	for i, raw := range args[3:] {
+		val, ok := big.NewInt(0).SetString(string(raw), 10)
+		if !ok || val.Sign() == -1 {
+			return shim.Error(fmt.Sprintf("failed to decode No.%d limit: %s", i, raw))
+		}
+		if val.Sign() != 0 {
+			vals[i] = val
+		}
+	}
+	limit := &Limit{Min: vals[0], Max: vals[1], DailyCap: vals[2]}
+	if limit.Min != nil && limit.Max != nil && limit.Min.Cmp(limit.Max) > 0 {
+		return shim.Error(fmt.Sprintf("min %s is greater than max %s", limit.Min.String(), limit.Max.String()))
+	}
+
+	key := getLimitKey(direction, chainId, token)
+	if limit.Min == nil && limit.Max == nil && limit.DailyCap == nil {
+		if err := stub.DelState(key); err != nil {
+			return shim.Error(fmt.Sprintf("failed to delete limit: %v", err))
+		}
+	} else {
+		raw, err := json.Marshal(limit)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+		}
+		if err := stub.PutState(key, raw); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put limit: %v", err))
+		}
+	}
+
+	rawEvent, err := json.Marshal(&LimitSetEvent{
+		Direction: direction,
+		Token:     token,
+		ChainId:   chainId,
+		Limit:     limit,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(LimitSet, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: direction, token, chainId
+func (lp *LockProxy) getLimit(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	chainId, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	raw, err := stub.GetState(getLimitKey(string(args[0]), chainId, string(args[1])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get limit: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: direction, token, chainId. Return the volume of last 24 hours in decimal string.
+func (lp *LockProxy) getVolume(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	chainId, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	buckets, err := getVolumeBuckets(stub, getVolumeKey(string(args[0]), chainId, string(args[1])), now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(sumVolume(buckets).String()))
+}
+
+// checkLimit rejects the transfers if one breaks the limit of (asset, chain) and
+// records the amounts into the rolling volume. Transfers of one tx are checked in
+// one call, the volume written can't be read back in the same tx.
+func checkLimit(stub shim.ChaincodeStubInterface, direction, token string, chainId uint64, amts ...*big.Int) error {
+	raw, err := stub.GetState(getLimitKey(direction, chainId, token))
+	if err != nil {
+		return fmt.Errorf("failed to get limit: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	limit := &Limit{}
+	if err := json.Unmarshal(raw, limit); err != nil {
+		return fmt.Errorf("failed to decode limit: %v", err)
+	}
+	amt := big.NewInt(0)
+	for _, a := range amts {
+		if limit.Min != nil && a.Cmp(limit.Min) < 0 {
+			return fmt.Errorf("%s amount %s is less than the minimum %s for %s on chain %d",
+				direction, a.String(), limit.Min.String(), token, chainId)
+		}
+		if limit.Max != nil && a.Cmp(limit.Max) > 0 {
+			return fmt.Errorf("%s amount %s is greater than the maximum %s for %s on chain %d",
+				direction, a.String(), limit.Max.String(), token, chainId)
+		}
+		amt.Add(amt, a)
+	}
+	if limit.DailyCap == nil {
+		return nil
+	}
+
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+	key := getVolumeKey(direction, chainId, token)
+	buckets, err := getVolumeBuckets(stub, key, now)
+	if err != nil {
+		return err
+	}
+	total := sumVolume(buckets)
+	total.Add(total, amt)
+	if total.Cmp(limit.DailyCap) > 0 {
+		return fmt.Errorf("%s volume %s in 24 hours would exceed the cap %s for %s on chain %d",
+			direction, total.String(), limit.DailyCap.String(), token, chainId)
+	}
+
+	start := now - now%VolumeBucketSize
+	if l := len(buckets); l > 0 && buckets[l-1].Start == start {
+		buckets[l-1].Amount.Add(buckets[l-1].Amount, amt)
+	} else {
+		buckets = append(buckets, &VolumeBucket{Start: start, Amount: big.NewInt(0).Set(amt)})
+	}
+	rawBuckets, err := json.Marshal(buckets)
+	if err != nil {
+		return fmt.Errorf("failed to json marshal: %v", err)
+	}
+	if err := stub.PutState(key, rawBuckets); err != nil {
+		return fmt.Errorf("failed to put volume: %v", err)
+	}
+	return nil
+}
+
+// getVolumeBuckets returns the buckets still inside the window ending at now.
+func getVolumeBuckets(stub shim.ChaincodeStubInterface, key string, now int64) ([]*VolumeBucket, error) {
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	buckets := make([]*VolumeBucket, 0)
+	if err := json.Unmarshal(raw, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to decode volume: %v", err)
+	}
+	res := make([]*VolumeBucket, 0, len(buckets))
+	for _, b := range buckets {
+		if b.Start+VolumeWindow > now {
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+func sumVolume(buckets []*VolumeBucket) *big.Int {
+	sum := big.NewInt(0)
+	for _, b := range buckets {
+		sum.Add(sum, b.Amount)
+	}
+	return sum
+}
+
+func getLimitKey(direction string, chainId uint64, token string) string {
+	return fmt.Sprintf(LimitKey, direction, chainId, token)
+}
+
+func getVolumeKey(direction string, chainId uint64, token string) string {
+	return fmt.Sprintf(VolumeKey, direction, chainId, token)
+}
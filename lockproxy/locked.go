@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"strconv"
+)
+
+const (
+	LockedType     = "locked"
+	LockedAdjusted = "proxy_locked_adjusted"
+)
+
+// LockedInvariant compares what lock and unlock recorded with the real balance
+// of the lockproxy address. Holds is false if the pool is short.
+type LockedInvariant struct {
+	Token      string              `json:"token"`
+	Locked     map[string]*big.Int `json:"locked"`
+	Total      *big.Int            `json:"total"`
+	AccruedFee *big.Int            `json:"accrued_fee"`
+	Balance    *big.Int            `json:"balance"`
+	Surplus    *big.Int            `json:"surplus"`
+	Holds      bool                `json:"holds"`
+	// BurnMint is true when the token is bridged by burn and mint, lpAddr holds
+	// nothing then and the balance is not checked.
+	BurnMint bool `json:"burn_mint"`
+}
+
+type LockedAdjustedEvent struct {
+	Token   string   `json:"token"`
+	ChainId uint64   `json:"chain_id"`
+	Delta   *big.Int `json:"delta"`
+	Locked  *big.Int `json:"locked"`
+}
+
+// args: token, chainId
+func (lp *LockProxy) getLocked(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	locked, err := getLockedAmount(stub, string(args[0]), chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(locked.String()))
+}
+
+// adjustLocked adds the signed delta to the liquidity locked toward a chain. It
+// records what isn't locked through this proxy, e.g. the pools filled before the
+// accounting existed, liquidity migrated from another proxy, or how much of a
+// mapping asset may be minted for the remote chain. args: token, chainId, delta
+func (lp *LockProxy) adjustLocked(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	delta, ok := big.NewInt(0).SetString(string(args[2]), 10)
+	if !ok || delta.Sign() == 0 {
+		return shim.Error(fmt.Sprintf("wrong delta: %s", args[2]))
+	}
+	token := string(args[0])
+	locked, err := getLockedAmount(stub, token, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addLocked(stub, token, chainId, delta); err != nil {
+		return shim.Error(err.Error())
+	}
+	locked.Add(locked, delta)
+	rawEvent, err := json.Marshal(&LockedAdjustedEvent{
+		Token:   token,
+		ChainId: chainId,
+		Delta:   delta,
+		Locked:  locked,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(LockedAdjusted, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: token
+func (lp *LockProxy) checkLockedInvariant(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	token := string(args[0])
+	inv := &LockedInvariant{
+		Token:  token,
+		Locked: make(map[string]*big.Int),
+		Total:  big.NewInt(0),
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(LockedType, []string{token})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query locked: %v", err))
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate locked: %v", err))
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 2 {
+			return shim.Error(fmt.Sprintf("wrong locked key %s: %v", kv.Key, err))
+		}
+		amt := big.NewInt(0).SetBytes(kv.Value)
+		inv.Locked[attrs[1]] = amt
+		inv.Total.Add(inv.Total, amt)
+	}
+
+	rawFee, err := stub.GetState(getFeeAccruedKey(token))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get accrued fee: %v", err))
+	}
+	inv.AccruedFee = big.NewInt(0).SetBytes(rawFee)
+	ac, err := getAdapterConfig(stub, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if ac.Kind == AdapterBurnMint {
+		inv.BurnMint = true
+		inv.Holds = true
+		raw, err := json.Marshal(inv)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+		}
+		return shim.Success(raw)
+	}
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+	balance, err := invokeToken(stub, token, "balanceOf", []byte(hex.EncodeToString(lpAddr)))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get balance: %v", err))
+	}
+	inv.Balance = big.NewInt(0).SetBytes(balance)
+	inv.Surplus = big.NewInt(0).Sub(inv.Balance, inv.Total)
+	inv.Surplus.Sub(inv.Surplus, inv.AccruedFee)
+	inv.Holds = inv.Surplus.Sign() >= 0
+
+	raw, err := json.Marshal(inv)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// addLocked changes the liquidity locked toward chainId, it fails if more is
+// released than locked from that chain. Nothing recorded counts as zero.
+func addLocked(stub shim.ChaincodeStubInterface, token string, chainId uint64, delta *big.Int) error {
+	key, err := lockedKey(stub, token, chainId)
+	if err != nil {
+		return err
+	}
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get locked: %v", err)
+	}
+	locked := big.NewInt(0).SetBytes(raw)
+	locked.Add(locked, delta)
+	if locked.Sign() < 0 {
+		return fmt.Errorf("only %s of %s locked from chain %d, can't release %s",
+			big.NewInt(0).SetBytes(raw).String(), token, chainId, big.NewInt(0).Neg(delta).String())
+	}
+	if err := putBigInt(stub, key, locked); err != nil {
+		return fmt.Errorf("failed to put locked: %v", err)
+	}
+	return nil
+}
+
+func getLockedAmount(stub shim.ChaincodeStubInterface, token string, chainId uint64) (*big.Int, error) {
+	key, err := lockedKey(stub, token, chainId)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get locked: %v", err)
+	}
+	return big.NewInt(0).SetBytes(raw), nil
+}
+
+func lockedKey(stub shim.ChaincodeStubInterface, token string, chainId uint64) (string, error) {
+	key, err := stub.CreateCompositeKey(LockedType, []string{token, strconv.FormatUint(chainId, 10)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create locked key: %v", err)
+	}
+	return key, nil
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -28,6 +29,7 @@ import (
 	"io"
 	"math/big"
 	"strconv"
+	"unicode/utf8"
 )
 
 const (
@@ -39,24 +41,53 @@ const (
 	FromCCM                = "from_ccm"
 	ProxyOwnershipTransfer = "proxy_owner_transfer"
 	ProxyTransfer          = "proxyTransfer"
+	EventLock              = "LockEvent"
+	EventUnlock            = "UnlockEvent"
+	MaxMemoLen             = 256
 )
 
 var logger = shim.NewLogger("LockProxy")
 
+// TxArgs is the cross chain message of lock and unlock. CallData and Memo are
+// appended only when not empty, so the layout stays the same for plain transfers.
+// CallData is written, maybe empty, before a Memo.
 type TxArgs struct {
 	ToAssetHash []byte
 	ToAddress   []byte
 	Amount      *big.Int
+	CallData    []byte
+	Memo        []byte
+	// FromAddress is who locked on the source chain, screened when unlocking
+	FromAddress []byte
 }
 
 func (args *TxArgs) Serialization(sink *pcommon.ZeroCopySink) {
+	_ = args.serialize(sink, fixed32Codec{})
+}
+
+func (args *TxArgs) Deserialization(source *pcommon.ZeroCopySource) error {
+	return args.deserialize(source, fixed32Codec{})
+}
+
+func (args *TxArgs) serialize(sink *pcommon.ZeroCopySink, codec TxArgsCodec) error {
 	sink.WriteVarBytes(args.ToAssetHash)
 	sink.WriteVarBytes(args.ToAddress)
-	raw, _ := PadFixedBytes(args.Amount, 32)
-	sink.WriteBytes(raw)
+	if err := codec.writeAmount(sink, args.Amount); err != nil {
+		return err
+	}
+	if len(args.CallData) > 0 || len(args.Memo) > 0 || len(args.FromAddress) > 0 {
+		sink.WriteVarBytes(args.CallData)
+	}
+	if len(args.Memo) > 0 || len(args.FromAddress) > 0 {
+		sink.WriteVarBytes(args.Memo)
+	}
+	if len(args.FromAddress) > 0 {
+		sink.WriteVarBytes(args.FromAddress)
+	}
+	return nil
 }
 
-func (args *TxArgs) Deserialization(source *pcommon.ZeroCopySource) error {
+func (args *TxArgs) deserialize(source *pcommon.ZeroCopySource, codec TxArgsCodec) error {
 	assetHash, eof := source.NextVarBytes()
 	if eof {
 		return fmt.Errorf("Args.Deserialization NextVarBytes AssetHash error:%s", io.ErrUnexpectedEOF)
@@ -67,19 +98,49 @@ func (args *TxArgs) Deserialization(source *pcommon.ZeroCopySource) error {
 		return fmt.Errorf("Args.Deserialization NextVarBytes ToAddress error:%s", io.ErrUnexpectedEOF)
 	}
 
-	value, eof := source.NextBytes(32)
-	if eof {
-		return fmt.Errorf("Args.Deserialization NextBytes Value error:%s", io.ErrUnexpectedEOF)
+	amt, err := codec.readAmount(source)
+	if err != nil {
+		return err
 	}
 
-	amt, err := UnpadFixedBytes(value, 32)
-	if err != nil {
-		return fmt.Errorf("faield to get amount: %v", err)
+	var callData, memo, fromAddress []byte
+	if source.Len() > 0 {
+		callData, eof = source.NextVarBytes()
+		if eof {
+			return fmt.Errorf("Args.Deserialization NextVarBytes CallData error:%s", io.ErrUnexpectedEOF)
+		}
+	}
+	if source.Len() > 0 {
+		memo, eof = source.NextVarBytes()
+		if eof {
+			return fmt.Errorf("Args.Deserialization NextVarBytes Memo error:%s", io.ErrUnexpectedEOF)
+		}
+		if len(memo) > MaxMemoLen {
+			return fmt.Errorf("Args.Deserialization memo longer than %d", MaxMemoLen)
+		}
+	}
+	if source.Len() > 0 {
+		fromAddress, eof = source.NextVarBytes()
+		if eof {
+			return fmt.Errorf("Args.Deserialization NextVarBytes FromAddress error:%s", io.ErrUnexpectedEOF)
+		}
 	}
 
 	args.ToAssetHash = assetHash
 	args.ToAddress = toAddress
 	args.Amount = amt
+	args.CallData = nil
+	if len(callData) > 0 {
+		args.CallData = callData
+	}
+	args.Memo = nil
+	if len(memo) > 0 {
+		args.Memo = memo
+	}
+	args.FromAddress = nil
+	if len(fromAddress) > 0 {
+		args.FromAddress = fromAddress
+	}
 	return nil
 }
 
@@ -127,7 +188,7 @@ func (lp *LockProxy) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	case "transferOwnership":
 		return lp.transferOwnership(stub, args)
 	case "setManager":
-		return lp.setManager(stub, args)
+		return SetManager(stub, args)
 	case "bindProxyHash":
 		return lp.bindProxyHash(stub, args)
 	case "getProxyHash":
@@ -136,12 +197,154 @@ func (lp *LockProxy) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return lp.bindAssetHash(stub, args)
 	case "getAssetHash":
 		return lp.getAssetHash(stub, args)
+	case "unbindProxyHash":
+		return lp.unbindProxyHash(stub, args)
+	case "unbindAssetHash":
+		return lp.unbindAssetHash(stub, args)
+	case "listProxyBindings":
+		return lp.listProxyBindings(stub, args)
+	case "listAssetBindings":
+		return lp.listAssetBindings(stub, args)
+	case "migrateBindings":
+		return lp.migrateBindings(stub, args)
+	case "getConfig":
+		return lp.getConfig(stub)
+	case "getScalingRule":
+		return lp.getScalingRule(stub, args)
 	case "lock":
 		return lp.lock(stub, args)
+	case "lockWithData":
+		return lp.lockWithData(stub, args)
 	case "unlock":
 		return lp.unlock(stub, args)
 	case "getManager":
 		return lp.getManager(stub)
+	case "setLimit":
+		return lp.setLimit(stub, args)
+	case "getLimit":
+		return lp.getLimit(stub, args)
+	case "getVolume":
+		return lp.getVolume(stub, args)
+	case "setFee":
+		return lp.setFee(stub, args)
+	case "getFee":
+		return lp.getFee(stub, args)
+	case "setTreasury":
+		return lp.setTreasury(stub, args)
+	case "getTreasury":
+		return lp.getTreasury(stub)
+	case "getAccruedFee":
+		return lp.getAccruedFee(stub, args)
+	case "withdrawFee":
+		return lp.withdrawFee(stub, args)
+	case "setAdapter":
+		return lp.setAdapter(stub, args)
+	case "getAdapter":
+		return lp.getAdapter(stub, args)
+	case "bindAssetFactory":
+		return lp.bindAssetFactory(stub, args)
+	case "getAssetFactory":
+		return lp.getAssetFactory(stub, args)
+	case "registerAsset":
+		return lp.registerAsset(stub, args)
+	case "assetRegistered":
+		return lp.assetRegistered(stub, args)
+	case "getAssetRegistration":
+		return lp.getAssetRegistration(stub, args)
+	case "rotateCCM":
+		return RotateCCM(stub, args)
+	case "setTrustedCCM":
+		return SetTrustedCCM(stub, args)
+	case "removeTrustedCCM":
+		return RemoveTrustedCCM(stub, args)
+	case "getTrustedCCMs":
+		return GetTrustedCCMs(stub)
+	case "setEmergencyDelay":
+		return lp.setEmergencyDelay(stub, args)
+	case "getEmergencyDelay":
+		return lp.getEmergencyDelay(stub)
+	case "scheduleEmergencyWithdraw":
+		return lp.scheduleEmergencyWithdraw(stub, args)
+	case "migrateLiquidity":
+		return lp.migrateLiquidity(stub, args)
+	case "executeEmergency":
+		return lp.executeEmergency(stub, args)
+	case "cancelEmergency":
+		return lp.cancelEmergency(stub, args)
+	case "getEmergency":
+		return lp.getEmergency(stub, args)
+	case "unlockBatch":
+		return lp.unlockBatch(stub, args)
+	case "setBatchSize":
+		return lp.setBatchSize(stub, args)
+	case "getBatch":
+		return lp.getBatch(stub, args)
+	case "flushBatch":
+		return lp.flushBatch(stub, args)
+	case "lockFrom":
+		return lp.lockFrom(stub, args)
+	case "setOperator":
+		return lp.setOperator(stub, args)
+	case "isOperator":
+		return lp.isOperator(stub, args)
+	case "lockTokens":
+		return lp.lockTokens(stub, args)
+	case "getLocked":
+		return lp.getLocked(stub, args)
+	case "setChainFamily":
+		return lp.setChainFamily(stub, args)
+	case "getChainFamily":
+		return lp.getChainFamily(stub, args)
+	case "setTxArgsCodec":
+		return lp.setTxArgsCodec(stub, args)
+	case "adjustLocked":
+		return lp.adjustLocked(stub, args)
+	case "checkLockedInvariant":
+		return lp.checkLockedInvariant(stub, args)
+	case "ack":
+		return lp.ack(stub, args)
+	case "refund":
+		return lp.refund(stub, args)
+	case "setRefundTimeout":
+		return lp.setRefundTimeout(stub, args)
+	case "getLock":
+		return lp.getLock(stub, args)
+	case "updateDenylist":
+		return lp.updateDenylist(stub, args)
+	case "isDenied":
+		return lp.isDenied(stub, args)
+	case "getHeld":
+		return lp.getHeld(stub, args)
+	case "releaseHeld":
+		return lp.releaseHeld(stub, args)
+	case "setApprovers":
+		return lp.setApprovers(stub, args)
+	case "getApprovers":
+		return lp.getApprovers(stub)
+	case "setApprovalThreshold":
+		return lp.setApprovalThreshold(stub, args)
+	case "getApprovalThreshold":
+		return lp.getApprovalThreshold(stub, args)
+	case "approveUnlock":
+		return lp.approveUnlock(stub, args)
+	case "vetoUnlock":
+		return lp.vetoUnlock(stub, args)
+	case "resolveUnlock":
+		return lp.resolveUnlock(stub, args)
+	case "executeUnlock":
+		return lp.executeUnlock(stub, args)
+	case "getPendingUnlock":
+		return lp.getPendingUnlock(stub, args)
+	case "listPendingUnlocks":
+		return lp.listPendingUnlocks(stub, args)
+	case "listLocks":
+		return lp.listLocks(stub, args)
+	case "setCallTarget":
+		return lp.setCallTarget(stub, args)
+	case "removeCallTarget":
+		return lp.removeCallTarget(stub, args)
+	case "getCallTarget":
+		return lp.getCallTarget(stub, args)
 	}
 
 	return shim.Error(fmt.Sprintf("no function name %s found", fn))
@@ -193,19 +396,6 @@ func (lp *LockProxy) transferOwnership(stub shim.ChaincodeStubInterface, args []
 	return shim.Success(nil)
 }
 
-func (lp *LockProxy) setManager(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("args number should be 1")
-	}
-	if _, err := checkOwner(stub); err != nil {
-		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
-	}
-	if err := stub.PutState(ProxyCCM, args[0]); err != nil {
-		return shim.Error(fmt.Sprintf("failed to put cross chain manager name: %v", err))
-	}
-	return shim.Success(nil)
-}
-
 func (lp *LockProxy) getManager(stub shim.ChaincodeStubInterface) pb.Response {
 	raw, err := stub.GetState(ProxyCCM)
 	if err != nil {
@@ -229,15 +419,16 @@ func (lp *LockProxy) bindProxyHash(stub shim.ChaincodeStubInterface, args [][]by
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to decode hex target proxy: %v", err))
 	}
-	if err := stub.PutState(getProxyBindKey(chainId), target); err != nil {
+	if err := PutProxyBinding(stub, chainId, target); err != nil {
 		return shim.Error(fmt.Sprintf("failed to put proxy: %v", err))
 	}
 	return shim.Success(nil)
 }
 
+// args: token, chainId, hex target asset, [remote decimals, [local decimals]]
 func (lp *LockProxy) bindAssetHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
-	if len(args) != 3 {
-		return shim.Error("args number should be 3")
+	if len(args) < 3 || len(args) > 5 {
+		return shim.Error("args number should be 3, 4 or 5")
 	}
 	if _, err := checkOwner(stub); err != nil {
 		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
@@ -250,9 +441,23 @@ func (lp *LockProxy) bindAssetHash(stub shim.ChaincodeStubInterface, args [][]by
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to decode hex target asset: %v", err))
 	}
-	if err := stub.PutState(getAssetBindKey(chainId, string(args[0])), target); err != nil {
+	if err := PutAssetBinding(stub, chainId, string(args[0]), target); err != nil {
 		return shim.Error(fmt.Sprintf("failed to put asset: %v", err))
 	}
+	switch len(args) {
+	case 3:
+		if err := stub.DelState(getAssetDecimalsKey(chainId, string(args[0]))); err != nil {
+			return shim.Error(fmt.Sprintf("failed to delete asset decimals: %v", err))
+		}
+	case 4:
+		if err := putAssetDecimals(stub, chainId, string(args[0]), args[3], nil); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put asset decimals: %v", err))
+		}
+	case 5:
+		if err := putAssetDecimals(stub, chainId, string(args[0]), args[3], args[4]); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put asset decimals: %v", err))
+		}
+	}
 	return shim.Success(nil)
 }
 
@@ -264,9 +469,9 @@ func (lp *LockProxy) getProxyHash(stub shim.ChaincodeStubInterface, args [][]byt
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
 	}
-	val, err := stub.GetState(getProxyBindKey(chainId))
+	val, err := GetProxyBinding(stub, chainId)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to put proxy: %v", err))
+		return shim.Error(fmt.Sprintf("failed to get proxy: %v", err))
 	}
 	return shim.Success(val)
 }
@@ -279,61 +484,148 @@ func (lp *LockProxy) getAssetHash(stub shim.ChaincodeStubInterface, args [][]byt
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
 	}
-	val, err := stub.GetState(getAssetBindKey(chainId, string(args[0])))
+	val, err := GetAssetBinding(stub, chainId, string(args[0]))
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to put asset: %v", err))
+		return shim.Error(fmt.Sprintf("failed to get asset: %v", err))
 	}
 	return shim.Success(val)
 }
 
+// args: token, toChainId, hex toAddress, amount
 func (lp *LockProxy) lock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
-	if len(args) != 4 {
-		return shim.Error("args number should be 4")
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("args number should be 4 or 5")
 	}
-	token := string(args[0])
-	if token == "" {
-		return shim.Error("token chaincode name is required")
+	param, err := parseLockParam(stub, args[:4])
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	if len(args) == 5 {
+		if param.Memo, err = parseMemo(args[4]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return lp.lockLogic(stub, param)
+}
 
-	lpAddr, err := stub.GetState(LockProxyAddr)
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+// parseMemo checks the optional client reference of a lock.
+func parseMemo(raw []byte) ([]byte, error) {
+	if len(raw) > MaxMemoLen {
+		return nil, fmt.Errorf("memo should be no longer than %d", MaxMemoLen)
 	}
+	if !utf8.Valid(raw) {
+		return nil, fmt.Errorf("memo should be utf8")
+	}
+	return raw, nil
+}
 
-	from, err := utils.GetMsgSenderAddress(stub)
+// lockParam is what a lock request carries, no matter which lock function it comes from.
+type lockParam struct {
+	Token     string
+	From      []byte
+	ChainId   uint64
+	ToAddress []byte
+	Amount    *big.Int
+	CallData  []byte
+	// TokenIds is set instead of Amount when the adapter locks by id.
+	TokenIds []string
+	// Spender is set when the funds of From are locked by allowance.
+	Spender []byte
+	Memo    []byte
+}
+
+// parseLockParam parses token, toChainId, hex toAddress and amount, the sender is the one locking.
+func parseLockParam(stub shim.ChaincodeStubInterface, args [][]byte) (*lockParam, error) {
+	param, err := parseLockTarget(stub, args[:3])
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get tx sender: %v", err))
+		return nil, err
 	}
 	amt, ok := big.NewInt(0).SetString(string(args[3]), 10)
 	if !ok {
-		return shim.Error(fmt.Sprintf("failed to decode amount: %s", args[2]))
+		return nil, fmt.Errorf("failed to decode amount: %s", args[3])
 	}
 	if amt.Sign() != 1 {
-		return shim.Error(fmt.Sprintf("amount should be positive"))
+		return nil, fmt.Errorf("amount should be positive")
 	}
+	param.Amount = amt
+	return param, nil
+}
 
-	transferArgs := make([][]byte, 4)
-	transferArgs[0] = []byte(ProxyTransfer)
-	transferArgs[1] = from.Bytes()
-	transferArgs[2] = lpAddr
-	transferArgs[3] = amt.Bytes()
-	resp := stub.InvokeChaincode(token, transferArgs, "")
-	if resp.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("failed to lock asset: %s", resp.Message))
+// parseLockTarget parses token, toChainId and hex toAddress.
+func parseLockTarget(stub shim.ChaincodeStubInterface, args [][]byte) (*lockParam, error) {
+	token := string(args[0])
+	if token == "" {
+		return nil, fmt.Errorf("token chaincode name is required")
+	}
+	from, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tx sender: %v", err)
 	}
-
 	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+		return nil, fmt.Errorf("failed to parse chainId: %v", err)
+	}
+	toAddr, err := normalizeToAddress(stub, chainId, string(args[2]))
+	if err != nil {
+		return nil, err
+	}
+	return &lockParam{
+		Token:     token,
+		From:      from.Bytes(),
+		ChainId:   chainId,
+		ToAddress: toAddr,
+	}, nil
+}
+
+func (lp *LockProxy) lockLogic(stub shim.ChaincodeStubInterface, param *lockParam) pb.Response {
+	token, chainId := param.Token, param.ChainId
+	if err := checkScreening(stub, param); err != nil {
+		return shim.Error(err.Error())
 	}
-	toAsset, err := stub.GetState(getAssetBindKey(chainId, token))
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+
+	adapter, err := getTokenAdapter(stub, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(param.Spender) > 0 {
+		adapter = &allowanceAdapter{inner: adapter}
+	}
+	amt, err := adapter.Lock(stub, param, lpAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to lock asset: %v", err))
+	}
+	param.Amount = amt
+	if err := checkLimit(stub, DirectionLock, token, chainId, amt); err != nil {
+		return shim.Error(err.Error())
+	}
+	fee, err := chargeFee(stub, token, chainId, amt)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to charge fee: %v", err))
+	}
+	netAmt := big.NewInt(0).Sub(amt, fee)
+	remoteAmt := netAmt
+	ad, err := getAssetDecimals(stub, chainId, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if ad != nil {
+		if remoteAmt, err = ad.toRemote(netAmt); err != nil {
+			return shim.Error(fmt.Sprintf("failed to scale amount: %v", err))
+		}
+	}
+
+	toAsset, err := GetAssetBinding(stub, chainId, token)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to get toAsset: %v", err))
 	}
 	if len(toAsset) == 0 {
 		return shim.Error("get no toAsset")
 	}
-	toProxy, err := stub.GetState(getProxyBindKey(chainId))
+	toProxy, err := GetProxyBinding(stub, chainId)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("failed to get toProxy: %v", err))
 	}
@@ -341,91 +633,326 @@ func (lp *LockProxy) lock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Re
 		return shim.Error("get no toProxy")
 	}
 
-	ccm, err := stub.GetState(ProxyCCM)
+	// a batch carries addresses and amounts only, locks with call data or memo go alone
+	batchSize, err := getBatchSize(stub, token, chainId)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get ccm: %v", err))
+		return shim.Error(err.Error())
 	}
-	if len(ccm) == 0 {
-		return shim.Error("get no ccm")
+	if batchSize > 0 && len(param.CallData) == 0 && len(param.Memo) == 0 {
+		return lp.queueLock(stub, param, batchSize, toAsset, netAmt, remoteAmt, fee)
 	}
 
-	toAddr, err := hex.DecodeString(string(args[2]))
-	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to decode hex toAddr: %v", err))
-	}
 	txArgs := &TxArgs{
 		ToAssetHash: toAsset,
-		ToAddress:   toAddr,
-		Amount:      amt,
+		ToAddress:   param.ToAddress,
+		Amount:      remoteAmt,
+		CallData:    param.CallData,
+		Memo:        param.Memo,
+		FromAddress: param.From,
+	}
+	codec, err := getTxArgsCodec(stub, chainId)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 	sink := pcommon.NewZeroCopySink(nil)
-	txArgs.Serialization(sink)
+	if err := txArgs.serialize(sink, codec); err != nil {
+		return shim.Error(fmt.Sprintf("failed to serialize tx args: %v", err))
+	}
+	rawEvent, err := json.Marshal(newLockEvent(stub, param, toAsset, remoteAmt, fee))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := sendCrossChain(stub, chainId, toProxy, "unlock", sink.Bytes(), rawEvent); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addLocked(stub, token, chainId, netAmt); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, err := recordLock(stub, param, netAmt, fee); err != nil {
+		return shim.Error(fmt.Sprintf("failed to record lock: %v", err))
+	}
+
+	logger.Infof("successful to call ccm for cross-chain: (to_chainID: %d, to_contract: %x, to_asset: %x, to_addr: %x, amount: %s, remote_amount: %s, fee: %s, call_data: %x)",
+		chainId, toProxy, toAsset, param.ToAddress, netAmt.String(), remoteAmt.String(), fee.String(), param.CallData)
+
+	return shim.Success(rawEvent)
+}
+
+func newLockEvent(stub shim.ChaincodeStubInterface, param *lockParam, toAsset []byte, remoteAmt, fee *big.Int) *LockEvent {
+	return &LockEvent{
+		FromAsset:    param.Token,
+		FromAddress:  hex.EncodeToString(param.From),
+		ToChainId:    param.ChainId,
+		ToAsset:      hex.EncodeToString(toAsset),
+		ToAddress:    hex.EncodeToString(param.ToAddress),
+		Amount:       remoteAmt.String(),
+		Fee:          fee.String(),
+		CrossChainId: stub.GetTxID(),
+		Spender:      hex.EncodeToString(param.Spender),
+		Memo:         string(param.Memo),
+	}
+}
+
+// sendCrossChain asks ccm to call method of toProxy with the payload and sets
+// the from_ccm event for relayer. It can be called only once in a tx. Fabric keeps
+// one event per tx, so a json event of the DApp is appended as var bytes after the
+// ccm payload, which relayer decodes as before without reading the rest.
+func sendCrossChain(stub shim.ChaincodeStubInterface, chainId uint64, toProxy []byte, method string, payload, event []byte) error {
+	ccm, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return fmt.Errorf("failed to get ccm: %v", err)
+	}
+	if len(ccm) == 0 {
+		return fmt.Errorf("get no ccm")
+	}
 
 	invokeArgs := make([][]byte, 5)
 	invokeArgs[0] = []byte("crossChain")
-	invokeArgs[1] = args[1]
+	invokeArgs[1] = []byte(strconv.FormatUint(chainId, 10))
 	invokeArgs[2] = []byte(hex.EncodeToString(toProxy))
-	invokeArgs[3] = []byte("unlock")
-	invokeArgs[4] = []byte(hex.EncodeToString(sink.Bytes()))
+	invokeArgs[3] = []byte(method)
+	invokeArgs[4] = []byte(hex.EncodeToString(payload))
 
-	resp = stub.InvokeChaincode(string(ccm), invokeArgs, "")
+	resp := stub.InvokeChaincode(string(ccm), invokeArgs, "")
 	if resp.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("failed to InvokeChaincode ccm %s: %s", string(ccm), resp.Message))
+		return fmt.Errorf("failed to InvokeChaincode ccm %s: %s", string(ccm), resp.Message)
 	}
-	if err := stub.SetEvent(FromCCM, resp.Payload); err != nil {
-		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	if err := stub.SetEvent(FromCCM, fromCCMPayload(resp.Payload, event)); err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
 	}
+	return nil
+}
 
-	logger.Infof("successful to call ccm for cross-chain: (to_chainID: %d, to_contract: %x, to_asset: %x, to_addr: %x, amount: %s)",
-		chainId, toProxy, toAsset, toAddr, amt.String())
-
-	return shim.Success(nil)
+func fromCCMPayload(ccmPayload, event []byte) []byte {
+	if len(event) == 0 {
+		return ccmPayload
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	sink.WriteBytes(ccmPayload)
+	sink.WriteVarBytes(event)
+	return sink.Bytes()
 }
 
+// args: hex tx args, hex from contract, from chainId, [hex cross chain id], or
+// hex tx args only from a ccm not upgraded yet
 func (lp *LockProxy) unlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("args number should be 1")
+	msg, err := ParseCCMArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	ccname, err := utils.GetCallingChainCodeName(stub)
+	if err := CheckFromProxy(stub, msg); err != nil {
+		return shim.Error(err.Error())
+	}
+	fromChainId := msg.FromChainId
+	codec, err := getTxArgsCodec(stub, fromChainId)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	ccmName, _ := stub.GetState(ProxyCCM)
-	if len(ccmName) == 0 {
-		return shim.Error("No cross chain manager set")
+	txArgs := &TxArgs{}
+	if err := txArgs.deserialize(pcommon.NewZeroCopySource(msg.Args), codec); err != nil {
+		return shim.Error(fmt.Sprintf("failed to deserialize tx args: %v", err))
 	}
-	if ccname != string(ccmName) {
-		return shim.Error(fmt.Sprintf("wrong calling chaincode: (actual: %s, expected: %s)",
-			ccname, string(ccmName)))
+	event, err := unlockEntry(stub, fromChainId, string(txArgs.ToAssetHash), txArgs.FromAddress, txArgs.ToAddress,
+		txArgs.Amount, txArgs.CallData, txArgs.Memo, msg.CrossChainId, stub.GetTxID())
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	eventName := EventUnlock
+	if event.PendingId != "" {
+		eventName = UnlockQueued
 	}
 
-	raw, err := hex.DecodeString(string(args[0]))
+	rawEvent, err := json.Marshal(event)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to decode hex args: %v", err))
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
 	}
-	txArgs := &TxArgs{}
-	if err := txArgs.Deserialization(pcommon.NewZeroCopySource(raw)); err != nil {
-		return shim.Error(fmt.Sprintf("failed to deserialize tx args: %v", err))
+	if err := stub.SetEvent(eventName, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	// ccm emits the payload since the event of a called chaincode is dropped
+	return shim.Success(rawEvent)
+}
+
+// unlockEntry releases amt of token in local decimals from fromAddr on the source
+// chain to toAddr, or queues it as pendingId when it needs approval.
+func unlockEntry(stub shim.ChaincodeStubInterface, fromChainId uint64, token string, fromAddr, toAddr []byte, amt *big.Int,
+	callData, memo []byte, crossChainId, pendingId string) (*UnlockEvent, error) {
+	amt, err := toLocalAmount(stub, fromChainId, token, amt)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLimit(stub, DirectionUnlock, token, fromChainId, amt); err != nil {
+		return nil, err
+	}
+	if err := addLocked(stub, token, fromChainId, big.NewInt(0).Neg(amt)); err != nil {
+		return nil, err
+	}
+	event := &UnlockEvent{
+		ToAsset:      token,
+		ToAddress:    hex.EncodeToString(toAddr),
+		Amount:       amt.String(),
+		FromChainId:  fromChainId,
+		CrossChainId: crossChainId,
+		FromAddress:  hex.EncodeToString(fromAddr),
+		Memo:         string(memo),
+	}
+	queued, err := needApproval(stub, token, amt)
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		pu := &PendingUnlock{
+			Id:           pendingId,
+			Token:        token,
+			FromChainId:  fromChainId,
+			FromAddress:  fromAddr,
+			ToAddress:    toAddr,
+			Amount:       amt,
+			CallData:     callData,
+			CrossChainId: crossChainId,
+			Memo:         string(memo),
+		}
+		if err := queueUnlock(stub, pu); err != nil {
+			return nil, err
+		}
+		event.PendingId = pu.Id
+	} else if event.Held, event.CallFailed, err = releaseUnlock(stub, token, fromAddr, toAddr, amt, callData); err != nil {
+		return nil, err
 	}
+
+	logger.Infof("unlock success: (from_chainID: %d, to_addr: %x, amount: %s, call_data: %x, queued: %v)",
+		fromChainId, toAddr, amt.String(), callData, queued)
+	return event, nil
+}
+
+// releaseUnlock sends the unlocked funds to the receiver, or to the target of the
+// call data once the call succeeds. Call data which is not listed or whose call
+// fails doesn't fail the unlock: the funds go to the receiver and the reason is
+// returned. Funds are held for the receiver and the call data is skipped when the
+// receiver or the source sender is denied.
+func releaseUnlock(stub shim.ChaincodeStubInterface, token string, fromAddr, toAddr []byte, amt *big.Int,
+	callData []byte) (bool, string, error) {
 	lpAddr, err := stub.GetState(LockProxyAddr)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+		return false, "", fmt.Errorf("failed to get LockProxyAddr: %v", err)
 	}
+	denied, err := anyDenied(stub, fromAddr, toAddr)
+	if err != nil {
+		return false, "", err
+	}
+	var (
+		callErr error
+		payee   = toAddr
+	)
+	if len(callData) > 0 && !denied {
+		var (
+			call   *FabricCall
+			target []byte
+		)
+		if call, target, callErr = parseCallData(stub, callData); callErr == nil {
+			// a tx reads the committed state only, so the target can't see the
+			// funds in this tx anyway and they are sent once the call succeeds
+			if callErr = invokeCallData(stub, call, token, toAddr, amt); callErr == nil {
+				payee = target
+			}
+		}
+	}
+	held, err := payOut(stub, token, lpAddr, fromAddr, toAddr, payee, amt)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to transfer %s from DApp address %x to address %x: %v",
+			amt.String(), lpAddr, payee, err)
+	}
+	if held {
+		logger.Infof("funds held for denied address: (token: %s, from_addr: %x, to_addr: %x, amount: %s)",
+			token, fromAddr, toAddr, amt.String())
+		return true, "", nil
+	}
+	if callErr != nil {
+		logger.Warningf("call data failed, funds sent to the receiver: (token: %s, to_addr: %x, amount: %s, err: %v)",
+			token, toAddr, amt.String(), callErr)
+		return false, callErr.Error(), nil
+	}
+	return false, "", nil
+}
 
-	transferArgs := make([][]byte, 4)
-	transferArgs[0] = []byte(ProxyTransfer)
-	transferArgs[1] = lpAddr
-	transferArgs[2] = txArgs.ToAddress
-	transferArgs[3] = txArgs.Amount.Bytes()
-	resp := stub.InvokeChaincode(string(txArgs.ToAssetHash), transferArgs, "")
-	if resp.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("failed to transfer %s from DApp address %x to address %x: %s",
-			txArgs.Amount.String(), lpAddr, txArgs.ToAddress, resp.GetMessage()))
+func CheckCallingCCM(stub shim.ChaincodeStubInterface) error {
+	ccname, err := utils.GetCallingChainCodeName(stub)
+	if err != nil {
+		return err
 	}
+	ccmName, _ := stub.GetState(ProxyCCM)
+	if len(ccmName) == 0 {
+		return fmt.Errorf("No cross chain manager set")
+	}
+	trusted, err := isTrustedCCM(stub, ccname)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		return fmt.Errorf("wrong calling chaincode: (actual: %s, expected: %s)", ccname, string(ccmName))
+	}
+	return nil
+}
 
-	logger.Infof("unlock success: (to_addr: %x, amount: %s)", txArgs.ToAddress, txArgs.Amount.String())
+// CCMMessage is a cross chain message delivered by ccm to a method of a proxy chaincode.
+type CCMMessage struct {
+	Args         []byte
+	FromContract []byte
+	FromChainId  uint64
+	CrossChainId string
+}
 
-	return shim.Success(nil)
+// ParseCCMArgs checks the calling ccm and decodes the args it passes:
+// (hex args, hex from contract, from chainId, [hex cross chain id]). A ccm not
+// upgraded yet passes the hex args only, the rest is then read from the proof
+// it verified in this tx.
+func ParseCCMArgs(stub shim.ChaincodeStubInterface, args [][]byte) (*CCMMessage, error) {
+	if len(args) != 1 && len(args) != 3 && len(args) != 4 {
+		return nil, fmt.Errorf("args number should be 1, 3 or 4")
+	}
+	if err := CheckCallingCCM(stub); err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hex args: %v", err)
+	}
+	msg := &CCMMessage{Args: raw}
+	if len(args) == 1 {
+		val, err := utils.GetVerifiedMerkleValue(stub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cross chain message: %v", err)
+		}
+		if !bytes.Equal(val.MakeTxParam.Args, raw) {
+			return nil, fmt.Errorf("args not equal to the verified cross chain message")
+		}
+		msg.FromContract = val.MakeTxParam.FromContractAddress
+		msg.FromChainId = val.FromChainID
+		msg.CrossChainId = hex.EncodeToString(val.MakeTxParam.CrossChainID)
+		return msg, nil
+	}
+	if msg.FromContract, err = hex.DecodeString(string(args[1])); err != nil {
+		return nil, fmt.Errorf("failed to decode hex from contract: %v", err)
+	}
+	if msg.FromChainId, err = strconv.ParseUint(string(args[2]), 10, 64); err != nil {
+		return nil, fmt.Errorf("failed to parse from chainId: %v", err)
+	}
+	if len(args) == 4 {
+		msg.CrossChainId = string(args[3])
+	}
+	return msg, nil
+}
+
+// CheckFromProxy makes sure the message is sent by the proxy bound for the source chain.
+func CheckFromProxy(stub shim.ChaincodeStubInterface, msg *CCMMessage) error {
+	fromProxy, err := GetProxyBinding(stub, msg.FromChainId)
+	if err != nil {
+		return fmt.Errorf("failed to get proxy: %v", err)
+	}
+	if len(fromProxy) == 0 || !bytes.Equal(fromProxy, msg.FromContract) {
+		return fmt.Errorf("from contract %x is not the proxy bound for chain %d", msg.FromContract, msg.FromChainId)
+	}
+	return nil
 }
 
 func checkOwner(stub shim.ChaincodeStubInterface) ([]byte, error) {
@@ -443,6 +970,7 @@ func checkOwner(stub shim.ChaincodeStubInterface) ([]byte, error) {
 	return owner, nil
 }
 
+// getProxyBindKey and getAssetBindKey are keys used before bindings stored with composite keys.
 func getProxyBindKey(chainId uint64) string {
 	return fmt.Sprintf(ProxyBindKey, chainId)
 }
@@ -450,3 +978,24 @@ func getProxyBindKey(chainId uint64) string {
 func getAssetBindKey(chainId uint64, fromAsset string) string {
 	return fmt.Sprintf(AssetBindKey, chainId, fromAsset)
 }
+
+// transferToken calls proxyTransfer of the token chaincode, one of from and to must be the lockproxy address.
+func transferToken(stub shim.ChaincodeStubInterface, token string, from, to []byte, amt *big.Int) error {
+	transferArgs := make([][]byte, 4)
+	transferArgs[0] = []byte(ProxyTransfer)
+	transferArgs[1] = from
+	transferArgs[2] = to
+	transferArgs[3] = amt.Bytes()
+	resp := stub.InvokeChaincode(token, transferArgs, "")
+	if resp.Status != shim.OK {
+		return errors.New(resp.GetMessage())
+	}
+	return nil
+}
+
+func putBigInt(stub shim.ChaincodeStubInterface, key string, val *big.Int) error {
+	if val.Sign() == 0 {
+		return stub.DelState(key)
+	}
+	return stub.PutState(key, val.Bytes())
+}
@@ -0,0 +1,1279 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/assets"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcommon "github.com/polynetwork/poly/common"
+	pcom "github.com/polynetwork/poly/native/service/cross_chain_manager/common"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strconv"
+	"testing"
+)
+
+func TestFeeConfig_calc(t *testing.T) {
+	fc := &FeeConfig{Kind: FeeKindFlat, Flat: big.NewInt(10)}
+	assert.NoError(t, fc.validate())
+	assert.Equal(t, big.NewInt(10), fc.calc(big.NewInt(1000)))
+
+	fc = &FeeConfig{Kind: FeeKindBps, Bps: 30}
+	assert.NoError(t, fc.validate())
+	assert.Equal(t, big.NewInt(3), fc.calc(big.NewInt(1000)))
+
+	fc = &FeeConfig{Kind: FeeKindTiered}
+	assert.NoError(t, json.Unmarshal([]byte(`[{"from":10000,"bps":10},{"from":0,"flat":5,"bps":50}]`), &fc.Tiers))
+	assert.NoError(t, fc.validate())
+	assert.Equal(t, big.NewInt(10), fc.calc(big.NewInt(1000)))
+	assert.Equal(t, big.NewInt(20), fc.calc(big.NewInt(20000)))
+
+	fc = &FeeConfig{Kind: FeeKindBps, Bps: FeeBpsDenom}
+	assert.Error(t, fc.validate())
+}
+
+func TestSumVolume(t *testing.T) {
+	buckets := []*VolumeBucket{
+		{Start: 0, Amount: big.NewInt(100)},
+		{Start: VolumeBucketSize, Amount: big.NewInt(50)},
+	}
+	assert.Equal(t, big.NewInt(150), sumVolume(buckets))
+	assert.Equal(t, big.NewInt(0), sumVolume(nil))
+}
+
+func TestAssetDecimals_scale(t *testing.T) {
+	ad := &AssetDecimals{Local: 8, Remote: 18}
+	res, err := ad.toRemote(big.NewInt(1))
+	assert.NoError(t, err)
+	assert.Equal(t, pow10(10), res)
+	res, err = ad.toLocal(pow10(10))
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewInt(1), res)
+	_, err = ad.toLocal(big.NewInt(1))
+	assert.Error(t, err)
+}
+
+func TestTxArgs_CallData(t *testing.T) {
+	args := &TxArgs{
+		ToAssetHash: []byte("peth"),
+		ToAddress:   []byte{1, 2, 3},
+		Amount:      big.NewInt(1000),
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	plain := &TxArgs{}
+	assert.NoError(t, plain.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, plain)
+
+	call := &FabricCall{Chaincode: "vault", Method: "deposit", Args: [][]byte{[]byte("1")}}
+	callSink := pcommon.NewZeroCopySink(nil)
+	call.Serialization(callSink)
+	args.CallData = callSink.Bytes()
+	sink = pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	withData := &TxArgs{}
+	assert.NoError(t, withData.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, withData)
+
+	decoded := &FabricCall{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(withData.CallData)))
+	assert.Equal(t, call, decoded)
+}
+
+func TestAckArgs(t *testing.T) {
+	args := &AckArgs{CrossChainId: []byte{1, 2, 3}, Success: true}
+	sink := pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	decoded := &AckArgs{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, decoded)
+	assert.Error(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes()[:3])))
+}
+
+func TestAdapterConfig_adapter(t *testing.T) {
+	a, err := (&AdapterConfig{Kind: AdapterProxyTransfer}).adapter()
+	assert.NoError(t, err)
+	assert.IsType(t, &proxyTransferAdapter{}, a)
+
+	a, err = (&AdapterConfig{Kind: AdapterUTXO, ReleaseMethod: "pay"}).adapter()
+	assert.NoError(t, err)
+	assert.Equal(t, &utxoAdapter{lockMethod: "transferTokens", releaseMethod: "pay"}, a)
+
+	a, err = (&AdapterConfig{Kind: AdapterBurnMint}).adapter()
+	assert.NoError(t, err)
+	assert.IsType(t, &burnMintAdapter{}, a)
+
+	_, err = (&AdapterConfig{Kind: "unknown"}).adapter()
+	assert.Error(t, err)
+}
+
+func TestAddLocked(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	assert.NoError(t, addLocked(mock, "peth", 2, big.NewInt(100)))
+	assert.NoError(t, addLocked(mock, "peth", 2, big.NewInt(-30)))
+	assert.Error(t, addLocked(mock, "peth", 2, big.NewInt(-80)))
+	locked, err := getLockedAmount(mock, "peth", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewInt(70), locked)
+}
+
+func TestChainFamily_normalize(t *testing.T) {
+	evm := &ChainFamily{Family: FamilyEVM}
+	raw, err := evm.normalize("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, len(raw))
+	_, err = evm.normalize("5aaeb6053f3e94c9b9a09f33669435e7ef1beaed")
+	assert.NoError(t, err)
+	_, err = evm.normalize("0x5aaeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	assert.Error(t, err)
+	_, err = evm.normalize("0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea")
+	assert.Error(t, err)
+
+	cosmos := &ChainFamily{Family: FamilyCosmos, Hrp: "cosmos"}
+	raw, err = cosmos.normalize("cosmos1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnrk363e")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}, raw)
+	_, err = cosmos.normalize("cosmos1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnrk363f")
+	assert.Error(t, err)
+	_, err = (&ChainFamily{Family: FamilyCosmos, Hrp: "swth"}).normalize("cosmos1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnrk363e")
+	assert.Error(t, err)
+
+	var addr pcommon.Address
+	copy(addr[:], raw)
+	neo := &ChainFamily{Family: FamilyNeo}
+	fromBase58, err := neo.normalize(addr.ToBase58())
+	assert.NoError(t, err)
+	assert.Equal(t, raw, fromBase58)
+	fromHex, err := neo.normalize("0x" + addr.ToHexString())
+	assert.NoError(t, err)
+	assert.Equal(t, raw, fromHex)
+}
+
+func TestTxArgs_codec(t *testing.T) {
+	args := &TxArgs{
+		ToAssetHash: []byte("peth"),
+		ToAddress:   []byte{1, 2, 3},
+		Amount:      big.NewInt(200),
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	assert.NoError(t, args.serialize(sink, neoVMCodec{}))
+	// 200 needs a sign byte as NeoVM integer
+	assert.Equal(t, []byte{2, 200, 0}, sink.Bytes()[len(sink.Bytes())-3:])
+	decoded := &TxArgs{}
+	assert.NoError(t, decoded.deserialize(pcommon.NewZeroCopySource(sink.Bytes()), neoVMCodec{}))
+	assert.Equal(t, args, decoded)
+
+	sink = pcommon.NewZeroCopySink(nil)
+	assert.NoError(t, args.serialize(sink, fixed32Codec{}))
+	plain := &TxArgs{}
+	assert.NoError(t, plain.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, plain)
+
+	assert.Equal(t, CodecNeoVM, (&ChainFamily{Family: FamilyOntology}).codecName())
+	assert.Equal(t, CodecFixed32, (&ChainFamily{Family: FamilyNeo, Codec: CodecFixed32}).codecName())
+}
+
+func TestApprovalConfig(t *testing.T) {
+	ac := &ApprovalConfig{Threshold: 2}
+	assert.NoError(t, json.Unmarshal([]byte(`[{"msp_id":"Org1MSP","address":"9B5826263C1E499CFC4C12DB8EE98AC1F7584117"},
+		{"msp_id":"Org2MSP","address":"9b5826263c1e499cfc4c12db8ee98ac1f7584117"}]`), &ac.Approvers))
+	assert.NoError(t, ac.validate())
+	assert.True(t, ac.isApprover("Org1MSP/9b5826263c1e499cfc4c12db8ee98ac1f7584117"))
+	assert.False(t, ac.isApprover("Org3MSP/9b5826263c1e499cfc4c12db8ee98ac1f7584117"))
+
+	ac.Threshold = 3
+	assert.Error(t, ac.validate())
+	// approvers of one MSP count once
+	ac.Approvers = append(ac.Approvers, &Approver{MspId: "Org2MSP", Address: "344cfc3b8635f72f14200aaf2168d9f75df86fd3"})
+	assert.Error(t, ac.validate())
+	ac.Approvers = ac.Approvers[:2]
+	ac.Threshold = 1
+	ac.Approvers = append(ac.Approvers, &Approver{MspId: "Org1MSP", Address: "9b5826263c1e499cfc4c12db8ee98ac1f7584117"})
+	assert.Error(t, ac.validate())
+
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	need, err := needApproval(mock, "peth", big.NewInt(1000))
+	assert.NoError(t, err)
+	assert.False(t, need)
+	assert.NoError(t, putBigInt(mock, getApprovalThresholdKey("peth"), big.NewInt(1000)))
+	need, err = needApproval(mock, "peth", big.NewInt(1000))
+	assert.NoError(t, err)
+	assert.True(t, need)
+	need, err = needApproval(mock, "peth", big.NewInt(999))
+	assert.NoError(t, err)
+	assert.False(t, need)
+}
+
+func TestPayOut_denied(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	to := []byte{1, 2, 3}
+	held, err := payOut(mock, "peth", []byte{9}, nil, to, to, big.NewInt(100))
+	assert.NoError(t, err)
+	assert.False(t, held)
+
+	assert.NoError(t, mock.PutState(getDeniedKey(to), []byte{1}))
+	assert.Error(t, checkScreening(mock, &lockParam{From: []byte{4}, ToAddress: to}))
+	held, err = payOut(mock, "peth", []byte{9}, nil, to, to, big.NewInt(100))
+	assert.NoError(t, err)
+	assert.True(t, held)
+	assert.Error(t, addHeld(mock, "peth", to, big.NewInt(-101)))
+	assert.NoError(t, addHeld(mock, "peth", to, big.NewInt(-100)))
+	assert.Empty(t, mock.Mem[getHeldKey("peth", to)])
+
+	// funds from a denied source sender are held for the receiver
+	other := []byte{5}
+	held, err = payOut(mock, "peth", []byte{9}, to, other, other, big.NewInt(100))
+	assert.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, big.NewInt(100).Bytes(), mock.Mem[getHeldKey("peth", other)])
+}
+
+func TestAllowanceAdapter(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	param := &lockParam{Token: "peth", From: []byte{1}, Spender: []byte{2}, Amount: big.NewInt(100)}
+	amt, err := (&allowanceAdapter{inner: &burnMintAdapter{}}).Lock(mock, param, []byte{9})
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewInt(100), amt)
+	assert.Equal(t, []byte{1}, param.From)
+
+	_, err = (&allowanceAdapter{inner: &utxoAdapter{}}).Lock(mock, param, []byte{9})
+	assert.Error(t, err)
+}
+
+func TestTxArgs_Memo(t *testing.T) {
+	args := &TxArgs{
+		ToAssetHash: []byte("peth"),
+		ToAddress:   []byte{1, 2, 3},
+		Amount:      big.NewInt(1000),
+		Memo:        []byte("invoice-42"),
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	decoded := &TxArgs{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, decoded)
+
+	args.CallData = []byte{4, 5}
+	sink = pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	decoded = &TxArgs{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, decoded)
+
+	// the sender comes last, the fields before are written even if empty
+	args = &TxArgs{ToAssetHash: []byte("peth"), ToAddress: []byte{1, 2, 3}, Amount: big.NewInt(1000), FromAddress: []byte{6}}
+	sink = pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	decoded = &TxArgs{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, decoded)
+
+	_, err := parseMemo(make([]byte, MaxMemoLen+1))
+	assert.Error(t, err)
+	_, err = parseMemo([]byte{0xff})
+	assert.Error(t, err)
+}
+
+func TestBatchTxArgs(t *testing.T) {
+	args := &BatchTxArgs{
+		ToAssetHash: []byte("peth"),
+		ToAddresses: [][]byte{{1, 2, 3}, {4, 5, 6}},
+		Amounts:     []*big.Int{big.NewInt(100), big.NewInt(200)},
+	}
+	for _, codec := range []TxArgsCodec{fixed32Codec{}, neoVMCodec{}} {
+		sink := pcommon.NewZeroCopySink(nil)
+		assert.NoError(t, args.serialize(sink, codec))
+		decoded := &BatchTxArgs{}
+		assert.NoError(t, decoded.deserialize(pcommon.NewZeroCopySource(sink.Bytes()), codec))
+		assert.Equal(t, args, decoded)
+	}
+
+	sink := pcommon.NewZeroCopySink(nil)
+	assert.NoError(t, (&BatchTxArgs{ToAssetHash: []byte("peth")}).serialize(sink, fixed32Codec{}))
+	assert.Error(t, (&BatchTxArgs{}).deserialize(pcommon.NewZeroCopySource(sink.Bytes()), fixed32Codec{}))
+}
+
+func TestEmergencyOp(t *testing.T) {
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	op := &EmergencyOp{
+		Id:           "tx1",
+		Kind:         EmergencyMigrate,
+		Token:        "peth",
+		Successor:    "lockproxy2",
+		Amount:       big.NewInt(100),
+		ExecutableAt: DefaultEmergencyDelay,
+		Status:       EmergencyStatusScheduled,
+	}
+	resp := putEmergencyOp(mock, op, EmergencyScheduled)
+	assert.Equal(t, true, shim.OK == resp.Status, "wrong result")
+	saved, err := getEmergencyOp(mock, "tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, op, saved)
+	_, err = getEmergencyOp(mock, "tx2")
+	assert.Error(t, err)
+}
+
+func TestTrustedCCMs(t *testing.T) {
+	old := &utils.TrustedCCM{Name: "ccm1", ExpiresAt: 100}
+	assert.Equal(t, true, old.Active(99))
+	assert.Equal(t, false, old.Active(100))
+	next := &utils.TrustedCCM{Name: "ccm2", ActiveFrom: 50}
+	assert.Equal(t, false, next.Active(49))
+	assert.Equal(t, true, next.Active(1<<40))
+
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	list := utils.SetTrustedCCM(utils.SetTrustedCCM(nil, old), next)
+	kept, err := utils.PutTrustedCCMs(mock, TrustedCCMsKey, list, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []*utils.TrustedCCM{next}, kept)
+	saved, err := utils.GetTrustedCCMs(mock, TrustedCCMsKey)
+	assert.NoError(t, err)
+	assert.Equal(t, kept, saved)
+	assert.Equal(t, 0, len(utils.RemoveTrustedCCM(saved, "ccm2")))
+}
+
+func TestAssetRegistration(t *testing.T) {
+	meta := &AssetMetadata{Token: []byte("peth"), Name: []byte("polyEth"), Symbol: []byte("pEth"), Decimals: 18}
+	sink := pcommon.NewZeroCopySink(nil)
+	meta.Serialization(sink)
+	decodedMeta := &AssetMetadata{}
+	assert.NoError(t, decodedMeta.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, meta, decodedMeta)
+
+	args := &AssetRegisteredArgs{Token: []byte("peth"), AssetHash: []byte{1, 2, 3}, Decimals: 8}
+	sink = pcommon.NewZeroCopySink(nil)
+	args.Serialization(sink)
+	decoded := &AssetRegisteredArgs{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, decoded)
+	assert.Error(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes()[:len(sink.Bytes())-1])))
+
+	mock := &utils.CCStubMock{Mem: make(map[string][]byte)}
+	reg := &AssetRegistration{Token: "peth", ChainId: 2, Name: "polyEth", Decimals: 18, Status: RegistrationPending}
+	_, err := putAssetRegistration(mock, reg)
+	assert.NoError(t, err)
+	saved, err := getAssetRegistration(mock, 2, "peth")
+	assert.NoError(t, err)
+	assert.Equal(t, reg, saved)
+	_, err = getAssetRegistration(mock, 3, "peth")
+	assert.Error(t, err)
+}
+
+const (
+	testCCMName   = "ccm"
+	testProxyName = "lockproxy"
+	testChainId   = 2
+)
+
+var testRemoteProxy = []byte("remote_proxy")
+
+// testCCM stands in for ccm without proofs: crossChain returns the MakeTxParam
+// like ccm and verifyHeaderAndExecuteTx delivers the ToMerkleValue the proof starts with.
+// legacy delivers the hex args only like a ccm not upgraded yet.
+type testCCM struct {
+	legacy bool
+}
+
+func (ccm *testCCM) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (ccm *testCCM) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	fn, args := stub.GetFunctionAndParameters()
+	switch fn {
+	case "crossChain":
+		payload, err := hex.DecodeString(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		caller, err := utils.GetCallingChainCodeName(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		sink := pcommon.NewZeroCopySink(nil)
+		(&pcom.MakeTxParam{
+			TxHash:              []byte(stub.GetTxID()),
+			CrossChainID:        []byte(stub.GetTxID()),
+			FromContractAddress: []byte(caller),
+			ToChainID:           testChainId,
+			ToContractAddress:   hexBytes(args[1]),
+			Method:              args[2],
+			Args:                payload,
+		}).Serialization(sink)
+		return shim.Success(sink.Bytes())
+	case "verifyHeaderAndExecuteTx":
+		val, err := utils.GetVerifiedMerkleValue(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		invokeArgs := [][]byte{[]byte(val.MakeTxParam.Method), []byte(hex.EncodeToString(val.MakeTxParam.Args))}
+		if !ccm.legacy {
+			invokeArgs = append(invokeArgs, []byte(hex.EncodeToString(val.MakeTxParam.FromContractAddress)),
+				[]byte(strconv.FormatUint(val.FromChainID, 10)), []byte(hex.EncodeToString(val.MakeTxParam.CrossChainID)))
+		}
+		return stub.InvokeChaincode(string(val.MakeTxParam.ToContractAddress), invokeArgs, "")
+	}
+	return shim.Error(fmt.Sprintf("no function name %s found", fn))
+}
+
+// testToken is a token not written against proxyTransfer. pull lets the
+// lockproxy move funds of the tx sender, transferTokens spends outputs of the
+// tx sender by id and proxyTransfer pays from the lockproxy address.
+type testToken struct{}
+
+func (tt *testToken) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (tt *testToken) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	fn, args := stub.GetFunctionAndParameters()
+	switch fn {
+	case "mintOutput":
+		val, _ := big.NewInt(0).SetString(args[2], 10)
+		if err := stub.PutState("out-"+args[0], append(hexBytes(args[1]), val.Bytes()...)); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "mint":
+		amt, _ := big.NewInt(0).SetString(args[1], 10)
+		return tt.move(stub, nil, hexBytes(args[0]), amt)
+	case "balanceOf":
+		return shim.Success(tt.balance(stub, hexBytes(args[0])).Bytes())
+	case "pull":
+		if err := tt.checkSender(stub, hexBytes(args[0])); err != nil {
+			return shim.Error(err.Error())
+		}
+		amt, _ := big.NewInt(0).SetString(args[2], 10)
+		return tt.move(stub, hexBytes(args[0]), hexBytes(args[1]), amt)
+	case "transferTokens":
+		sender, err := utils.GetMsgSenderAddress(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		total := big.NewInt(0)
+		for _, id := range args[1:] {
+			raw, _ := stub.GetState("out-" + id)
+			if len(raw) < 20 || !bytes.Equal(raw[:20], sender.Bytes()) {
+				return shim.Error(fmt.Sprintf("output %s is not spendable by the sender", id))
+			}
+			total.Add(total, big.NewInt(0).SetBytes(raw[20:]))
+			if err := stub.DelState("out-" + id); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		if resp := tt.move(stub, nil, hexBytes(args[0]), total); resp.Status != shim.OK {
+			return resp
+		}
+		return shim.Success([]byte(total.String()))
+	case ProxyTransfer:
+		caller, err := testCallingProxy(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if caller != testProxyName {
+			return shim.Error(fmt.Sprintf("%s is not the proxy", caller))
+		}
+		return tt.move(stub, stub.GetArgs()[1], stub.GetArgs()[2], big.NewInt(0).SetBytes(stub.GetArgs()[3]))
+	}
+	return shim.Error(fmt.Sprintf("no function name %s found", fn))
+}
+
+// checkSender lets the proxy called by the owner of from move the funds.
+func (tt *testToken) checkSender(stub shim.ChaincodeStubInterface, from []byte) error {
+	caller, err := testCallingProxy(stub)
+	if err != nil {
+		return err
+	}
+	sender, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return err
+	}
+	if caller != testProxyName || !bytes.Equal(sender.Bytes(), from) {
+		return fmt.Errorf("%x can't be spent by %s for %x", from, caller, sender.Bytes())
+	}
+	return nil
+}
+
+func (tt *testToken) balance(stub shim.ChaincodeStubInterface, acc []byte) *big.Int {
+	raw, _ := stub.GetState("bal-" + hex.EncodeToString(acc))
+	return big.NewInt(0).SetBytes(raw)
+}
+
+func (tt *testToken) move(stub shim.ChaincodeStubInterface, from, to []byte, amt *big.Int) pb.Response {
+	if from != nil {
+		left := big.NewInt(0).Sub(tt.balance(stub, from), amt)
+		if left.Sign() < 0 {
+			return shim.Error("balance not enough")
+		}
+		if err := putBigInt(stub, "bal-"+hex.EncodeToString(from), left); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if err := putBigInt(stub, "bal-"+hex.EncodeToString(to), big.NewInt(0).Add(tt.balance(stub, to), amt)); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// testCallingProxy finds the proxy calling like assets: the target of the
+// message when ccm is the top-level chaincode.
+func testCallingProxy(stub shim.ChaincodeStubInterface) (string, error) {
+	caller, err := utils.GetCallingChainCodeName(stub)
+	if err != nil || caller != testCCMName {
+		return caller, err
+	}
+	val, err := utils.GetVerifiedMerkleValue(stub)
+	if err != nil {
+		return "", err
+	}
+	return string(val.MakeTxParam.ToContractAddress), nil
+}
+
+func hexBytes(s string) []byte {
+	raw, _ := hex.DecodeString(s)
+	return raw
+}
+
+// testNet is a channel with ccm, the lockproxy bound to chain testChainId and
+// the token peth which alice holds 10000 of.
+type testNet struct {
+	*utils.MockNet
+	t       *testing.T
+	owner   *utils.MockUser
+	alice   *utils.MockUser
+	relayer *utils.MockUser
+	lpAddr  []byte
+	nonce   uint64
+}
+
+func newTestNet(t *testing.T) *testNet {
+	tn := &testNet{MockNet: utils.NewMockNet(), t: t}
+	tn.owner = tn.newUser("Org1MSP", nil)
+	tn.alice = tn.newUser("Org1MSP", nil)
+	tn.relayer = tn.newUser("Org2MSP", nil)
+	tn.mustOK(tn.Deploy(testCCMName, &testCCM{}, tn.owner))
+	tn.mustOK(tn.Deploy(testProxyName, &LockProxy{}, tn.owner))
+	tn.lpAddr = tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLockProxyAddr")).Payload
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setManager", testCCMName))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "bindProxyHash", strconv.Itoa(testChainId), hex.EncodeToString(testRemoteProxy)))
+
+	tn.mustOK(tn.Deploy("peth", &assets.ERC20TokenImpl{}, tn.owner, "polyEth", "pEth", "18", "1000000", testCCMName))
+	tn.mustOK(tn.Invoke("peth", tn.owner, "setLockProxyChainCode", testProxyName, hex.EncodeToString(tn.lpAddr)))
+	tn.mustOK(tn.Invoke("peth", tn.owner, "transfer", tn.hexAddr(tn.alice), "10000"))
+	tn.bindAsset("peth")
+	return tn
+}
+
+func (tn *testNet) newUser(mspId string, attrs map[string]string) *utils.MockUser {
+	user, err := utils.NewMockUser(mspId, attrs)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return user
+}
+
+func (tn *testNet) hexAddr(user *utils.MockUser) string {
+	return hex.EncodeToString(user.Addr.Bytes())
+}
+
+func (tn *testNet) bindAsset(token string) {
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "bindAssetHash", token, strconv.Itoa(testChainId),
+		hex.EncodeToString([]byte("remote_"+token))))
+}
+
+func (tn *testNet) mustOK(resp pb.Response) pb.Response {
+	tn.t.Helper()
+	if resp.Status != shim.OK {
+		tn.t.Fatalf("unexpected error: %s", resp.Message)
+	}
+	return resp
+}
+
+func (tn *testNet) balanceOf(token string, acc []byte) string {
+	tn.t.Helper()
+	raw := tn.mustOK(tn.Invoke(token, tn.owner, "balanceOf", hex.EncodeToString(acc))).Payload
+	return big.NewInt(0).SetBytes(raw).String()
+}
+
+// sentParam decodes the last message sent to chain testChainId and the json
+// event appended to it, nil if none.
+func (tn *testNet) sentParam() (*pcom.MakeTxParam, []byte) {
+	tn.t.Helper()
+	if tn.Event == nil || tn.Event.EventName != FromCCM {
+		tn.t.Fatalf("no message sent")
+	}
+	source := pcommon.NewZeroCopySource(tn.Event.Payload)
+	param := &pcom.MakeTxParam{}
+	assert.NoError(tn.t, param.Deserialization(source))
+	event, _ := source.NextVarBytes()
+	return param, event
+}
+
+func (tn *testNet) sentArgs() *TxArgs {
+	tn.t.Helper()
+	param, _ := tn.sentParam()
+	args := &TxArgs{}
+	assert.NoError(tn.t, args.Deserialization(pcommon.NewZeroCopySource(param.Args)))
+	return args
+}
+
+// deliver relays a message from the remote proxy calling method of the lockproxy.
+func (tn *testNet) deliver(method string, args []byte) pb.Response {
+	tn.nonce++
+	txHash := sha256.Sum256([]byte(fmt.Sprintf("remote tx %d", tn.nonce)))
+	val := &pcom.ToMerkleValue{
+		TxHash:      txHash[:],
+		FromChainID: testChainId,
+		MakeTxParam: &pcom.MakeTxParam{
+			TxHash:              txHash[:],
+			CrossChainID:        txHash[:],
+			FromContractAddress: testRemoteProxy,
+			ToChainID:           7,
+			ToContractAddress:   []byte(testProxyName),
+			Method:              method,
+			Args:                args,
+		},
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	val.Serialization(sink)
+	proof := pcommon.NewZeroCopySink(nil)
+	proof.WriteVarBytes(sink.Bytes())
+	return tn.Invoke(testCCMName, tn.relayer, "verifyHeaderAndExecuteTx", hex.EncodeToString(proof.Bytes()), "", "", "")
+}
+
+// deliverUnlock relays an unlock of amt of token to the receiver.
+func (tn *testNet) deliverUnlock(token string, to []byte, amt int64) pb.Response {
+	sink := pcommon.NewZeroCopySink(nil)
+	(&TxArgs{ToAssetHash: []byte(token), ToAddress: to, Amount: big.NewInt(amt)}).Serialization(sink)
+	return tn.deliver("unlock", sink.Bytes())
+}
+
+func TestAdapters_lockAndUnlock(t *testing.T) {
+	tn := newTestNet(t)
+	bob := tn.newUser("Org1MSP", nil)
+	to := hex.EncodeToString(bob.Addr.Bytes())
+
+	// proxyTransfer, the default of assets
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", strconv.Itoa(testChainId), to, "1000"))
+	assert.Equal(t, big.NewInt(1000), tn.sentArgs().Amount)
+	assert.Equal(t, "1000", tn.balanceOf("peth", tn.lpAddr))
+	tn.mustOK(tn.deliverUnlock("peth", bob.Addr.Bytes(), 400))
+	assert.Equal(t, "400", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "600", tn.balanceOf("peth", tn.lpAddr))
+
+	// burnMint on assets made minter
+	tn.mustOK(tn.Invoke("peth", tn.owner, "setMinter", testProxyName))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setAdapter", "peth", AdapterBurnMint))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", strconv.Itoa(testChainId), to, "1000"))
+	assert.Equal(t, "8000", tn.balanceOf("peth", tn.alice.Addr.Bytes()))
+	assert.Equal(t, "600", tn.balanceOf("peth", tn.lpAddr))
+	tn.mustOK(tn.deliverUnlock("peth", bob.Addr.Bytes(), 1000))
+	assert.Equal(t, "1400", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "600", tn.balanceOf("peth", tn.lpAddr))
+
+	// transferFrom and utxo release from lpAddr by proxyTransfer
+	tn.mustOK(tn.Deploy("tt", &testToken{}, tn.owner))
+	tn.bindAsset("tt")
+	tn.mustOK(tn.Invoke("tt", tn.owner, "mint", tn.hexAddr(tn.alice), "1000"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setAdapter", "tt", AdapterTransferFrom, "pull"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "tt", strconv.Itoa(testChainId), to, "300"))
+	assert.Equal(t, "300", tn.balanceOf("tt", tn.lpAddr))
+	tn.mustOK(tn.deliverUnlock("tt", bob.Addr.Bytes(), 200))
+	assert.Equal(t, "200", tn.balanceOf("tt", bob.Addr.Bytes()))
+	assert.Equal(t, "100", tn.balanceOf("tt", tn.lpAddr))
+
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setAdapter", "tt", AdapterUTXO))
+	tn.mustOK(tn.Invoke("tt", tn.owner, "mintOutput", "u1", tn.hexAddr(tn.alice), "50"))
+	tn.mustOK(tn.Invoke("tt", tn.owner, "mintOutput", "u2", tn.hexAddr(tn.alice), "70"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lockTokens", "tt", strconv.Itoa(testChainId), to, "u1,u2"))
+	assert.Equal(t, big.NewInt(120), tn.sentArgs().Amount)
+	assert.Equal(t, "220", tn.balanceOf("tt", tn.lpAddr))
+	tn.mustOK(tn.deliverUnlock("tt", bob.Addr.Bytes(), 220))
+	assert.Equal(t, "420", tn.balanceOf("tt", bob.Addr.Bytes()))
+	assert.Equal(t, "0", tn.balanceOf("tt", tn.lpAddr))
+
+	// nothing is released over what was locked from the chain
+	assert.NotEqual(t, int32(shim.OK), tn.deliverUnlock("tt", bob.Addr.Bytes(), 1).Status)
+}
+
+func TestLockFrom(t *testing.T) {
+	tn := newTestNet(t)
+	custodian := tn.newUser("Org2MSP", nil)
+	to := hex.EncodeToString(custodian.Addr.Bytes())
+	lockFrom := func() pb.Response {
+		return tn.Invoke(testProxyName, custodian, "lockFrom", "peth", tn.hexAddr(tn.alice), strconv.Itoa(testChainId), to, "300")
+	}
+
+	// an allowance given to the caller is not spent by the lockproxy
+	tn.mustOK(tn.Invoke("peth", tn.alice, "approve", hex.EncodeToString(custodian.Addr.Bytes()), "1000"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "setOperator", hex.EncodeToString(custodian.Addr.Bytes()), "true"))
+	assert.NotEqual(t, int32(shim.OK), lockFrom().Status)
+
+	tn.mustOK(tn.Invoke("peth", tn.alice, "approve", hex.EncodeToString(tn.lpAddr), "500"))
+	resp := tn.mustOK(lockFrom())
+	event := &LockEvent{}
+	assert.NoError(t, json.Unmarshal(resp.Payload, event))
+	assert.Equal(t, tn.hexAddr(tn.alice), event.FromAddress)
+	assert.Equal(t, hex.EncodeToString(custodian.Addr.Bytes()), event.Spender)
+	assert.Equal(t, "9700", tn.balanceOf("peth", tn.alice.Addr.Bytes()))
+	assert.Equal(t, "300", tn.balanceOf("peth", tn.lpAddr))
+	assert.NotEqual(t, int32(shim.OK), lockFrom().Status, "allowance of 200 left")
+
+	// only operators of the holder can spend the allowance
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "setOperator", hex.EncodeToString(custodian.Addr.Bytes()), "false"))
+	tn.mustOK(tn.Invoke("peth", tn.alice, "approve", hex.EncodeToString(tn.lpAddr), "500"))
+	assert.NotEqual(t, int32(shim.OK), lockFrom().Status)
+	assert.Equal(t, "false", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "isOperator",
+		tn.hexAddr(tn.alice), hex.EncodeToString(custodian.Addr.Bytes()))).Payload))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lockFrom", "peth", tn.hexAddr(tn.alice), strconv.Itoa(testChainId), to, "500"))
+	assert.Equal(t, "800", tn.balanceOf("peth", tn.lpAddr))
+}
+
+func TestBatch_flushAndUnlock(t *testing.T) {
+	tn := newTestNet(t)
+	bob := tn.newUser("Org1MSP", nil)
+	to := hex.EncodeToString(bob.Addr.Bytes())
+	chainId := strconv.Itoa(testChainId)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setBatchSize", "peth", chainId, "2"))
+
+	resp := tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "100"))
+	event := &LockEvent{}
+	assert.NoError(t, json.Unmarshal(resp.Payload, event))
+	assert.Empty(t, event.CrossChainId)
+	assert.Equal(t, EventLock, tn.Event.EventName)
+	assert.Equal(t, resp.Payload, tn.Event.Payload)
+	firstId := tn.Event.TxId
+
+	// a memo is not carried by batches so the lock goes alone
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "200", "invoice-42"))
+	assert.Equal(t, []byte("invoice-42"), tn.sentArgs().Memo)
+
+	// the lock filling the batch sends it
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "flushBatch", "peth", chainId).Status)
+	resp = tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "300"))
+	param, sentEvent := tn.sentParam()
+	assert.Equal(t, "unlockBatch", param.Method)
+	assert.Equal(t, resp.Payload, sentEvent)
+	batch := &BatchTxArgs{}
+	assert.NoError(t, batch.deserialize(pcommon.NewZeroCopySource(param.Args), fixed32Codec{}))
+	assert.Equal(t, []*big.Int{big.NewInt(100), big.NewInt(300)}, batch.Amounts)
+	batchId := tn.Event.TxId
+	assert.NoError(t, json.Unmarshal(resp.Payload, event))
+	assert.Equal(t, batchId, event.CrossChainId)
+	ids := []string{firstId, batchId}
+	for _, id := range ids {
+		rec := &LockRecord{}
+		assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLock", id)).Payload, rec))
+		assert.Equal(t, batchId, rec.BatchId)
+	}
+	assert.Equal(t, "[]", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getBatch", "peth", chainId)).Payload))
+
+	// a failed batch is refunded lock by lock
+	ackSink := pcommon.NewZeroCopySink(nil)
+	(&AckArgs{CrossChainId: hexBytes(batchId), Success: false}).Serialization(ackSink)
+	tn.mustOK(tn.deliver("ack", ackSink.Bytes()))
+	for _, id := range ids {
+		tn.mustOK(tn.Invoke(testProxyName, bob, "refund", id))
+	}
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "refund", ids[0]).Status)
+	assert.Equal(t, "9800", tn.balanceOf("peth", tn.alice.Addr.Bytes()))
+	assert.Equal(t, "200", tn.balanceOf("peth", tn.lpAddr))
+
+	// the owner flushes what is left at any time
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "50"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "flushBatch", "peth", chainId))
+	assert.Equal(t, "250", tn.balanceOf("peth", tn.lpAddr))
+
+	sink := pcommon.NewZeroCopySink(nil)
+	assert.NoError(t, (&BatchTxArgs{
+		ToAssetHash: []byte("peth"),
+		ToAddresses: [][]byte{bob.Addr.Bytes(), tn.alice.Addr.Bytes()},
+		Amounts:     []*big.Int{big.NewInt(150), big.NewInt(100)},
+	}).serialize(sink, fixed32Codec{}))
+	resp = tn.mustOK(tn.deliver("unlockBatch", sink.Bytes()))
+	var events []*UnlockEvent
+	assert.NoError(t, json.Unmarshal(resp.Payload, &events))
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "250", tn.balanceOf("peth", tn.lpAddr))
+	for _, event := range events {
+		tn.mustOK(tn.Invoke(testProxyName, bob, "executeUnlock", event.PendingId))
+	}
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "executeUnlock", events[0].PendingId).Status)
+	assert.Equal(t, "150", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "9850", tn.balanceOf("peth", tn.alice.Addr.Bytes()))
+	assert.Equal(t, "0", tn.balanceOf("peth", tn.lpAddr))
+}
+
+func TestMigrateBindings(t *testing.T) {
+	tn := newTestNet(t)
+	tn.PutState(testProxyName, getProxyBindKey(3), []byte("proxy_3"))
+	tn.PutState(testProxyName, getAssetBindKey(3, "peth"), []byte("eth_3"))
+	tn.PutState(testProxyName, getAssetBindKey(4, "peth"), []byte("eth_4"))
+	// bound again after the upgrade, the new value is kept
+	tn.PutState(testProxyName, getAssetBindKey(testChainId, "peth"), []byte("stale"))
+
+	conf := &ProxyConfig{}
+	assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getConfig")).Payload, conf))
+	assert.Equal(t, 1, len(conf.ProxyBindings))
+	assert.Equal(t, 1, len(conf.AssetBindings))
+
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "migrateBindings").Status)
+	next := ""
+	for i := 0; ; i++ {
+		next = string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "migrateBindings", next, "2")).Payload)
+		if next == "" {
+			assert.Equal(t, 1, i)
+			break
+		}
+	}
+	assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getConfig")).Payload, conf))
+	assert.Equal(t, []*ProxyBinding{
+		{ChainId: testChainId, ProxyHash: hex.EncodeToString(testRemoteProxy)},
+		{ChainId: 3, ProxyHash: hex.EncodeToString([]byte("proxy_3"))},
+	}, conf.ProxyBindings)
+	assert.Equal(t, 3, len(conf.AssetBindings))
+	hashes := make(map[uint64]string)
+	for _, b := range conf.AssetBindings {
+		hashes[b.ChainId] = b.AssetHash
+	}
+	assert.Equal(t, hex.EncodeToString([]byte("remote_peth")), hashes[testChainId])
+	assert.Equal(t, hex.EncodeToString([]byte("eth_4")), hashes[4])
+	assert.Nil(t, tn.GetState(testProxyName, getAssetBindKey(testChainId, "peth")))
+	assert.Nil(t, tn.GetState(testProxyName, getProxyBindKey(3)))
+}
+
+func TestAdjustLocked(t *testing.T) {
+	tn := newTestNet(t)
+	chainId := strconv.Itoa(testChainId)
+	bob := tn.newUser("Org1MSP", nil)
+	// locked before the upgrade, nothing recorded counts as zero
+	tn.mustOK(tn.Invoke("peth", tn.alice, "transfer", hex.EncodeToString(tn.lpAddr), "2000"))
+	assert.NotEqual(t, int32(shim.OK), tn.deliverUnlock("peth", tn.alice.Addr.Bytes(), 100).Status)
+	// a lock before the owner adjusts doesn't block it
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, tn.hexAddr(bob), "1"))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "adjustLocked", "peth", chainId, "900").Status)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "adjustLocked", "peth", chainId, "0").Status)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "adjustLocked", "peth", chainId, "-2").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "adjustLocked", "peth", chainId, "900"))
+	assert.Equal(t, LockedAdjusted, tn.Event.EventName)
+	event := &LockedAdjustedEvent{}
+	assert.NoError(t, json.Unmarshal(tn.Event.Payload, event))
+	assert.Equal(t, big.NewInt(901), event.Locked)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "adjustLocked", "peth", chainId, "-1"))
+	assert.Equal(t, "900", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+
+	assert.NotEqual(t, int32(shim.OK), tn.deliverUnlock("peth", tn.alice.Addr.Bytes(), 901).Status)
+	tn.mustOK(tn.deliverUnlock("peth", tn.alice.Addr.Bytes(), 900))
+	assert.Equal(t, "0", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+	assert.NotEqual(t, int32(shim.OK), tn.deliverUnlock("peth", tn.alice.Addr.Bytes(), 1).Status)
+}
+
+func TestApproval_approveAndExecute(t *testing.T) {
+	tn := newTestNet(t)
+	chainId := strconv.Itoa(testChainId)
+	bob := tn.newUser("Org1MSP", nil)
+	a1, a2, b1 := tn.newUser("Org1MSP", nil), tn.newUser("Org1MSP", nil), tn.newUser("Org2MSP", nil)
+	approvers, err := json.Marshal([]*Approver{
+		{MspId: a1.MspId, Address: tn.hexAddr(a1)},
+		{MspId: a2.MspId, Address: tn.hexAddr(a2)},
+		{MspId: b1.MspId, Address: tn.hexAddr(b1)},
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "setApprovers", "3", "0", string(approvers)).Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setApprovers", "2", "0", string(approvers)))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setApprovalThreshold", "peth", "500"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, tn.hexAddr(bob), "3000"))
+
+	queue := func(amt int64) string {
+		event := &UnlockEvent{}
+		assert.NoError(t, json.Unmarshal(tn.mustOK(tn.deliverUnlock("peth", bob.Addr.Bytes(), amt)).Payload, event))
+		assert.NotEmpty(t, event.PendingId)
+		return event.PendingId
+	}
+	// under the threshold, released at once
+	tn.mustOK(tn.deliverUnlock("peth", bob.Addr.Bytes(), 100))
+	assert.Equal(t, "100", tn.balanceOf("peth", bob.Addr.Bytes()))
+
+	id := queue(600)
+	assert.Equal(t, "2300", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "approveUnlock", id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, a1, "approveUnlock", id))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, a1, "approveUnlock", id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, a2, "approveUnlock", id))
+	// two approvers of Org1MSP are one MSP
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "executeUnlock", id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, b1, "approveUnlock", id))
+	tn.mustOK(tn.Invoke(testProxyName, bob, "executeUnlock", id))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "executeUnlock", id).Status)
+	assert.Equal(t, "700", tn.balanceOf("peth", bob.Addr.Bytes()))
+
+	// a vetoed unlock waits for owner, who queues it again
+	id = queue(700)
+	tn.mustOK(tn.Invoke(testProxyName, a1, "approveUnlock", id))
+	tn.mustOK(tn.Invoke(testProxyName, b1, "vetoUnlock", id))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "executeUnlock", id).Status)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, a1, "resolveUnlock", id, ResolveRequeue).Status)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "resolveUnlock", id, "unknown").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "resolveUnlock", id, ResolveRequeue))
+	assert.Equal(t, UnlockRequeued, tn.Event.EventName)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "resolveUnlock", id, ResolveCancel).Status)
+	tn.mustOK(tn.Invoke(testProxyName, a1, "approveUnlock", id))
+	// approvals before the veto are dropped
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "executeUnlock", id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, b1, "approveUnlock", id))
+	tn.mustOK(tn.Invoke(testProxyName, bob, "executeUnlock", id))
+	assert.Equal(t, "1400", tn.balanceOf("peth", bob.Addr.Bytes()))
+
+	// or cancels it, giving the liquidity back
+	id = queue(800)
+	assert.Equal(t, "800", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+	tn.mustOK(tn.Invoke(testProxyName, a2, "vetoUnlock", id))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "resolveUnlock", id, ResolveCancel))
+	assert.Equal(t, "1600", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, bob, "executeUnlock", id).Status)
+	page := &PendingUnlockPage{}
+	assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "listPendingUnlocks",
+		PendingStatusCancelled)).Payload, page))
+	assert.Equal(t, 1, len(page.Records))
+	assert.Equal(t, id, page.Records[0].Id)
+	assert.Equal(t, "1400", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "1600", tn.balanceOf("peth", tn.lpAddr))
+}
+
+func TestEmergency_delayAndWithdraw(t *testing.T) {
+	tn := newTestNet(t)
+	chainId := strconv.Itoa(testChainId)
+	bob := tn.newUser("Org1MSP", nil)
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, tn.hexAddr(bob), "1000"))
+	schedule := func(amt string) *EmergencyOp {
+		op := &EmergencyOp{}
+		raw := tn.mustOK(tn.Invoke(testProxyName, tn.owner, "scheduleEmergencyWithdraw", "peth", tn.hexAddr(bob), amt, chainId)).Payload
+		assert.NoError(t, json.Unmarshal(raw, op))
+		return op
+	}
+
+	// a shorter delay waits for the current one
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "setEmergencyDelay", "7200").Status)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "setEmergencyDelay", "60").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setEmergencyDelay", "7200"))
+	assert.Equal(t, EmergencyDelayChanged, tn.Event.EventName)
+	ed := &EmergencyDelay{}
+	assert.NoError(t, json.Unmarshal(tn.Event.Payload, ed))
+	assert.Equal(t, &EmergencyDelay{Delay: 7200, Previous: DefaultEmergencyDelay, EffectiveAt: tn.Time + DefaultEmergencyDelay}, ed)
+	op := schedule("300")
+	assert.Equal(t, tn.Time+DefaultEmergencyDelay, op.ExecutableAt)
+
+	tn.Time += DefaultEmergencyDelay - 1
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "executeEmergency", op.Id).Status)
+	tn.Time++
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "executeEmergency", op.Id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "executeEmergency", op.Id))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "executeEmergency", op.Id).Status)
+	assert.Equal(t, "300", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "700", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+
+	// in force now, and a longer one at once
+	op = schedule("100")
+	assert.Equal(t, tn.Time+7200, op.ExecutableAt)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "cancelEmergency", op.Id))
+	tn.Time += 7200
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "executeEmergency", op.Id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setEmergencyDelay", "86400"))
+	assert.Equal(t, tn.Time+86400, schedule("100").ExecutableAt)
+	assert.Equal(t, "700", tn.balanceOf("peth", tn.lpAddr))
+
+	// stored as decimal seconds before
+	tn.PutState(testProxyName, EmergencyDelayKey, []byte("3600"))
+	assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getEmergencyDelay")).Payload, ed))
+	assert.Equal(t, &EmergencyDelay{Delay: 3600, Previous: 3600}, ed)
+	assert.Equal(t, tn.Time+3600, schedule("100").ExecutableAt)
+
+	// the locked total of a chain always goes down with the pool
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "scheduleEmergencyWithdraw", "peth", tn.hexAddr(bob), "100").Status)
+	op = schedule("701")
+	noChain := schedule("100")
+	noChain.ChainId = 0
+	raw, _ := json.Marshal(noChain)
+	tn.PutState(testProxyName, getEmergencyOpKey(noChain.Id), raw)
+	tn.Time += 3600
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "executeEmergency", op.Id).Status)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "executeEmergency", noChain.Id).Status)
+	assert.Equal(t, "700", tn.balanceOf("peth", tn.lpAddr))
+	assert.Equal(t, "700", string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", "peth", chainId)).Payload))
+}
+
+// lockEvent locks amt of token from user to testChainId and returns the LockEvent,
+// which is emitted after the message in from_ccm.
+func (tn *testNet) lockEvent(user *utils.MockUser, token, to, amt string) *LockEvent {
+	tn.t.Helper()
+	event := &LockEvent{}
+	raw := tn.mustOK(tn.Invoke(testProxyName, user, "lock", token, strconv.Itoa(testChainId), to, amt)).Payload
+	_, sent := tn.sentParam()
+	assert.Equal(tn.t, raw, sent)
+	assert.NoError(tn.t, json.Unmarshal(sent, event))
+	return event
+}
+
+func (tn *testNet) locked(token string) string {
+	tn.t.Helper()
+	return string(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLocked", token, strconv.Itoa(testChainId))).Payload)
+}
+
+func (tn *testNet) invariant(token string) *LockedInvariant {
+	tn.t.Helper()
+	inv := &LockedInvariant{}
+	assert.NoError(tn.t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "checkLockedInvariant", token)).Payload, inv))
+	return inv
+}
+
+func TestLock_fee(t *testing.T) {
+	tn := newTestNet(t)
+	chainId := strconv.Itoa(testChainId)
+	bob := tn.newUser("Org1MSP", nil)
+	to := tn.hexAddr(bob)
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "setFee", "peth", chainId, "flat", "10").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setFee", "peth", chainId, "flat", "10"))
+
+	event := tn.lockEvent(tn.alice, "peth", to, "1000")
+	assert.Equal(t, "990", event.Amount)
+	assert.Equal(t, "10", event.Fee)
+	assert.Equal(t, big.NewInt(990), tn.sentArgs().Amount)
+	rec := &LockRecord{}
+	assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLock", event.CrossChainId)).Payload, rec))
+	assert.Equal(t, big.NewInt(990), rec.Amount)
+	assert.Equal(t, big.NewInt(10), rec.Fee)
+	// the fee stays at lpAddr, apart from the locked liquidity
+	assert.Equal(t, "990", tn.locked("peth"))
+	inv := tn.invariant("peth")
+	assert.True(t, inv.Holds)
+	assert.Equal(t, big.NewInt(10), inv.AccruedFee)
+	assert.Equal(t, big.NewInt(1000), inv.Balance)
+
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setFee", "peth", chainId, "none", ""))
+	event = tn.lockEvent(tn.alice, "peth", to, "500")
+	assert.Equal(t, "500", event.Amount)
+	assert.Equal(t, "0", event.Fee)
+
+	// paid out of the accrued fee only
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "withdrawFee", "peth").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setTreasury", to))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "withdrawFee", "peth", "11").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "withdrawFee", "peth"))
+	assert.Equal(t, "10", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, 0, tn.invariant("peth").AccruedFee.Sign())
+	assert.Equal(t, "1490", tn.locked("peth"))
+}
+
+func TestLock_ackAndRefund(t *testing.T) {
+	tn := newTestNet(t)
+	chainId := strconv.Itoa(testChainId)
+	bob := tn.newUser("Org1MSP", nil)
+	to := tn.hexAddr(bob)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setFee", "peth", chainId, "flat", "10"))
+	status := func(id string) string {
+		rec := &LockRecord{}
+		assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getLock", id)).Payload, rec))
+		return rec.Status
+	}
+	ack := func(id string, success bool) pb.Response {
+		sink := pcommon.NewZeroCopySink(nil)
+		(&AckArgs{CrossChainId: hexBytes(id), Success: success}).Serialization(sink)
+		return tn.deliver("ack", sink.Bytes())
+	}
+
+	// completed once
+	id := tn.lockEvent(tn.alice, "peth", to, "1000").CrossChainId
+	assert.Equal(t, LockStatusPending, status(id))
+	tn.mustOK(ack(id, true))
+	assert.Equal(t, LockStatusCompleted, status(id))
+	assert.NotEqual(t, int32(shim.OK), ack(id, false).Status)
+	assert.NotEqual(t, int32(shim.OK), ack("00", true).Status)
+
+	// a failure reported pays the net amount back, the fee is kept
+	id = tn.lockEvent(tn.alice, "peth", to, "500").CrossChainId
+	assert.Equal(t, "1480", tn.locked("peth"))
+	tn.mustOK(ack(id, false))
+	assert.Equal(t, LockStatusRefunded, status(id))
+	assert.Equal(t, "990", tn.locked("peth"))
+	assert.Equal(t, "8990", tn.balanceOf("peth", tn.alice.Addr.Bytes()))
+
+	// refunded by owner after the timeout
+	id = tn.lockEvent(tn.alice, "peth", to, "300").CrossChainId
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "refund", id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setRefundTimeout", "3600"))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "refund", id).Status)
+	tn.Time += 3600
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "refund", id).Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "refund", id))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.owner, "refund", id).Status)
+	assert.NotEqual(t, int32(shim.OK), ack(id, true).Status)
+	assert.Equal(t, "8980", tn.balanceOf("peth", tn.alice.Addr.Bytes()))
+	assert.Equal(t, "990", tn.locked("peth"))
+
+	inv := tn.invariant("peth")
+	assert.True(t, inv.Holds)
+	assert.Equal(t, big.NewInt(30), inv.AccruedFee)
+	assert.Equal(t, big.NewInt(1020), inv.Balance)
+	assert.Equal(t, 0, inv.Surplus.Sign())
+
+	page := &LockRecordPage{}
+	assert.NoError(t, json.Unmarshal(tn.mustOK(tn.Invoke(testProxyName, tn.owner, "listLocks", tn.hexAddr(tn.alice), LockStatusRefunded)).Payload, page))
+	assert.Equal(t, 2, len(page.Records))
+}
+
+func TestLimit_accountingOrder(t *testing.T) {
+	tn := newTestNet(t)
+	chainId := strconv.Itoa(testChainId)
+	to := tn.hexAddr(tn.alice)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setFee", "peth", chainId, "flat", "10"))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "setLimit", "lock", "peth", chainId, "100", "1000", "1500").Status)
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setLimit", "lock", "peth", chainId, "100", "1000", "1500"))
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setLimit", "unlock", "peth", chainId, "0", "600", "0"))
+	state := func() []string {
+		inv := tn.invariant("peth")
+		return []string{inv.Total.String(), inv.AccruedFee.String(), inv.Balance.String(),
+			tn.balanceOf("peth", tn.alice.Addr.Bytes())}
+	}
+
+	// a lock failing on any check leaves the totals, fees and balances untouched
+	before := state()
+	for _, args := range [][]string{{chainId, "99"}, {chainId, "1001"}, {"3", "500"}, {chainId, "20000"}} {
+		assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "lock", "peth", args[0], to, args[1]).Status)
+		assert.Equal(t, before, state())
+	}
+
+	// the limit is checked on the amount locked, fee included
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "1000"))
+	assert.Equal(t, []string{"990", "10", "1000", "9000"}, state())
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "500"))
+	assert.NotEqual(t, int32(shim.OK), tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "100").Status)
+	assert.Equal(t, []string{"1480", "20", "1500", "8500"}, state())
+	// the window rolls by the hour
+	tn.Time += 24 * 3600
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", chainId, to, "100"))
+	assert.Equal(t, []string{"1570", "30", "1600", "8400"}, state())
+
+	// an unlock over the limit takes nothing from the locked liquidity
+	assert.NotEqual(t, int32(shim.OK), tn.deliverUnlock("peth", tn.alice.Addr.Bytes(), 601).Status)
+	assert.Equal(t, []string{"1570", "30", "1600", "8400"}, state())
+	tn.mustOK(tn.deliverUnlock("peth", tn.alice.Addr.Bytes(), 600))
+	assert.Equal(t, []string{"970", "30", "1000", "9000"}, state())
+}
+
+// testVault is a call target crediting deposits, it fails if asked to.
+type testVault struct{}
+
+func (tv *testVault) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (tv *testVault) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	fn, args := stub.GetFunctionAndParameters()
+	if fn != "deposit" {
+		return shim.Error(fmt.Sprintf("no function name %s found", fn))
+	}
+	if len(args) > 3 && args[3] == "fail" {
+		return shim.Error("deposit refused")
+	}
+	if err := stub.PutState("deposit-"+args[1], []byte(args[2])); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func TestCallData_fallback(t *testing.T) {
+	tn := newTestNet(t)
+	bob := tn.newUser("Org1MSP", nil)
+	vaultAddr := bytes.Repeat([]byte{7}, 20)
+	tn.mustOK(tn.Deploy("vault", &testVault{}, tn.owner))
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", strconv.Itoa(testChainId), tn.hexAddr(bob), "1000"))
+	unlock := func(args ...string) *UnlockEvent {
+		call := &FabricCall{Chaincode: "vault", Method: "deposit"}
+		for _, arg := range args {
+			call.Args = append(call.Args, []byte(arg))
+		}
+		callSink := pcommon.NewZeroCopySink(nil)
+		call.Serialization(callSink)
+		sink := pcommon.NewZeroCopySink(nil)
+		(&TxArgs{ToAssetHash: []byte("peth"), ToAddress: bob.Addr.Bytes(), Amount: big.NewInt(100),
+			CallData: callSink.Bytes()}).Serialization(sink)
+		event := &UnlockEvent{}
+		assert.NoError(t, json.Unmarshal(tn.mustOK(tn.deliver("unlock", sink.Bytes())).Payload, event))
+		return event
+	}
+
+	// a target not listed pays the receiver
+	event := unlock()
+	assert.Contains(t, event.CallFailed, "not an allowed call target")
+	assert.Equal(t, "100", tn.balanceOf("peth", bob.Addr.Bytes()))
+
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "setCallTarget", "vault", "deposit", hex.EncodeToString(vaultAddr)))
+	event = unlock()
+	assert.Empty(t, event.CallFailed)
+	assert.Equal(t, "100", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "100", tn.balanceOf("peth", vaultAddr))
+	assert.Equal(t, []byte("100"), tn.GetState("vault", "deposit-"+tn.hexAddr(bob)))
+
+	// so does a failed call
+	event = unlock("fail")
+	assert.Contains(t, event.CallFailed, "deposit refused")
+	assert.Equal(t, "200", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "100", tn.balanceOf("peth", vaultAddr))
+
+	// and a target removed after the lock
+	tn.mustOK(tn.Invoke(testProxyName, tn.owner, "removeCallTarget", "vault", "deposit"))
+	event = unlock()
+	assert.NotEmpty(t, event.CallFailed)
+	assert.Equal(t, "300", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, "600", tn.balanceOf("peth", tn.lpAddr))
+}
+
+func TestUnlock_deniedSender(t *testing.T) {
+	tn := newTestNet(t)
+	bob := tn.newUser("Org1MSP", nil)
+	officer := tn.newUser("Org1MSP", map[string]string{ComplianceAttr: "true"})
+	tn.mustOK(tn.Invoke(testProxyName, tn.alice, "lock", "peth", strconv.Itoa(testChainId), tn.hexAddr(bob), "1000"))
+	assert.Equal(t, tn.alice.Addr.Bytes(), tn.sentArgs().FromAddress)
+
+	mallory := []byte("remote_mallory")
+	tn.mustOK(tn.Invoke(testProxyName, officer, "updateDenylist", DenylistAdd, hex.EncodeToString(mallory)))
+	unlock := func(from []byte) *UnlockEvent {
+		sink := pcommon.NewZeroCopySink(nil)
+		(&TxArgs{ToAssetHash: []byte("peth"), ToAddress: bob.Addr.Bytes(), Amount: big.NewInt(100),
+			FromAddress: from}).Serialization(sink)
+		event := &UnlockEvent{}
+		assert.NoError(t, json.Unmarshal(tn.mustOK(tn.deliver("unlock", sink.Bytes())).Payload, event))
+		return event
+	}
+
+	event := unlock(mallory)
+	assert.True(t, event.Held)
+	assert.Equal(t, hex.EncodeToString(mallory), event.FromAddress)
+	assert.Equal(t, "0", tn.balanceOf("peth", bob.Addr.Bytes()))
+	assert.Equal(t, []byte("100"), tn.mustOK(tn.Invoke(testProxyName, tn.owner, "getHeld", "peth", tn.hexAddr(bob))).Payload)
+
+	event = unlock(tn.alice.Addr.Bytes())
+	assert.False(t, event.Held)
+	assert.Equal(t, "100", tn.balanceOf("peth", bob.Addr.Bytes()))
+}
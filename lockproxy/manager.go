@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	"strconv"
+)
+
+const (
+	TrustedCCMsKey = "trusted_ccms"
+	CCMChanged     = "proxy_ccm_changed"
+)
+
+type CCMChangedEvent struct {
+	Manager string              `json:"manager"`
+	Trusted []*utils.TrustedCCM `json:"trusted"`
+}
+
+// The ccm management methods below are shared with the other proxy chaincodes
+// of this repo, which keep the owner and ccm under the same keys.
+
+// SetManager sets the ccm, the old one is not trusted any more, use RotateCCM
+// to keep it for a while.
+// args: ccm
+func SetManager(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	return rotateCCM(stub, string(args[0]), 0)
+}
+
+// RotateCCM makes newCCM the manager used for sending, the old one is still
+// trusted for delivering messages in flight for grace seconds.
+// args: new ccm, grace seconds
+func RotateCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	grace, err := strconv.ParseUint(string(args[1]), 10, 63)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse grace: %v", err))
+	}
+	return rotateCCM(stub, string(args[0]), int64(grace))
+}
+
+func rotateCCM(stub shim.ChaincodeStubInterface, newCCM string, grace int64) pb.Response {
+	if newCCM == "" {
+		return shim.Error("ccm can't be empty")
+	}
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	list, err := utils.GetTrustedCCMs(stub, TrustedCCMsKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	oldCCM, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get cross chain manager name: %v", err))
+	}
+	list = utils.RemoveTrustedCCM(list, newCCM)
+	if len(oldCCM) > 0 && string(oldCCM) != newCCM && grace > 0 {
+		list = utils.SetTrustedCCM(list, &utils.TrustedCCM{Name: string(oldCCM), ExpiresAt: now + grace})
+	}
+	if err := stub.PutState(ProxyCCM, []byte(newCCM)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put cross chain manager name: %v", err))
+	}
+	return putTrustedCCMs(stub, newCCM, list, now)
+}
+
+// SetTrustedCCM trusts a ccm for delivering messages in [activeFrom, expiresAt),
+// timestamps in seconds and "0" expiresAt for no expiry.
+// args: ccm, activeFrom, expiresAt
+func SetTrustedCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	t := &utils.TrustedCCM{Name: string(args[0])}
+	var err error
+	if t.ActiveFrom, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse activeFrom: %v", err))
+	}
+	if t.ExpiresAt, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse expiresAt: %v", err))
+	}
+	if t.Name == "" || (t.ExpiresAt != 0 && t.ExpiresAt <= t.ActiveFrom) {
+		return shim.Error("ccm is required and expiresAt should be after activeFrom")
+	}
+	return updateTrustedCCMs(stub, func(list []*utils.TrustedCCM) []*utils.TrustedCCM {
+		return utils.SetTrustedCCM(list, t)
+	})
+}
+
+// args: ccm
+func RemoveTrustedCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	return updateTrustedCCMs(stub, func(list []*utils.TrustedCCM) []*utils.TrustedCCM {
+		return utils.RemoveTrustedCCM(list, string(args[0]))
+	})
+}
+
+func GetTrustedCCMs(stub shim.ChaincodeStubInterface) pb.Response {
+	list, err := utils.GetTrustedCCMs(stub, TrustedCCMsKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// isTrustedCCM tells if ccname can deliver messages, the manager or an active trusted ccm.
+func isTrustedCCM(stub shim.ChaincodeStubInterface, ccname string) (bool, error) {
+	manager, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return false, fmt.Errorf("failed to get cross chain manager name: %v", err)
+	}
+	if len(manager) > 0 && string(manager) == ccname {
+		return true, nil
+	}
+	return utils.IsTrustedCCM(stub, TrustedCCMsKey, ccname)
+}
+
+func updateTrustedCCMs(stub shim.ChaincodeStubInterface, update func([]*utils.TrustedCCM) []*utils.TrustedCCM) pb.Response {
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	list, err := utils.GetTrustedCCMs(stub, TrustedCCMsKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	manager, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get cross chain manager name: %v", err))
+	}
+	return putTrustedCCMs(stub, string(manager), update(list), now)
+}
+
+func putTrustedCCMs(stub shim.ChaincodeStubInterface, manager string, list []*utils.TrustedCCM, now int64) pb.Response {
+	list, err := utils.PutTrustedCCMs(stub, TrustedCCMsKey, list, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rawEvent, err := json.Marshal(&CCMChangedEvent{Manager: manager, Trusted: list})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(CCMChanged, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
@@ -0,0 +1,432 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcommon "github.com/polynetwork/poly/common"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+const (
+	LockRecordKey    = "lock_record-%s"
+	LockIndexType    = "lock_user"
+	RefundTimeoutKey = "refund_timeout"
+	LockRefund       = "proxy_lock_refund"
+	LockComplete     = "proxy_lock_complete"
+	LockFailed       = "proxy_lock_failed"
+
+	LockStatusPending   = "pending"
+	LockStatusCompleted = "completed"
+	LockStatusRefunded  = "refunded"
+	// LockStatusFailed is a lock of a batch failed on destination, waiting for
+	// anyone to refund it
+	LockStatusFailed = "failed"
+)
+
+// LockRecord is kept for every lock so that it can be refunded if the unlock on
+// destination never happens. Id is the fabric txid which is also the cross chain id.
+type LockRecord struct {
+	Id        string   `json:"id"`
+	Token     string   `json:"token"`
+	From      []byte   `json:"from"`
+	ChainId   uint64   `json:"chain_id"`
+	ToAddress []byte   `json:"to_address"`
+	Amount    *big.Int `json:"amount"`
+	Fee       *big.Int `json:"fee"`
+	Status    string   `json:"status"`
+	CreatedAt int64    `json:"created_at"`
+	Memo      string   `json:"memo,omitempty"`
+	// BatchId is the cross chain id of the batch the lock is sent in, empty
+	// while it waits in the batch or if it's not batched.
+	BatchId string `json:"batch_id,omitempty"`
+}
+
+// AckArgs is sent back by the destination lockproxy to tell if the unlock succeeded.
+type AckArgs struct {
+	CrossChainId []byte
+	Success      bool
+}
+
+func (args *AckArgs) Serialization(sink *pcommon.ZeroCopySink) {
+	sink.WriteVarBytes(args.CrossChainId)
+	sink.WriteBool(args.Success)
+}
+
+func (args *AckArgs) Deserialization(source *pcommon.ZeroCopySource) error {
+	id, eof := source.NextVarBytes()
+	if eof {
+		return fmt.Errorf("AckArgs.Deserialization NextVarBytes CrossChainId error:%s", io.ErrUnexpectedEOF)
+	}
+	success, eof := source.NextBool()
+	if eof {
+		return fmt.Errorf("AckArgs.Deserialization NextBool Success error:%s", io.ErrUnexpectedEOF)
+	}
+	args.CrossChainId = id
+	args.Success = success
+	return nil
+}
+
+type LockRecordPage struct {
+	Records  []*LockRecord `json:"records"`
+	Bookmark string        `json:"bookmark"`
+}
+
+type LockStatusEvent struct {
+	Id     string   `json:"id"`
+	Token  string   `json:"token"`
+	From   []byte   `json:"from"`
+	Amount *big.Int `json:"amount"`
+	Reason string   `json:"reason"`
+}
+
+// ack is called by ccm with (hex ack args, hex from contract, from chainId, [hex cross chain id]),
+// or hex ack args only from a ccm not upgraded yet.
+func (lp *LockProxy) ack(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	msg, err := ParseCCMArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := CheckFromProxy(stub, msg); err != nil {
+		return shim.Error(err.Error())
+	}
+	fromChainId := msg.FromChainId
+	ackArgs := &AckArgs{}
+	if err := ackArgs.Deserialization(pcommon.NewZeroCopySource(msg.Args)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to deserialize ack args: %v", err))
+	}
+	id := hex.EncodeToString(ackArgs.CrossChainId)
+	batchIds, err := getBatchLockIds(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if batchIds == nil {
+		rec, err := ackLock(stub, id, fromChainId, ackArgs.Success)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if ackArgs.Success {
+			return emitLockStatus(stub, LockComplete, rec, "acknowledged by destination")
+		}
+		return emitLockStatus(stub, LockRefund, rec, "failure reported by destination")
+	}
+
+	// a batch is acknowledged as a whole. Refunds of one tx would all be paid from
+	// the balance of lpAddr read before the tx, so failed locks are refunded later
+	// one by one with refund.
+	events := make([]*LockStatusEvent, 0, len(batchIds))
+	name, reason := LockComplete, "acknowledged by destination"
+	if !ackArgs.Success {
+		name, reason = LockFailed, "failure reported by destination"
+	}
+	for _, lockId := range batchIds {
+		rec, err := checkPendingLock(stub, lockId, fromChainId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		status := LockStatusCompleted
+		if !ackArgs.Success {
+			status = LockStatusFailed
+		}
+		if err := setLockStatus(stub, rec, status); err != nil {
+			return shim.Error(err.Error())
+		}
+		events = append(events, newLockStatusEvent(rec, reason))
+	}
+	rawEvent, err := json.Marshal(events)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(name, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	// ccm emits the payload since the event of a called chaincode is dropped
+	return shim.Success(rawEvent)
+}
+
+// ackLock completes or refunds the pending lock id sent to chainId.
+func ackLock(stub shim.ChaincodeStubInterface, id string, chainId uint64, success bool) (*LockRecord, error) {
+	rec, err := checkPendingLock(stub, id, chainId)
+	if err != nil {
+		return nil, err
+	}
+	if success {
+		return rec, setLockStatus(stub, rec, LockStatusCompleted)
+	}
+	return rec, refundLock(stub, rec)
+}
+
+// checkPendingLock returns the lock id if it's sent to chainId and still pending.
+func checkPendingLock(stub shim.ChaincodeStubInterface, id string, chainId uint64) (*LockRecord, error) {
+	rec, err := getLockRecord(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	if rec.ChainId != chainId {
+		return nil, fmt.Errorf("lock %s is sent to chain %d not %d", rec.Id, rec.ChainId, chainId)
+	}
+	if rec.Status != LockStatusPending {
+		return nil, fmt.Errorf("lock %s is already %s", rec.Id, rec.Status)
+	}
+	return rec, nil
+}
+
+// refund is called by owner for a lock still pending after the refund timeout,
+// or by anyone for a lock of a batch failed on destination. The amount net of
+// the fee is paid back, the fee is kept.
+func (lp *LockProxy) refund(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	rec, err := getLockRecord(stub, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rec.Status == LockStatusFailed {
+		if err := refundLock(stub, rec); err != nil {
+			return shim.Error(err.Error())
+		}
+		return emitLockStatus(stub, LockRefund, rec, "failure reported by destination")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if rec.Status != LockStatusPending {
+		return shim.Error(fmt.Sprintf("lock %s is already %s", rec.Id, rec.Status))
+	}
+	raw, err := stub.GetState(RefundTimeoutKey)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get refund timeout: %v", err))
+	}
+	if len(raw) == 0 {
+		return shim.Error("refund timeout not set")
+	}
+	timeout, _ := strconv.ParseInt(string(raw), 10, 64)
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now < rec.CreatedAt+timeout {
+		return shim.Error(fmt.Sprintf("lock %s can be refunded after %d", rec.Id, rec.CreatedAt+timeout))
+	}
+	if err := refundLock(stub, rec); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitLockStatus(stub, LockRefund, rec, "timeout")
+}
+
+func (lp *LockProxy) setRefundTimeout(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	timeout, err := strconv.ParseUint(string(args[0]), 10, 63)
+	if err != nil || timeout == 0 {
+		return shim.Error(fmt.Sprintf("wrong timeout: %s", args[0]))
+	}
+	if err := stub.PutState(RefundTimeoutKey, args[0]); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put refund timeout: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *LockProxy) getLock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	raw, err := stub.GetState(getLockRecordKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get lock: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: hex user, status, [pageSize, [bookmark]]
+func (lp *LockProxy) listLocks(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) < 2 {
+		return shim.Error("args number should be at least 2")
+	}
+	user, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex user: %v", err))
+	}
+	status := string(args[1])
+	if status != LockStatusPending && status != LockStatusCompleted && status != LockStatusRefunded &&
+		status != LockStatusFailed {
+		return shim.Error(fmt.Sprintf("unknown status %s", status))
+	}
+	pageSize, bookmark, err := utils.ParsePageArgs(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(LockIndexType,
+		[]string{hex.EncodeToString(user), status}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to query locks: %v", err))
+	}
+	defer iter.Close()
+	page := &LockRecordPage{Records: make([]*LockRecord, 0), Bookmark: meta.GetBookmark()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to iterate locks: %v", err))
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 3 {
+			return shim.Error(fmt.Sprintf("wrong lock index %s: %v", kv.Key, err))
+		}
+		rec, err := getLockRecord(stub, attrs[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Records = append(page.Records, rec)
+	}
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// recordLock saves a pending lock whose id is the current txid.
+func recordLock(stub shim.ChaincodeStubInterface, param *lockParam, amt, fee *big.Int) (*LockRecord, error) {
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	rec := &LockRecord{
+		Id:        stub.GetTxID(),
+		Token:     param.Token,
+		From:      param.From,
+		ChainId:   param.ChainId,
+		ToAddress: param.ToAddress,
+		Amount:    amt,
+		Fee:       fee,
+		Status:    LockStatusPending,
+		CreatedAt: now,
+		Memo:      string(param.Memo),
+	}
+	if err := putLockRecord(stub, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func refundLock(stub shim.ChaincodeStubInterface, rec *LockRecord) error {
+	// a lock still waiting in the batch must not be sent any more
+	if err := removeBatchEntry(stub, rec.Token, rec.ChainId, rec.Id); err != nil {
+		return err
+	}
+	if err := addLocked(stub, rec.Token, rec.ChainId, big.NewInt(0).Neg(rec.Amount)); err != nil {
+		return err
+	}
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return fmt.Errorf("failed to get LockProxyAddr: %v", err)
+	}
+	if _, err := payOut(stub, rec.Token, lpAddr, nil, rec.From, rec.From, rec.Amount); err != nil {
+		return fmt.Errorf("failed to refund %s to %x: %v", rec.Amount.String(), rec.From, err)
+	}
+	return setLockStatus(stub, rec, LockStatusRefunded)
+}
+
+func setLockStatus(stub shim.ChaincodeStubInterface, rec *LockRecord, status string) error {
+	key, err := lockIndexKey(stub, rec)
+	if err != nil {
+		return err
+	}
+	if err := stub.DelState(key); err != nil {
+		return fmt.Errorf("failed to delete lock index: %v", err)
+	}
+	rec.Status = status
+	return putLockRecord(stub, rec)
+}
+
+func putLockRecord(stub shim.ChaincodeStubInterface, rec *LockRecord) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to json marshal: %v", err)
+	}
+	if err := stub.PutState(getLockRecordKey(rec.Id), raw); err != nil {
+		return fmt.Errorf("failed to put lock: %v", err)
+	}
+	key, err := lockIndexKey(stub, rec)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, []byte{0}); err != nil {
+		return fmt.Errorf("failed to put lock index: %v", err)
+	}
+	return nil
+}
+
+func getLockRecord(stub shim.ChaincodeStubInterface, id string) (*LockRecord, error) {
+	raw, err := stub.GetState(getLockRecordKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lock %s: %v", id, err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no lock %s found", id)
+	}
+	rec := &LockRecord{}
+	if err := json.Unmarshal(raw, rec); err != nil {
+		return nil, fmt.Errorf("failed to decode lock %s: %v", id, err)
+	}
+	return rec, nil
+}
+
+func emitLockStatus(stub shim.ChaincodeStubInterface, name string, rec *LockRecord, reason string) pb.Response {
+	rawEvent, err := json.Marshal(newLockStatusEvent(rec, reason))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(name, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(rawEvent)
+}
+
+func newLockStatusEvent(rec *LockRecord, reason string) *LockStatusEvent {
+	return &LockStatusEvent{
+		Id:     rec.Id,
+		Token:  rec.Token,
+		From:   rec.From,
+		Amount: rec.Amount,
+		Reason: reason,
+	}
+}
+
+func lockIndexKey(stub shim.ChaincodeStubInterface, rec *LockRecord) (string, error) {
+	key, err := stub.CreateCompositeKey(LockIndexType, []string{hex.EncodeToString(rec.From), rec.Status, rec.Id})
+	if err != nil {
+		return "", fmt.Errorf("failed to create lock index key: %v", err)
+	}
+	return key, nil
+}
+
+func getLockRecordKey(id string) string {
+	return fmt.Sprintf(LockRecordKey, id)
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcommon "github.com/polynetwork/poly/common"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+const (
+	AssetFactoryKey      = "asset_factory-%d"
+	AssetRegistrationKey = "asset_registration-%d-%s"
+	AssetRegistered      = "proxy_asset_registered"
+
+	// RemoteRegisterMethod is the method of the remote factory called by registerAsset.
+	RemoteRegisterMethod = "registerAsset"
+
+	RegistrationPending   = "pending"
+	RegistrationCompleted = "completed"
+)
+
+// AssetMetadata is sent to the remote factory so that it can deploy the wrapped
+// token. Token is the fabric chaincode name, used as the asset hash on the way back.
+type AssetMetadata struct {
+	Token    []byte
+	Name     []byte
+	Symbol   []byte
+	Decimals uint8
+}
+
+func (m *AssetMetadata) Serialization(sink *pcommon.ZeroCopySink) {
+	sink.WriteVarBytes(m.Token)
+	sink.WriteVarBytes(m.Name)
+	sink.WriteVarBytes(m.Symbol)
+	sink.WriteUint8(m.Decimals)
+}
+
+func (m *AssetMetadata) Deserialization(source *pcommon.ZeroCopySource) error {
+	var eof bool
+	if m.Token, eof = source.NextVarBytes(); eof {
+		return fmt.Errorf("AssetMetadata.Deserialization NextVarBytes Token error:%s", io.ErrUnexpectedEOF)
+	}
+	if m.Name, eof = source.NextVarBytes(); eof {
+		return fmt.Errorf("AssetMetadata.Deserialization NextVarBytes Name error:%s", io.ErrUnexpectedEOF)
+	}
+	if m.Symbol, eof = source.NextVarBytes(); eof {
+		return fmt.Errorf("AssetMetadata.Deserialization NextVarBytes Symbol error:%s", io.ErrUnexpectedEOF)
+	}
+	if m.Decimals, eof = source.NextUint8(); eof {
+		return fmt.Errorf("AssetMetadata.Deserialization NextUint8 Decimals error:%s", io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// AssetRegisteredArgs is sent back by the remote factory with the address of the
+// deployed token and its decimals.
+type AssetRegisteredArgs struct {
+	Token     []byte
+	AssetHash []byte
+	Decimals  uint8
+}
+
+func (args *AssetRegisteredArgs) Serialization(sink *pcommon.ZeroCopySink) {
+	sink.WriteVarBytes(args.Token)
+	sink.WriteVarBytes(args.AssetHash)
+	sink.WriteUint8(args.Decimals)
+}
+
+func (args *AssetRegisteredArgs) Deserialization(source *pcommon.ZeroCopySource) error {
+	var eof bool
+	if args.Token, eof = source.NextVarBytes(); eof {
+		return fmt.Errorf("AssetRegisteredArgs.Deserialization NextVarBytes Token error:%s", io.ErrUnexpectedEOF)
+	}
+	if args.AssetHash, eof = source.NextVarBytes(); eof {
+		return fmt.Errorf("AssetRegisteredArgs.Deserialization NextVarBytes AssetHash error:%s", io.ErrUnexpectedEOF)
+	}
+	if args.Decimals, eof = source.NextUint8(); eof {
+		return fmt.Errorf("AssetRegisteredArgs.Deserialization NextUint8 Decimals error:%s", io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// AssetRegistration tracks a registerAsset until the factory answers.
+type AssetRegistration struct {
+	Token          string `json:"token"`
+	ChainId        uint64 `json:"chain_id"`
+	Name           string `json:"name"`
+	Symbol         string `json:"symbol"`
+	Decimals       uint8  `json:"decimals"`
+	CrossChainId   string `json:"cross_chain_id"`
+	Status         string `json:"status"`
+	AssetHash      string `json:"asset_hash,omitempty"`
+	RemoteDecimals uint8  `json:"remote_decimals,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+// args: chainId, hex factory
+func (lp *LockProxy) bindAssetFactory(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	factory, err := hex.DecodeString(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex factory: %v", err))
+	}
+	if err := stub.PutState(getAssetFactoryKey(chainId), factory); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put asset factory: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: chainId
+func (lp *LockProxy) getAssetFactory(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	factory, err := stub.GetState(getAssetFactoryKey(chainId))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get asset factory: %v", err))
+	}
+	return shim.Success(factory)
+}
+
+// registerAsset sends the metadata of token to the factory of chainId, which is
+// expected to deploy the wrapped token and call assetRegistered back.
+// args: token, chainId
+func (lp *LockProxy) registerAsset(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	token := string(args[0])
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	toAsset, err := GetAssetBinding(stub, chainId, token)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get asset: %v", err))
+	}
+	if len(toAsset) != 0 {
+		return shim.Error(fmt.Sprintf("%s is already bound to %x on chain %d", token, toAsset, chainId))
+	}
+	factory, err := stub.GetState(getAssetFactoryKey(chainId))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get asset factory: %v", err))
+	}
+	if len(factory) == 0 {
+		return shim.Error(fmt.Sprintf("no asset factory bound for chain %d", chainId))
+	}
+	meta, err := readAssetMetadata(stub, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	meta.Serialization(sink)
+	if err := sendCrossChain(stub, chainId, factory, RemoteRegisterMethod, sink.Bytes(), nil); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := utils.GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reg := &AssetRegistration{
+		Token:        token,
+		ChainId:      chainId,
+		Name:         string(meta.Name),
+		Symbol:       string(meta.Symbol),
+		Decimals:     meta.Decimals,
+		CrossChainId: stub.GetTxID(),
+		Status:       RegistrationPending,
+		CreatedAt:    now,
+	}
+	raw, err := putAssetRegistration(stub, reg)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// from_ccm is the event of this tx, the registration is returned
+	return shim.Success(raw)
+}
+
+// assetRegistered is called by ccm with the answer of the factory and binds the asset.
+// args: hex registered args, hex from contract, from chainId, [hex cross chain id],
+// or hex registered args only from a ccm not upgraded yet
+func (lp *LockProxy) assetRegistered(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	msg, err := ParseCCMArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fromChainId := msg.FromChainId
+	factory, err := stub.GetState(getAssetFactoryKey(fromChainId))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get asset factory: %v", err))
+	}
+	if len(factory) == 0 || !bytes.Equal(factory, msg.FromContract) {
+		return shim.Error(fmt.Sprintf("from contract %x is not the asset factory bound for chain %d", msg.FromContract, fromChainId))
+	}
+	regArgs := &AssetRegisteredArgs{}
+	if err := regArgs.Deserialization(pcommon.NewZeroCopySource(msg.Args)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to deserialize registered args: %v", err))
+	}
+	if len(regArgs.AssetHash) == 0 {
+		return shim.Error("asset hash can't be empty")
+	}
+
+	reg, err := getAssetRegistration(stub, fromChainId, string(regArgs.Token))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if reg.Status != RegistrationPending {
+		return shim.Error(fmt.Sprintf("registration of %s on chain %d is already %s", reg.Token, reg.ChainId, reg.Status))
+	}
+	if err := PutAssetBinding(stub, fromChainId, reg.Token, regArgs.AssetHash); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put asset: %v", err))
+	}
+	// the factory may not keep our precision, e.g. capped to 18 decimals
+	if regArgs.Decimals != reg.Decimals {
+		remote := []byte(strconv.FormatUint(uint64(regArgs.Decimals), 10))
+		local := []byte(strconv.FormatUint(uint64(reg.Decimals), 10))
+		if err := putAssetDecimals(stub, fromChainId, reg.Token, remote, local); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put asset decimals: %v", err))
+		}
+	} else if err := stub.DelState(getAssetDecimalsKey(fromChainId, reg.Token)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete asset decimals: %v", err))
+	}
+
+	reg.Status = RegistrationCompleted
+	reg.AssetHash = hex.EncodeToString(regArgs.AssetHash)
+	reg.RemoteDecimals = regArgs.Decimals
+	rawEvent, err := putAssetRegistration(stub, reg)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent(AssetRegistered, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	// ccm emits the payload since the event of a called chaincode is dropped
+	return shim.Success(rawEvent)
+}
+
+// args: token, chainId
+func (lp *LockProxy) getAssetRegistration(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	reg, err := getAssetRegistration(stub, chainId, string(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := json.Marshal(reg)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// readAssetMetadata reads name, symbol and decimal from the ERC20TokenImpl chaincode.
+func readAssetMetadata(stub shim.ChaincodeStubInterface, token string) (*AssetMetadata, error) {
+	name, err := invokeToken(stub, token, "name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get name: %v", err)
+	}
+	symbol, err := invokeToken(stub, token, "symbol")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get symbol: %v", err)
+	}
+	rawDecimal, err := invokeToken(stub, token, "decimal")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get decimal: %v", err)
+	}
+	decimal := big.NewInt(0).SetBytes(rawDecimal)
+	if !decimal.IsUint64() || decimal.Uint64() > MaxDecimals {
+		return nil, fmt.Errorf("decimals should not be greater than %d", MaxDecimals)
+	}
+	return &AssetMetadata{
+		Token:    []byte(token),
+		Name:     name,
+		Symbol:   symbol,
+		Decimals: uint8(decimal.Uint64()),
+	}, nil
+}
+
+func getAssetRegistration(stub shim.ChaincodeStubInterface, chainId uint64, token string) (*AssetRegistration, error) {
+	raw, err := stub.GetState(fmt.Sprintf(AssetRegistrationKey, chainId, token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get asset registration: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no registration of %s on chain %d", token, chainId)
+	}
+	reg := &AssetRegistration{}
+	if err := json.Unmarshal(raw, reg); err != nil {
+		return nil, fmt.Errorf("failed to decode asset registration: %v", err)
+	}
+	return reg, nil
+}
+
+func putAssetRegistration(stub shim.ChaincodeStubInterface, reg *AssetRegistration) ([]byte, error) {
+	raw, err := json.Marshal(reg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to json marshal: %v", err)
+	}
+	if err := stub.PutState(fmt.Sprintf(AssetRegistrationKey, reg.ChainId, reg.Token), raw); err != nil {
+		return nil, fmt.Errorf("failed to put asset registration: %v", err)
+	}
+	return raw, nil
+}
+
+func getAssetFactoryKey(chainId uint64) string {
+	return fmt.Sprintf(AssetFactoryKey, chainId)
+}
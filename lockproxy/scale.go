@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lockproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"strconv"
+)
+
+const (
+	AssetDecimalsKey = "asset_decimals-%d-%s"
+	MaxDecimals      = 77
+)
+
+// AssetDecimals is stored with the asset binding when the remote asset has its own precision.
+type AssetDecimals struct {
+	Local  uint64 `json:"local"`
+	Remote uint64 `json:"remote"`
+}
+
+// toRemote converts local amount to the remote precision, failing on the dust
+// which can't be represented on the remote chain.
+func (ad *AssetDecimals) toRemote(amt *big.Int) (*big.Int, error) {
+	return scaleAmount(amt, ad.Local, ad.Remote)
+}
+
+func (ad *AssetDecimals) toLocal(amt *big.Int) (*big.Int, error) {
+	return scaleAmount(amt, ad.Remote, ad.Local)
+}
+
+type ScalingRule struct {
+	Token          string `json:"token"`
+	ChainId        uint64 `json:"chain_id"`
+	LocalDecimals  uint64 `json:"local_decimals"`
+	RemoteDecimals uint64 `json:"remote_decimals"`
+	LockUnit       string `json:"lock_unit"`
+	UnlockUnit     string `json:"unlock_unit"`
+	Rule           string `json:"rule"`
+}
+
+func (lp *LockProxy) getScalingRule(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	token := string(args[0])
+	ad, err := getAssetDecimals(stub, chainId, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rule := &ScalingRule{
+		Token:      token,
+		ChainId:    chainId,
+		LockUnit:   "1",
+		UnlockUnit: "1",
+		Rule:       "no remote decimals bound, amount is sent unchanged",
+	}
+	if ad != nil {
+		rule.LocalDecimals = ad.Local
+		rule.RemoteDecimals = ad.Remote
+		switch {
+		case ad.Local > ad.Remote:
+			rule.LockUnit = pow10(ad.Local - ad.Remote).String()
+			rule.Rule = fmt.Sprintf("lock: net amount must be a multiple of %s and is divided by it; unlock: amount is multiplied by %s",
+				rule.LockUnit, rule.LockUnit)
+		case ad.Local < ad.Remote:
+			rule.UnlockUnit = pow10(ad.Remote - ad.Local).String()
+			rule.Rule = fmt.Sprintf("lock: net amount is multiplied by %s; unlock: amount must be a multiple of %s and is divided by it",
+				rule.UnlockUnit, rule.UnlockUnit)
+		default:
+			rule.Rule = "same decimals, amount is sent unchanged"
+		}
+	}
+	raw, err := json.Marshal(rule)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// putAssetDecimals stores decimals for the binding. The local decimals is read
+// from the token chaincode if not given.
+func putAssetDecimals(stub shim.ChaincodeStubInterface, chainId uint64, token string, remote, local []byte) error {
+	ad := &AssetDecimals{}
+	var err error
+	if ad.Remote, err = strconv.ParseUint(string(remote), 10, 64); err != nil {
+		return fmt.Errorf("failed to parse remote decimals: %v", err)
+	}
+	if local != nil {
+		if ad.Local, err = strconv.ParseUint(string(local), 10, 64); err != nil {
+			return fmt.Errorf("failed to parse local decimals: %v", err)
+		}
+	} else {
+		resp := stub.InvokeChaincode(token, [][]byte{[]byte("decimal")}, "")
+		if resp.Status != shim.OK {
+			return fmt.Errorf("failed to get decimal from %s: %s", token, resp.GetMessage())
+		}
+		ad.Local = big.NewInt(0).SetBytes(resp.Payload).Uint64()
+	}
+	if ad.Local > MaxDecimals || ad.Remote > MaxDecimals {
+		return fmt.Errorf("decimals should not be greater than %d", MaxDecimals)
+	}
+	raw, err := json.Marshal(ad)
+	if err != nil {
+		return fmt.Errorf("failed to json marshal: %v", err)
+	}
+	return stub.PutState(getAssetDecimalsKey(chainId, token), raw)
+}
+
+// getAssetDecimals returns nil if no decimals bound for (token, chain).
+func getAssetDecimals(stub shim.ChaincodeStubInterface, chainId uint64, token string) (*AssetDecimals, error) {
+	raw, err := stub.GetState(getAssetDecimalsKey(chainId, token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get asset decimals: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	ad := &AssetDecimals{}
+	if err := json.Unmarshal(raw, ad); err != nil {
+		return nil, fmt.Errorf("failed to decode asset decimals: %v", err)
+	}
+	return ad, nil
+}
+
+// toLocalAmount scales amt sent from chainId to the decimals of token here.
+func toLocalAmount(stub shim.ChaincodeStubInterface, chainId uint64, token string, amt *big.Int) (*big.Int, error) {
+	ad, err := getAssetDecimals(stub, chainId, token)
+	if err != nil {
+		return nil, err
+	}
+	if ad == nil {
+		return amt, nil
+	}
+	local, err := ad.toLocal(amt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scale amount: %v", err)
+	}
+	return local, nil
+}
+
+func scaleAmount(amt *big.Int, from, to uint64) (*big.Int, error) {
+	if from == to {
+		return big.NewInt(0).Set(amt), nil
+	}
+	if to > from {
+		res := big.NewInt(0).Mul(amt, pow10(to-from))
+		if res.BitLen() > 255 {
+			return nil, fmt.Errorf("amount %s overflows with %d decimals", amt.String(), to)
+		}
+		return res, nil
+	}
+	unit := pow10(from - to)
+	res, dust := big.NewInt(0).QuoRem(amt, unit, big.NewInt(0))
+	if dust.Sign() != 0 {
+		return nil, fmt.Errorf("amount %s has dust %s which can't be represented with %d decimals", amt.String(), dust.String(), to)
+	}
+	return res, nil
+}
+
+func pow10(n uint64) *big.Int {
+	return big.NewInt(0).Exp(big.NewInt(10), big.NewInt(0).SetUint64(n), nil)
+}
+
+func getAssetDecimalsKey(chainId uint64, token string) string {
+	return fmt.Sprintf(AssetDecimalsKey, chainId, token)
+}
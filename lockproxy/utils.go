@@ -27,6 +27,40 @@ type TransferOwnershipEvent struct {
 	NewOwner []byte `json:"new_owner"`
 }
 
+// LockEvent and UnlockEvent carry the fields of the events of lockproxy on EVM
+// chains, hashes and addresses are hex and amounts are decimal.
+type LockEvent struct {
+	FromAsset   string `json:"from_asset"`
+	FromAddress string `json:"from_address"`
+	ToChainId   uint64 `json:"to_chain_id"`
+	ToAsset     string `json:"to_asset"`
+	ToAddress   string `json:"to_address"`
+	Amount      string `json:"amount"`
+	// Fee is charged in local decimals from the amount locked
+	Fee          string `json:"fee"`
+	CrossChainId string `json:"cross_chain_id"`
+	// Spender is set by lockFrom
+	Spender string `json:"spender,omitempty"`
+	Memo    string `json:"memo,omitempty"`
+}
+
+type UnlockEvent struct {
+	ToAsset      string `json:"to_asset"`
+	ToAddress    string `json:"to_address"`
+	Amount       string `json:"amount"`
+	FromChainId  uint64 `json:"from_chain_id"`
+	CrossChainId string `json:"cross_chain_id"`
+	// FromAddress is who locked on the source chain, empty if the message has none
+	FromAddress string `json:"from_address,omitempty"`
+	// PendingId is set when the unlock waits for approval
+	PendingId string `json:"pending_id,omitempty"`
+	// Held is set when the receiver is denied and the funds stay at LockProxyAddr
+	Held bool `json:"held,omitempty"`
+	// CallFailed is why the call data failed, the funds went to ToAddress then
+	CallFailed string `json:"call_failed,omitempty"`
+	Memo       string `json:"memo,omitempty"`
+}
+
 // coming from "github.com/ethereum/go-ethereum/common/math"
 func PadFixedBytes(bigint *big.Int, intBsLen int) ([]byte, error) {
 	ret := make([]byte, intBsLen)
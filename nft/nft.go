@@ -0,0 +1,869 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package nft
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/assets"
+	"github.com/polynetwork/fabric-contract/utils"
+	"math/big"
+	"strconv"
+)
+
+const (
+	NFTId          = "NFTImpl"
+	NFTOwner       = NFTId + "-Owner"
+	NFTName        = NFTId + "-Name"
+	NFTSymbol      = NFTId + "-Symbol"
+	NFTTotalSupply = NFTId + "-TotalSupply"
+	NFTTokenOwner  = NFTId + "-%s-TokenOwner"
+	NFTTokenURI    = NFTId + "-%s-URI"
+	NFTBalance     = NFTId + "-%s-Balance"
+	NFTApprove     = NFTId + "-%s-Approve"
+	NFTOperator    = NFTId + "-%s-Operator-%s"
+
+	EventTransfer          = NFTId + "transfer"
+	EventApproval          = NFTId + "approve"
+	EventApprovalForAll    = NFTId + "approveForAll"
+	EventTransferOwnership = NFTId + "transferOwnerShip"
+
+	IsCrossChainOn = "is_cc_on"
+	LockProxyAddr  = "lockproxy_addr"
+	LockProxyKey   = "lockproxy_%s"
+	ProxyMint      = "proxyMint"
+
+	MaxTokenURILen = 1024
+)
+
+var logger = shim.NewLogger("NFT")
+
+// NFTImpl is a non-fungible token with ERC721 semantics. Token ids are decimal
+// strings of uint256 so they can be bridged to the NFT proxy on EVM chains.
+type NFTImpl struct{}
+
+// args: name, symbol, [CCMChainCodeName, [lockProxyAddr, LPchaincodeName]]
+func (nft *NFTImpl) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	rawName, _ := stub.GetState(NFTName)
+	if len(rawName) != 0 {
+		return shim.Success(nil)
+	}
+
+	args := stub.GetStringArgs()
+	if len(args) != 2 && len(args) != 3 && len(args) != 5 {
+		return shim.Error("wrong args number and should be two, three or five")
+	}
+	if args[0] == "" {
+		return shim.Error("nft name can't be empty")
+	}
+	if args[1] == "" {
+		return shim.Error("nft symbol can't be empty")
+	}
+	if err := stub.PutState(NFTName, []byte(args[0])); err != nil {
+		return shim.Error(fmt.Sprintf("failed To put nft name: %v", err))
+	}
+	if err := stub.PutState(NFTSymbol, []byte(args[1])); err != nil {
+		return shim.Error(fmt.Sprintf("failed To put nft symbol: %v", err))
+	}
+
+	owner, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	if err = stub.PutState(NFTOwner, owner.Bytes()); err != nil {
+		return shim.Error(fmt.Sprintf("failed To put nft owner: %v", err))
+	}
+
+	if len(args) > 2 && args[2] != "" {
+		if err := stub.PutState(IsCrossChainOn, []byte(args[2])); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put true for crosschain: %v", err))
+		}
+	}
+	// mapping nft only minted by the lockproxy
+	if len(args) == 5 {
+		lpAddr, err := hex.DecodeString(args[3])
+		if err != nil || len(lpAddr) != 20 {
+			return shim.Error(fmt.Sprintf("wrong lockproxy address: %s", args[3]))
+		}
+		if err := stub.PutState(LockProxyAddr, lpAddr); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put lockproxy addr: %v", err))
+		}
+		if err := stub.PutState(lockproxyKey(args[4]), lpAddr); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put lockproxy ccname and addr: %v", err))
+		}
+	}
+	return shim.Success(nil)
+}
+
+func (nft *NFTImpl) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	fn, _ := stub.GetFunctionAndParameters()
+	args := stub.GetArgs()
+	if len(args) == 0 {
+		return shim.Error("no args")
+	}
+	args = args[1:]
+
+	switch fn {
+	case "name":
+		return nft.name(stub)
+	case "symbol":
+		return nft.symbol(stub)
+	case "totalSupply":
+		return nft.totalSupply(stub)
+	case "getMyAddr":
+		return nft.getMyAddr(stub)
+	case "getOwner":
+		return nft.getOwner(stub)
+	case "transferOwnership":
+		return nft.transferOwnership(stub, args)
+	case "balanceOf":
+		return nft.balanceOf(stub, args)
+	case "ownerOf":
+		return nft.ownerOf(stub, args)
+	case "exists":
+		return nft.exists(stub, args)
+	case "tokenURI":
+		return nft.tokenURI(stub, args)
+	case "mint":
+		return nft.mint(stub, args)
+	case "burn":
+		return nft.burn(stub, args)
+	case "transfer":
+		return nft.transfer(stub, args)
+	case "approve":
+		return nft.approve(stub, args)
+	case "getApproved":
+		return nft.getApproved(stub, args)
+	case "setApprovalForAll":
+		return nft.setApprovalForAll(stub, args)
+	case "isApprovedForAll":
+		return nft.isApprovedForAll(stub, args)
+	case "transferFrom":
+		return nft.transferFrom(stub, args)
+	case "proxyTransfer":
+		return nft.proxyTransfer(stub, args)
+	case "proxyMint":
+		return nft.proxyMint(stub, args)
+	case "setLockProxyChainCode":
+		return nft.setLockProxyChainCode(stub, args)
+	case "getLockProxyChainCode":
+		return nft.getLockProxyChainCode(stub, args)
+	case "delLockProxyChainCode":
+		return nft.delLockProxyChainCode(stub, args)
+	case "getLockProxyAddr":
+		return nft.getLockProxyAddr(stub)
+	case "isCrossChainOn":
+		return nft.isCrossChainOn(stub)
+	case "getCCM":
+		return nft.getCCM(stub)
+	case "changeCCM":
+		return nft.changeCCM(stub, args)
+	}
+
+	return shim.Error(fmt.Sprintf("no function name %s found", fn))
+}
+
+func (nft *NFTImpl) name(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(NFTName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(raw)
+}
+
+func (nft *NFTImpl) symbol(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(NFTSymbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(raw)
+}
+
+func (nft *NFTImpl) totalSupply(stub shim.ChaincodeStubInterface) pb.Response {
+	raw, err := stub.GetState(NFTTotalSupply)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(big.NewInt(0).SetBytes(raw).Bytes())
+}
+
+func (nft *NFTImpl) balanceOf(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	acc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex holder: %v", err))
+	}
+	raw, err := stub.GetState(balanceKey(acc))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get balance: %v", err))
+	}
+	return shim.Success(big.NewInt(0).SetBytes(raw).Bytes())
+}
+
+func (nft *NFTImpl) ownerOf(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	id, err := parseTokenId(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := getTokenOwner(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(owner)
+}
+
+func (nft *NFTImpl) exists(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	id, err := parseTokenId(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := stub.GetState(tokenOwnerKey(id))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get token owner: %v", err))
+	}
+	return shim.Success([]byte(strconv.FormatBool(len(raw) != 0)))
+}
+
+func (nft *NFTImpl) tokenURI(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	id, err := parseTokenId(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, err := getTokenOwner(stub, id); err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := stub.GetState(tokenURIKey(id))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get token uri: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: hex to, tokenId, tokenURI
+func (nft *NFTImpl) mint(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("number of args should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	to, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	id, err := parseTokenId(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return nft.mintLogic(stub, to, id, args[2])
+}
+
+func (nft *NFTImpl) burn(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	from, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	id, err := parseTokenId(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := getTokenOwner(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !bytes.Equal(owner, from.Bytes()) {
+		return shim.Error(fmt.Sprintf("token %s is not owned by %x", id.String(), from.Bytes()))
+	}
+	if err := stub.DelState(tokenOwnerKey(id)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete token owner: %v", err))
+	}
+	if err := stub.DelState(tokenURIKey(id)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete token uri: %v", err))
+	}
+	if err := stub.DelState(approveKey(id)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete approval: %v", err))
+	}
+	if err := addBalance(stub, owner, -1); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addTotalSupply(stub, -1); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitTransfer(stub, owner, nil, id)
+}
+
+// args: hex to, tokenId
+func (nft *NFTImpl) transfer(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
+	}
+	from, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	to, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	id, err := parseTokenId(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return nft.transferLogic(stub, from.Bytes(), to, id)
+}
+
+// args: hex spender, tokenId
+func (nft *NFTImpl) approve(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
+	}
+	sender, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	spender, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex spender: %v", err))
+	}
+	id, err := parseTokenId(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := getTokenOwner(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !bytes.Equal(owner, sender.Bytes()) && !isOperator(stub, owner, sender.Bytes()) {
+		return shim.Error(fmt.Sprintf("%x is not owner or operator of token %s", sender.Bytes(), id.String()))
+	}
+	if err := stub.PutState(approveKey(id), spender); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put approval: %v", err))
+	}
+
+	rawEvent, err := json.Marshal(&ApprovalEvent{
+		Owner:    owner,
+		Approved: spender,
+		TokenId:  id.String(),
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventApproval, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (nft *NFTImpl) getApproved(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	id, err := parseTokenId(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	raw, err := stub.GetState(approveKey(id))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get approval: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+// args: hex operator, true or false
+func (nft *NFTImpl) setApprovalForAll(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
+	}
+	owner, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	operator, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex operator: %v", err))
+	}
+	approved, err := strconv.ParseBool(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse approved: %v", err))
+	}
+	key := operatorKey(owner.Bytes(), operator)
+	if approved {
+		err = stub.PutState(key, []byte{1})
+	} else {
+		err = stub.DelState(key)
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to update operator: %v", err))
+	}
+
+	rawEvent, err := json.Marshal(&ApprovalForAllEvent{
+		Owner:    owner.Bytes(),
+		Operator: operator,
+		Approved: approved,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventApprovalForAll, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: hex owner, hex operator
+func (nft *NFTImpl) isApprovedForAll(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("number of args should be 2")
+	}
+	owner, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex owner: %v", err))
+	}
+	operator, err := hex.DecodeString(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex operator: %v", err))
+	}
+	return shim.Success([]byte(strconv.FormatBool(isOperator(stub, owner, operator))))
+}
+
+// args: hex from, hex to, tokenId
+func (nft *NFTImpl) transferFrom(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("number of args should be 3")
+	}
+	spender, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	from, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex from: %v", err))
+	}
+	to, err := hex.DecodeString(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex to_addr: %v", err))
+	}
+	id, err := parseTokenId(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	approved, err := stub.GetState(approveKey(id))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get approval: %v", err))
+	}
+	if !bytes.Equal(from, spender.Bytes()) && !bytes.Equal(approved, spender.Bytes()) &&
+		!isOperator(stub, from, spender.Bytes()) {
+		return shim.Error(fmt.Sprintf("%x is not approved for token %s", spender.Bytes(), id.String()))
+	}
+	return nft.transferLogic(stub, from, to, id)
+}
+
+func (nft *NFTImpl) transferLogic(stub shim.ChaincodeStubInterface, from, to []byte, id *big.Int) pb.Response {
+	if len(to) == 0 {
+		return shim.Error("receiver can't be empty")
+	}
+	owner, err := getTokenOwner(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !bytes.Equal(owner, from) {
+		return shim.Error(fmt.Sprintf("token %s is not owned by %x", id.String(), from))
+	}
+	if err := stub.DelState(approveKey(id)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to delete approval: %v", err))
+	}
+	if err := stub.PutState(tokenOwnerKey(id), to); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put token owner: %v", err))
+	}
+	if err := addBalance(stub, from, -1); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addBalance(stub, to, 1); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitTransfer(stub, from, to, id)
+}
+
+func (nft *NFTImpl) mintLogic(stub shim.ChaincodeStubInterface, to []byte, id *big.Int, uri []byte) pb.Response {
+	if len(to) == 0 {
+		return shim.Error("receiver can't be empty")
+	}
+	if len(uri) > MaxTokenURILen {
+		return shim.Error(fmt.Sprintf("token uri should not be longer than %d", MaxTokenURILen))
+	}
+	raw, err := stub.GetState(tokenOwnerKey(id))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get token owner: %v", err))
+	}
+	if len(raw) != 0 {
+		return shim.Error(fmt.Sprintf("token %s already exists", id.String()))
+	}
+	if err := stub.PutState(tokenOwnerKey(id), to); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put token owner: %v", err))
+	}
+	if len(uri) > 0 {
+		if err := stub.PutState(tokenURIKey(id), uri); err != nil {
+			return shim.Error(fmt.Sprintf("failed to put token uri: %v", err))
+		}
+	}
+	if err := addBalance(stub, to, 1); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addTotalSupply(stub, 1); err != nil {
+		return shim.Error(err.Error())
+	}
+	return emitTransfer(stub, nil, to, id)
+}
+
+// args: from, to, tokenId bytes. Only a lockproxy set for this nft can move its
+// own tokens, the same as ERC20TokenImpl.proxyTransfer.
+func (nft *NFTImpl) proxyTransfer(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("length 3 of args expected")
+	}
+	lpName, lpAddr, err := getCallingProxy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !bytes.Equal(lpAddr, args[0]) && !bytes.Equal(lpAddr, args[1]) {
+		return shim.Error(fmt.Sprintf("lockProxy address %s for %s not equal any address from the request: (from: %s, to: %s)",
+			hex.EncodeToString(lpAddr), lpName, hex.EncodeToString(args[0]), hex.EncodeToString(args[1])))
+	}
+	id := big.NewInt(0).SetBytes(args[2])
+
+	logger.Infof("successful to call proxyTransfer for chaincode %s: (from: %x, to: %x, token_id: %s)",
+		lpName, args[0], args[1], id.String())
+	return nft.transferLogic(stub, args[0], args[1], id)
+}
+
+// args: to, tokenId bytes, tokenURI. Called by lockproxy when unlocking a token
+// which doesn't exist on fabric yet.
+func (nft *NFTImpl) proxyMint(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("length 3 of args expected")
+	}
+	lpName, _, err := getCallingProxy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id := big.NewInt(0).SetBytes(args[1])
+
+	logger.Infof("successful to call proxyMint for chaincode %s: (to: %x, token_id: %s)", lpName, args[0], id.String())
+	return nft.mintLogic(stub, args[0], id, args[2])
+}
+
+// args: lockproxy chaincode name, [hex lockproxy address]
+func (nft *NFTImpl) setLockProxyChainCode(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if !isCCOn(stub) {
+		return shim.Error("not cross chain asset")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if len(args) == 0 || string(args[0]) == "" {
+		return shim.Error("chaincode name required")
+	}
+	lpAddr, _ := stub.GetState(LockProxyAddr)
+	if len(lpAddr) == 0 {
+		if len(args) != 2 {
+			return shim.Error("wrong args length and expect 2")
+		}
+		var err error
+		lpAddr, err = hex.DecodeString(string(args[1]))
+		if err != nil || len(lpAddr) != 20 {
+			return shim.Error(fmt.Sprintf("wrong lockproxy address: %s", args[1]))
+		}
+	} else if len(args) != 1 {
+		return shim.Error("wrong args length and expect 1")
+	}
+	if err := stub.PutState(lockproxyKey(string(args[0])), lpAddr); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put proxy name: %v", err))
+	}
+	logger.Infof("set lockproxy %s with address %x", string(args[0]), lpAddr)
+	return shim.Success(nil)
+}
+
+func (nft *NFTImpl) getLockProxyChainCode(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("wrong args length and expect 1")
+	}
+	raw, err := stub.GetState(lockproxyKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get proxy address: %v", err))
+	}
+	return shim.Success(raw)
+}
+
+func (nft *NFTImpl) delLockProxyChainCode(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("wrong args length and expect 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if err := stub.DelState(lockproxyKey(string(args[0]))); err != nil {
+		return shim.Error(fmt.Sprintf("failed to del state: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (nft *NFTImpl) transferOwnership(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	old, err := checkOwner(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rawAcc, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex account: %v", err))
+	}
+	if err := stub.PutState(NFTOwner, rawAcc); err != nil {
+		return shim.Error(err.Error())
+	}
+	rawEvent, err := json.Marshal(&assets.TransferOwnershipEvent{
+		NewOwner: rawAcc,
+		OldOwner: old,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventTransferOwnership, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (nft *NFTImpl) changeCCM(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("number of args should be 1")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	if len(args[0]) == 0 {
+		return shim.Error("ccm can't be nil")
+	}
+	if err := stub.PutState(IsCrossChainOn, args[0]); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put state: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (nft *NFTImpl) getOwner(stub shim.ChaincodeStubInterface) pb.Response {
+	owner, err := stub.GetState(NFTOwner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(owner)
+}
+
+func (nft *NFTImpl) getMyAddr(stub shim.ChaincodeStubInterface) pb.Response {
+	creator, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get sender: %v", err))
+	}
+	return shim.Success(creator.Bytes())
+}
+
+func (nft *NFTImpl) getLockProxyAddr(stub shim.ChaincodeStubInterface) pb.Response {
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(lpAddr)
+}
+
+func (nft *NFTImpl) getCCM(stub shim.ChaincodeStubInterface) pb.Response {
+	val, _ := stub.GetState(IsCrossChainOn)
+	if len(val) == 0 {
+		return shim.Error("no ccm found")
+	}
+	return shim.Success(val)
+}
+
+func (nft *NFTImpl) isCrossChainOn(stub shim.ChaincodeStubInterface) pb.Response {
+	if !isCCOn(stub) {
+		return shim.Success([]byte("false"))
+	}
+	return shim.Success([]byte("true"))
+}
+
+// getCallingProxy returns the lockproxy calling this nft directly or through ccm.
+func getCallingProxy(stub shim.ChaincodeStubInterface) (string, []byte, error) {
+	if !isCCOn(stub) {
+		return "", nil, fmt.Errorf("not cross chain asset")
+	}
+	ccname, err := utils.GetCallingChainCodeName(stub)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get calling chaincode: %v", err)
+	}
+	ccmRec, err := stub.GetState(IsCrossChainOn)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get ccm: %v", err)
+	}
+
+	lpName := ccname
+	if string(ccmRec) == ccname {
+		originalArgs, err := utils.GetOriginalInputArgs(stub)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get original args: %v", err)
+		}
+		rawProof, err := hex.DecodeString(string(originalArgs[1]))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to decode proof to hex: %v", err)
+		}
+		if lpName, err = assets.GetWhatCCMCalling(rawProof); err != nil {
+			return "", nil, fmt.Errorf("failed to get chaincode name which ccm calling: %v", err)
+		}
+	}
+	lpAddr, err := stub.GetState(lockproxyKey(lpName))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get proxy address for chaincode %s: %v", lpName, err)
+	}
+	if len(lpAddr) == 0 {
+		return "", nil, fmt.Errorf("no proxy address for chaincode %s", lpName)
+	}
+	return lpName, lpAddr, nil
+}
+
+func getTokenOwner(stub shim.ChaincodeStubInterface, id *big.Int) ([]byte, error) {
+	owner, err := stub.GetState(tokenOwnerKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token owner: %v", err)
+	}
+	if len(owner) == 0 {
+		return nil, fmt.Errorf("token %s not exist", id.String())
+	}
+	return owner, nil
+}
+
+func addBalance(stub shim.ChaincodeStubInterface, acc []byte, delta int64) error {
+	key := balanceKey(acc)
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get balance: %v", err)
+	}
+	bal := big.NewInt(0).SetBytes(raw)
+	bal.Add(bal, big.NewInt(delta))
+	if bal.Sign() == 0 {
+		return stub.DelState(key)
+	}
+	return stub.PutState(key, bal.Bytes())
+}
+
+func addTotalSupply(stub shim.ChaincodeStubInterface, delta int64) error {
+	raw, err := stub.GetState(NFTTotalSupply)
+	if err != nil {
+		return fmt.Errorf("failed to get totalsupply: %v", err)
+	}
+	ts := big.NewInt(0).SetBytes(raw)
+	ts.Add(ts, big.NewInt(delta))
+	return stub.PutState(NFTTotalSupply, ts.Bytes())
+}
+
+func emitTransfer(stub shim.ChaincodeStubInterface, from, to []byte, id *big.Int) pb.Response {
+	rawEvent, err := json.Marshal(&TransferEvent{
+		From:    from,
+		To:      to,
+		TokenId: id.String(),
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventTransfer, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func isOperator(stub shim.ChaincodeStubInterface, owner, operator []byte) bool {
+	raw, _ := stub.GetState(operatorKey(owner, operator))
+	return len(raw) != 0
+}
+
+func isCCOn(stub shim.ChaincodeStubInterface) bool {
+	val, _ := stub.GetState(IsCrossChainOn)
+	return len(val) != 0
+}
+
+func checkOwner(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	creator, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := stub.GetState(NFTOwner)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(creator.Bytes(), owner) {
+		return nil, fmt.Errorf("is not owner")
+	}
+	return owner, nil
+}
+
+// parseTokenId parses a decimal token id which must fit in uint256 of the NFT proxy message.
+func parseTokenId(raw []byte) (*big.Int, error) {
+	id, ok := big.NewInt(0).SetString(string(raw), 10)
+	if !ok || id.Sign() < 0 || id.BitLen() > 255 {
+		return nil, fmt.Errorf("wrong token id: %s", raw)
+	}
+	return id, nil
+}
+
+func tokenOwnerKey(id *big.Int) string {
+	return fmt.Sprintf(NFTTokenOwner, id.String())
+}
+
+func tokenURIKey(id *big.Int) string {
+	return fmt.Sprintf(NFTTokenURI, id.String())
+}
+
+func approveKey(id *big.Int) string {
+	return fmt.Sprintf(NFTApprove, id.String())
+}
+
+func balanceKey(acc []byte) string {
+	return fmt.Sprintf(NFTBalance, hex.EncodeToString(acc))
+}
+
+func operatorKey(owner, operator []byte) string {
+	return fmt.Sprintf(NFTOperator, hex.EncodeToString(owner), hex.EncodeToString(operator))
+}
+
+func lockproxyKey(ccname string) string {
+	return fmt.Sprintf(LockProxyKey, ccname)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package nft
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/polynetwork/fabric-contract/utils"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+var (
+	rootCA = `-----BEGIN CERTIFICATE-----
+MIICNjCCAd2gAwIBAgIRAMnf9/dmV9RvCCVw9pZQUfUwCgYIKoZIzj0EAwIwgYEx
+CzAJBgNVBAYTAlVTMRMwEQYDVQQIEwpDYWxpZm9ybmlhMRYwFAYDVQQHEw1TYW4g
+RnJhbmNpc2NvMRkwFwYDVQQKExBvcmcxLmV4YW1wbGUuY29tMQwwCgYDVQQLEwND
+T1AxHDAaBgNVBAMTE2NhLm9yZzEuZXhhbXBsZS5jb20wHhcNMTcxMTEyMTM0MTEx
+WhcNMjcxMTEwMTM0MTExWjBpMQswCQYDVQQGEwJVUzETMBEGA1UECBMKQ2FsaWZv
+cm5pYTEWMBQGA1UEBxMNU2FuIEZyYW5jaXNjbzEMMAoGA1UECxMDQ09QMR8wHQYD
+VQQDExZwZWVyMC5vcmcxLmV4YW1wbGUuY29tMFkwEwYHKoZIzj0CAQYIKoZIzj0D
+AQcDQgAEZ8S4V71OBJpyMIVZdwYdFXAckItrpvSrCf0HQg40WW9XSoOOO76I+Umf
+EkmTlIJXP7/AyRRSRU38oI8Ivtu4M6NNMEswDgYDVR0PAQH/BAQDAgeAMAwGA1Ud
+EwEB/wQCMAAwKwYDVR0jBCQwIoAginORIhnPEFZUhXm6eWBkm7K7Zc8R4/z7LW4H
+ossDlCswCgYIKoZIzj0EAwIDRwAwRAIgVikIUZzgfuFsGLQHWJUVJCU7pDaETkaz
+PzFgsCiLxUACICgzJYlW7nvZxP7b6tbeu3t8mrhMXQs956mD4+BoKuNI
+-----END CERTIFICATE-----`
+
+	newCA = `-----BEGIN CERTIFICATE-----
+MIICHjCCAcWgAwIBAgIRAKU15UAdRc3gZQuCCdYE2SIwCgYIKoZIzj0EAwIwaTEL
+MAkGA1UEBhMCVVMxEzARBgNVBAgTCkNhbGlmb3JuaWExFjAUBgNVBAcTDVNhbiBG
+cmFuY2lzY28xFDASBgNVBAoTC2V4YW1wbGUuY29tMRcwFQYDVQQDEw5jYS5leGFt
+cGxlLmNvbTAeFw0yMDEwMDkwMjQ5MDBaFw0zMDEwMDcwMjQ5MDBaMGoxCzAJBgNV
+BAYTAlVTMRMwEQYDVQQIEwpDYWxpZm9ybmlhMRYwFAYDVQQHEw1TYW4gRnJhbmNp
+c2NvMRAwDgYDVQQLEwdvcmRlcmVyMRwwGgYDVQQDExNvcmRlcmVyLmV4YW1wbGUu
+Y29tMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEA67IcH48n8fpLoT9MjyDT6Qh
+QZqGe5KXHG9sqHJdIbJoYpnHMxkletVrqI35Y6sgp4w9Sy+8jTvReHc1+fchwKNN
+MEswDgYDVR0PAQH/BAQDAgeAMAwGA1UdEwEB/wQCMAAwKwYDVR0jBCQwIoAgfi+u
+kqWiPFOtT8mCFDWk2Rbl5JDHW1dwJRmcEyihyqkwCgYIKoZIzj0EAwIDRwAwRAIg
+HNzfr04Jzi4J/p1UZn1U14JM8S6ym65/BxmH9uqepM8CIA5/tfv6aZ53PpOVYsrs
+zQW7eQxTo228awU1AIwsA95+
+-----END CERTIFICATE-----`
+)
+
+// identity builds the serialized creator of a cert.
+func identity(cert string) string {
+	raw, _ := proto.Marshal(&msp.SerializedIdentity{Mspid: "DEFAULT", IdBytes: []byte(cert)})
+	return string(raw)
+}
+
+func addrOf(mock *utils.CCStubMock, cert string) string {
+	old := mock.CA
+	mock.SetNewCA(identity(cert))
+	addr, _ := utils.GetMsgSenderAddress(mock)
+	mock.SetNewCA(old)
+	return hex.EncodeToString(addr.Bytes())
+}
+
+func prepareEnv() (*NFTImpl, *utils.CCStubMock) {
+	impl := &NFTImpl{}
+	mock := &utils.CCStubMock{
+		CA: identity(rootCA),
+	}
+	mock.Mem = make(map[string][]byte)
+	mock.Args = [][]byte{
+		[]byte("Certificate"),
+		[]byte("CERT"),
+		[]byte("ccm"),
+	}
+	resp := impl.Init(mock)
+	if resp.Status != shim.OK {
+		fmt.Println(resp.GetMessage())
+	}
+	resp = impl.mint(mock, [][]byte{[]byte(addrOf(mock, rootCA)), []byte("1"), []byte("ipfs://cert/1")})
+	if resp.Status != shim.OK {
+		fmt.Println(resp.GetMessage())
+	}
+	return impl, mock
+}
+
+func TestNFTImpl_mint(t *testing.T) {
+	impl, mock := prepareEnv()
+	addr1, addr2 := addrOf(mock, rootCA), addrOf(mock, newCA)
+	resp := impl.ownerOf(mock, [][]byte{[]byte("1")})
+	assert.Equal(t, true, shim.OK == resp.Status, resp.GetMessage())
+	assert.Equal(t, addr1, fmt.Sprintf("%x", resp.Payload))
+
+	resp = impl.tokenURI(mock, [][]byte{[]byte("1")})
+	assert.Equal(t, []byte("ipfs://cert/1"), resp.Payload)
+
+	resp = impl.mint(mock, [][]byte{[]byte(addr2), []byte("1"), []byte("")})
+	assert.Equal(t, false, shim.OK == resp.Status, "token can't be minted twice")
+
+	resp = impl.totalSupply(mock)
+	assert.Equal(t, big.NewInt(1).Bytes(), resp.Payload)
+}
+
+func TestNFTImpl_transfer(t *testing.T) {
+	impl, mock := prepareEnv()
+	addr1, addr2 := addrOf(mock, rootCA), addrOf(mock, newCA)
+	resp := impl.transfer(mock, [][]byte{[]byte(addr2), []byte("1")})
+	assert.Equal(t, true, shim.OK == resp.Status, resp.GetMessage())
+
+	resp = impl.ownerOf(mock, [][]byte{[]byte("1")})
+	assert.Equal(t, addr2, fmt.Sprintf("%x", resp.Payload))
+	resp = impl.balanceOf(mock, [][]byte{[]byte(addr2)})
+	assert.Equal(t, big.NewInt(1).Bytes(), resp.Payload)
+	resp = impl.balanceOf(mock, [][]byte{[]byte(addr1)})
+	assert.Equal(t, big.NewInt(0).Bytes(), resp.Payload)
+
+	resp = impl.transfer(mock, [][]byte{[]byte(addr1), []byte("1")})
+	assert.Equal(t, false, shim.OK == resp.Status, "only owner can transfer")
+}
+
+func TestNFTImpl_transferFrom(t *testing.T) {
+	impl, mock := prepareEnv()
+	addr1, addr2 := addrOf(mock, rootCA), addrOf(mock, newCA)
+	mock.SetNewCA(identity(newCA))
+	resp := impl.transferFrom(mock, [][]byte{[]byte(addr1), []byte(addr2), []byte("1")})
+	assert.Equal(t, false, shim.OK == resp.Status, "not approved")
+
+	mock.SetNewCA(identity(rootCA))
+	resp = impl.setApprovalForAll(mock, [][]byte{[]byte(addr2), []byte("true")})
+	assert.Equal(t, true, shim.OK == resp.Status, resp.GetMessage())
+	mock.SetNewCA(identity(newCA))
+	resp = impl.transferFrom(mock, [][]byte{[]byte(addr1), []byte(addr2), []byte("1")})
+	assert.Equal(t, true, shim.OK == resp.Status, resp.GetMessage())
+
+	resp = impl.ownerOf(mock, [][]byte{[]byte("1")})
+	assert.Equal(t, addr2, fmt.Sprintf("%x", resp.Payload))
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package nftlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/lockproxy"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcommon "github.com/polynetwork/poly/common"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+const (
+	// the keys are the same as lockproxy since its owner, ccm and binding helpers are reused
+	ProxyOwner             = lockproxy.ProxyOwner
+	ProxyCCM               = lockproxy.ProxyCCM
+	LockProxyAddr          = lockproxy.LockProxyAddr
+	LockProxyAddrSeed      = "nft_lockproxy_addr"
+	FromCCM                = "from_ccm"
+	ProxyOwnershipTransfer = "proxy_owner_transfer"
+	ProxyTransfer          = "proxyTransfer"
+	ProxyMint              = "proxyMint"
+	EventUnlock            = "NFTUnlockEvent"
+	MintableKey            = "nft_mintable-%s"
+)
+
+var logger = shim.NewLogger("NFTLockProxy")
+
+// UnlockEvent is returned by unlock for ccm to emit, addresses are hex.
+type UnlockEvent struct {
+	ToAsset      string `json:"to_asset"`
+	ToAddress    string `json:"to_address"`
+	TokenId      string `json:"token_id"`
+	FromChainId  uint64 `json:"from_chain_id"`
+	CrossChainId string `json:"cross_chain_id"`
+	// Minted is set when the token comes to this chain for the first time
+	Minted bool `json:"minted,omitempty"`
+}
+
+// TxArgs is the same as the one of poly NFT lockproxy on EVM chains.
+type TxArgs struct {
+	ToAssetHash []byte
+	ToAddress   []byte
+	TokenId     *big.Int
+	TokenURI    []byte
+}
+
+func (args *TxArgs) Serialization(sink *pcommon.ZeroCopySink) error {
+	sink.WriteVarBytes(args.ToAssetHash)
+	sink.WriteVarBytes(args.ToAddress)
+	raw, err := lockproxy.PadFixedBytes(args.TokenId, 32)
+	if err != nil {
+		return err
+	}
+	sink.WriteBytes(raw)
+	sink.WriteVarBytes(args.TokenURI)
+	return nil
+}
+
+func (args *TxArgs) Deserialization(source *pcommon.ZeroCopySource) error {
+	assetHash, eof := source.NextVarBytes()
+	if eof {
+		return fmt.Errorf("Args.Deserialization NextVarBytes AssetHash error:%s", io.ErrUnexpectedEOF)
+	}
+	toAddress, eof := source.NextVarBytes()
+	if eof {
+		return fmt.Errorf("Args.Deserialization NextVarBytes ToAddress error:%s", io.ErrUnexpectedEOF)
+	}
+	value, eof := source.NextBytes(32)
+	if eof {
+		return fmt.Errorf("Args.Deserialization NextBytes TokenId error:%s", io.ErrUnexpectedEOF)
+	}
+	id, err := lockproxy.UnpadFixedBytes(value, 32)
+	if err != nil {
+		return fmt.Errorf("faield to get token id: %v", err)
+	}
+	uri, eof := source.NextVarBytes()
+	if eof {
+		return fmt.Errorf("Args.Deserialization NextVarBytes TokenURI error:%s", io.ErrUnexpectedEOF)
+	}
+
+	args.ToAssetHash = assetHash
+	args.ToAddress = toAddress
+	args.TokenId = id
+	args.TokenURI = uri
+	return nil
+}
+
+// NFTLockProxy locks nft.NFTImpl tokens for other chains and unlocks or mints
+// them for tokens coming back.
+type NFTLockProxy struct{}
+
+func (lp *NFTLockProxy) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	rawName, _ := stub.GetState(LockProxyAddr)
+	if len(rawName) != 0 {
+		return shim.Success(nil)
+	}
+
+	args := stub.GetStringArgs()
+	if len(args) != 0 {
+		return shim.Error("wrong args number and should be zero")
+	}
+
+	owner, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed To get tx sender: %v", err))
+	}
+	if err = stub.PutState(ProxyOwner, owner.Bytes()); err != nil {
+		return shim.Error(fmt.Sprintf("failed To put token owner: %v", err))
+	}
+	lpAddr := utils.GetAddrFromRaw(append([]byte(LockProxyAddrSeed), owner.Bytes()...))
+	if err := stub.PutState(LockProxyAddr, lpAddr.Bytes()); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put lockproxy addr: %v", err))
+	}
+
+	return shim.Success(nil)
+}
+
+func (lp *NFTLockProxy) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	fn, _ := stub.GetFunctionAndParameters()
+	args := stub.GetArgs()
+	if len(args) == 0 {
+		return shim.Error("no args")
+	}
+	args = args[1:]
+
+	switch fn {
+	case "getOwner":
+		return lp.getOwner(stub)
+	case "getLockProxyAddr":
+		return lp.getLockProxyAddr(stub)
+	case "transferOwnership":
+		return lp.transferOwnership(stub, args)
+	case "setManager":
+		return lockproxy.SetManager(stub, args)
+	case "getManager":
+		return lp.getManager(stub)
+	case "rotateCCM":
+		return lockproxy.RotateCCM(stub, args)
+	case "setTrustedCCM":
+		return lockproxy.SetTrustedCCM(stub, args)
+	case "removeTrustedCCM":
+		return lockproxy.RemoveTrustedCCM(stub, args)
+	case "getTrustedCCMs":
+		return lockproxy.GetTrustedCCMs(stub)
+	case "bindProxyHash":
+		return lp.bindProxyHash(stub, args)
+	case "getProxyHash":
+		return lp.getProxyHash(stub, args)
+	case "bindAssetHash":
+		return lp.bindAssetHash(stub, args)
+	case "getAssetHash":
+		return lp.getAssetHash(stub, args)
+	case "setMintable":
+		return lp.setMintable(stub, args)
+	case "isMintable":
+		return lp.isMintable(stub, args)
+	case "lock":
+		return lp.lock(stub, args)
+	case "unlock":
+		return lp.unlock(stub, args)
+	}
+
+	return shim.Error(fmt.Sprintf("no function name %s found", fn))
+}
+
+func (lp *NFTLockProxy) getOwner(stub shim.ChaincodeStubInterface) pb.Response {
+	owner, err := stub.GetState(ProxyOwner)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get owner: %v", err))
+	}
+	return shim.Success(owner)
+}
+
+func (lp *NFTLockProxy) getLockProxyAddr(stub shim.ChaincodeStubInterface) pb.Response {
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get lockproxy address: %v", err))
+	}
+	return shim.Success(lpAddr)
+}
+
+func (lp *NFTLockProxy) transferOwnership(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	old, err := checkOwner(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	newOwner, err := hex.DecodeString(string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex owner: %v", err))
+	}
+	if err := stub.PutState(ProxyOwner, newOwner); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put new owner: %v", err))
+	}
+	rawEvent, err := json.Marshal(&lockproxy.TransferOwnershipEvent{
+		OldOwner: old,
+		NewOwner: newOwner,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(ProxyOwnershipTransfer, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *NFTLockProxy) getManager(stub shim.ChaincodeStubInterface) pb.Response {
+	ccm, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get ccm: %v", err))
+	}
+	return shim.Success(ccm)
+}
+
+// args: chainId, hex proxy
+func (lp *NFTLockProxy) bindProxyHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	proxy, err := hex.DecodeString(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex proxy: %v", err))
+	}
+	if err := lockproxy.PutProxyBinding(stub, chainId, proxy); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put proxy: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+func (lp *NFTLockProxy) getProxyHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	chainId, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	val, err := lockproxy.GetProxyBinding(stub, chainId)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get proxy: %v", err))
+	}
+	return shim.Success(val)
+}
+
+// args: nft chaincode, chainId, hex asset
+func (lp *NFTLockProxy) bindAssetHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("args number should be 3")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	asset, err := hex.DecodeString(string(args[2]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to decode hex asset: %v", err))
+	}
+	if err := lockproxy.PutAssetBinding(stub, chainId, string(args[0]), asset); err != nil {
+		return shim.Error(fmt.Sprintf("failed to put asset: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: nft chaincode, chainId
+func (lp *NFTLockProxy) getAssetHash(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	val, err := lockproxy.GetAssetBinding(stub, chainId, string(args[0]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get asset: %v", err))
+	}
+	return shim.Success(val)
+}
+
+// setMintable lets unlock mint the token ids unknown to the nft chaincode. Only
+// enable it for wrapped collections which are minted by this proxy, a native
+// collection must not get tokens the proxy never locked.
+// args: nft chaincode, "true" or "false"
+func (lp *NFTLockProxy) setMintable(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("args number should be 2")
+	}
+	if _, err := checkOwner(stub); err != nil {
+		return shim.Error(fmt.Sprintf("failed to check owner: %v", err))
+	}
+	mintable, err := strconv.ParseBool(string(args[1]))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse mintable: %v", err))
+	}
+	key := getMintableKey(string(args[0]))
+	if !mintable {
+		err = stub.DelState(key)
+	} else {
+		err = stub.PutState(key, []byte("true"))
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to put mintable: %v", err))
+	}
+	return shim.Success(nil)
+}
+
+// args: nft chaincode
+func (lp *NFTLockProxy) isMintable(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("args number should be 1")
+	}
+	raw, err := stub.GetState(getMintableKey(string(args[0])))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get mintable: %v", err))
+	}
+	return shim.Success([]byte(strconv.FormatBool(len(raw) > 0)))
+}
+
+// args: nft chaincode, toChainId, hex toAddress, tokenId
+func (lp *NFTLockProxy) lock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("args number should be 4")
+	}
+	token := string(args[0])
+	from, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get tx sender: %v", err))
+	}
+	chainId, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to parse chainId: %v", err))
+	}
+	toAddr, err := hex.DecodeString(string(args[2]))
+	if err != nil || len(toAddr) == 0 {
+		return shim.Error(fmt.Sprintf("wrong hex toAddr: %s", args[2]))
+	}
+	id, ok := big.NewInt(0).SetString(string(args[3]), 10)
+	if !ok || id.Sign() < 0 {
+		return shim.Error(fmt.Sprintf("wrong token id: %s", args[3]))
+	}
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+
+	resp := stub.InvokeChaincode(token, [][]byte{[]byte("tokenURI"), args[3]}, "")
+	if resp.Status != shim.OK {
+		return shim.Error(fmt.Sprintf("failed to get token uri: %s", resp.GetMessage()))
+	}
+	uri := resp.Payload
+	resp = stub.InvokeChaincode(token, [][]byte{[]byte(ProxyTransfer), from.Bytes(), lpAddr, id.Bytes()}, "")
+	if resp.Status != shim.OK {
+		return shim.Error(fmt.Sprintf("failed to lock token: %s", resp.GetMessage()))
+	}
+
+	toAsset, err := lockproxy.GetAssetBinding(stub, chainId, token)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get toAsset: %v", err))
+	}
+	if len(toAsset) == 0 {
+		return shim.Error("get no toAsset")
+	}
+	toProxy, err := lockproxy.GetProxyBinding(stub, chainId)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get toProxy: %v", err))
+	}
+	if len(toProxy) == 0 {
+		return shim.Error("get no toProxy")
+	}
+	ccm, err := stub.GetState(ProxyCCM)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get ccm: %v", err))
+	}
+	if len(ccm) == 0 {
+		return shim.Error("get no ccm")
+	}
+
+	txArgs := &TxArgs{
+		ToAssetHash: toAsset,
+		ToAddress:   toAddr,
+		TokenId:     id,
+		TokenURI:    uri,
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	if err := txArgs.Serialization(sink); err != nil {
+		return shim.Error(fmt.Sprintf("failed to serialize tx args: %v", err))
+	}
+
+	invokeArgs := make([][]byte, 5)
+	invokeArgs[0] = []byte("crossChain")
+	invokeArgs[1] = []byte(strconv.FormatUint(chainId, 10))
+	invokeArgs[2] = []byte(hex.EncodeToString(toProxy))
+	invokeArgs[3] = []byte("unlock")
+	invokeArgs[4] = []byte(hex.EncodeToString(sink.Bytes()))
+
+	resp = stub.InvokeChaincode(string(ccm), invokeArgs, "")
+	if resp.Status != shim.OK {
+		return shim.Error(fmt.Sprintf("failed to InvokeChaincode ccm %s: %s", string(ccm), resp.Message))
+	}
+	if err := stub.SetEvent(FromCCM, resp.Payload); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+
+	logger.Infof("successful to call ccm for cross-chain: (to_chainID: %d, to_contract: %x, to_asset: %x, to_addr: %x, token_id: %s)",
+		chainId, toProxy, toAsset, toAddr, id.String())
+	return shim.Success(nil)
+}
+
+// args: hex tx args, hex from contract, from chainId, [hex cross chain id], or
+// hex tx args only from a ccm not upgraded yet
+func (lp *NFTLockProxy) unlock(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	msg, err := lockproxy.ParseCCMArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := lockproxy.CheckFromProxy(stub, msg); err != nil {
+		return shim.Error(err.Error())
+	}
+	txArgs := &TxArgs{}
+	if err := txArgs.Deserialization(pcommon.NewZeroCopySource(msg.Args)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to deserialize tx args: %v", err))
+	}
+	fromChainId := msg.FromChainId
+	lpAddr, err := stub.GetState(LockProxyAddr)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to get LockProxyAddr: %v", err))
+	}
+
+	token := string(txArgs.ToAssetHash)
+	resp := stub.InvokeChaincode(token, [][]byte{[]byte("exists"), []byte(txArgs.TokenId.String())}, "")
+	if resp.Status != shim.OK {
+		return shim.Error(fmt.Sprintf("failed to check token %s: %s", txArgs.TokenId.String(), resp.GetMessage()))
+	}
+	// tokens locked before are released, the others are minted for the first time
+	// if the collection is mintable
+	minted := string(resp.Payload) != "true"
+	if minted {
+		raw, err := stub.GetState(getMintableKey(token))
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to get mintable: %v", err))
+		}
+		if len(raw) == 0 {
+			return shim.Error(fmt.Sprintf("token %s is not locked and %s is not mintable", txArgs.TokenId.String(), token))
+		}
+	}
+	if !minted {
+		resp = stub.InvokeChaincode(token, [][]byte{[]byte(ProxyTransfer), lpAddr, txArgs.ToAddress, txArgs.TokenId.Bytes()}, "")
+	} else {
+		resp = stub.InvokeChaincode(token, [][]byte{[]byte(ProxyMint), txArgs.ToAddress, txArgs.TokenId.Bytes(), txArgs.TokenURI}, "")
+	}
+	if resp.Status != shim.OK {
+		return shim.Error(fmt.Sprintf("failed to unlock token %s to %x: %s", txArgs.TokenId.String(), txArgs.ToAddress, resp.GetMessage()))
+	}
+
+	logger.Infof("unlock success: (from_chainID: %d, to_asset: %s, to_addr: %x, token_id: %s)",
+		fromChainId, token, txArgs.ToAddress, txArgs.TokenId.String())
+
+	rawEvent, err := json.Marshal(&UnlockEvent{
+		ToAsset:      token,
+		ToAddress:    hex.EncodeToString(txArgs.ToAddress),
+		TokenId:      txArgs.TokenId.String(),
+		FromChainId:  fromChainId,
+		CrossChainId: msg.CrossChainId,
+		Minted:       minted,
+	})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to json marshal: %v", err))
+	}
+	if err := stub.SetEvent(EventUnlock, rawEvent); err != nil {
+		return shim.Error(fmt.Sprintf("failed to set event: %v", err))
+	}
+	// ccm emits the payload since the event of a called chaincode is dropped
+	return shim.Success(rawEvent)
+}
+
+func checkOwner(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	creator, err := utils.GetMsgSenderAddress(stub)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := stub.GetState(ProxyOwner)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(creator.Bytes(), owner) {
+		return nil, fmt.Errorf("is not owner")
+	}
+	return owner, nil
+}
+
+func getMintableKey(token string) string {
+	return fmt.Sprintf(MintableKey, token)
+}
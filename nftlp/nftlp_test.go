@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package nftlp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/polynetwork/fabric-contract/nft"
+	"github.com/polynetwork/fabric-contract/utils"
+	pcommon "github.com/polynetwork/poly/common"
+	pcom "github.com/polynetwork/poly/native/service/cross_chain_manager/common"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strconv"
+	"testing"
+)
+
+func TestTxArgs(t *testing.T) {
+	args := &TxArgs{
+		ToAssetHash: []byte{1, 2, 3},
+		ToAddress:   []byte{4, 5, 6},
+		TokenId:     big.NewInt(1024),
+		TokenURI:    []byte("ipfs://cert/1024"),
+	}
+	sink := pcommon.NewZeroCopySink(nil)
+	assert.NoError(t, args.Serialization(sink))
+	decoded := &TxArgs{}
+	assert.NoError(t, decoded.Deserialization(pcommon.NewZeroCopySource(sink.Bytes())))
+	assert.Equal(t, args, decoded)
+
+	args.TokenId = big.NewInt(0).Lsh(big.NewInt(1), 255)
+	assert.Error(t, args.Serialization(pcommon.NewZeroCopySink(nil)))
+}
+
+const (
+	testCCMName   = "ccm"
+	testProxyName = "nftlp"
+	testNFTName   = "cert"
+	testChainId   = 2
+)
+
+var testRemoteProxy = []byte("remote_proxy")
+
+// testCCM stands in for ccm without proofs like the one of the lockproxy tests:
+// crossChain returns the args sent and verifyHeaderAndExecuteTx delivers the
+// ToMerkleValue the proof starts with, only the hex args when legacy.
+type testCCM struct {
+	legacy bool
+}
+
+func (ccm *testCCM) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (ccm *testCCM) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	fn, args := stub.GetFunctionAndParameters()
+	switch fn {
+	case "crossChain":
+		payload, err := hex.DecodeString(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(payload)
+	case "verifyHeaderAndExecuteTx":
+		val, err := utils.GetVerifiedMerkleValue(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		invokeArgs := [][]byte{[]byte(val.MakeTxParam.Method), []byte(hex.EncodeToString(val.MakeTxParam.Args))}
+		if !ccm.legacy {
+			invokeArgs = append(invokeArgs, []byte(hex.EncodeToString(val.MakeTxParam.FromContractAddress)),
+				[]byte(strconv.FormatUint(val.FromChainID, 10)), []byte(hex.EncodeToString(val.MakeTxParam.CrossChainID)))
+		}
+		return stub.InvokeChaincode(string(val.MakeTxParam.ToContractAddress), invokeArgs, "")
+	}
+	return shim.Error(fmt.Sprintf("no function name %s found", fn))
+}
+
+func mustOK(t *testing.T, resp pb.Response) pb.Response {
+	t.Helper()
+	if resp.Status != shim.OK {
+		t.Fatalf("unexpected error: %s", resp.Message)
+	}
+	return resp
+}
+
+// deliverUnlock relays an unlock of token id from fromProxy to the receiver.
+func deliverUnlock(net *utils.MockNet, relayer *utils.MockUser, fromProxy, to []byte, id int64, uri string) pb.Response {
+	sink := pcommon.NewZeroCopySink(nil)
+	args := &TxArgs{ToAssetHash: []byte(testNFTName), ToAddress: to, TokenId: big.NewInt(id), TokenURI: []byte(uri)}
+	if err := args.Serialization(sink); err != nil {
+		panic(err)
+	}
+	txHash := sha256.Sum256([]byte(fmt.Sprintf("remote tx %d", id)))
+	val := &pcom.ToMerkleValue{
+		TxHash:      txHash[:],
+		FromChainID: testChainId,
+		MakeTxParam: &pcom.MakeTxParam{
+			TxHash:              txHash[:],
+			CrossChainID:        txHash[:],
+			FromContractAddress: fromProxy,
+			ToChainID:           7,
+			ToContractAddress:   []byte(testProxyName),
+			Method:              "unlock",
+			Args:                sink.Bytes(),
+		},
+	}
+	raw := pcommon.NewZeroCopySink(nil)
+	val.Serialization(raw)
+	proof := pcommon.NewZeroCopySink(nil)
+	proof.WriteVarBytes(raw.Bytes())
+	return net.Invoke(testCCMName, relayer, "verifyHeaderAndExecuteTx", hex.EncodeToString(proof.Bytes()), "", "", "")
+}
+
+func TestNFTLockProxy_lockAndUnlock(t *testing.T) {
+	net := utils.NewMockNet()
+	newUser := func(mspId string) *utils.MockUser {
+		user, err := utils.NewMockUser(mspId, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	owner, alice, bob, relayer := newUser("Org1MSP"), newUser("Org1MSP"), newUser("Org1MSP"), newUser("Org2MSP")
+	ccm := &testCCM{}
+	mustOK(t, net.Deploy(testCCMName, ccm, owner))
+	mustOK(t, net.Deploy(testProxyName, &NFTLockProxy{}, owner))
+	lpAddr := mustOK(t, net.Invoke(testProxyName, owner, "getLockProxyAddr")).Payload
+	mustOK(t, net.Invoke(testProxyName, owner, "setManager", testCCMName))
+	mustOK(t, net.Invoke(testProxyName, owner, "bindProxyHash", strconv.Itoa(testChainId), hex.EncodeToString(testRemoteProxy)))
+	mustOK(t, net.Invoke(testProxyName, owner, "bindAssetHash", testNFTName, strconv.Itoa(testChainId),
+		hex.EncodeToString([]byte("remote_cert"))))
+	mustOK(t, net.Deploy(testNFTName, &nft.NFTImpl{}, owner, "certificate", "CERT", testCCMName))
+	mustOK(t, net.Invoke(testNFTName, owner, "setLockProxyChainCode", testProxyName, hex.EncodeToString(lpAddr)))
+	mustOK(t, net.Invoke(testNFTName, owner, "mint", hex.EncodeToString(alice.Addr.Bytes()), "1", "ipfs://cert/1"))
+
+	// bindings are stored with composite keys like lockproxy
+	assert.Equal(t, testRemoteProxy, mustOK(t, net.Invoke(testProxyName, owner, "getProxyHash", strconv.Itoa(testChainId))).Payload)
+	assert.Nil(t, net.GetState(testProxyName, fmt.Sprintf("proxy-%d", testChainId)))
+
+	mustOK(t, net.Invoke(testProxyName, alice, "lock", testNFTName, strconv.Itoa(testChainId), hex.EncodeToString(bob.Addr.Bytes()), "1"))
+	if assert.NotNil(t, net.Event) && assert.Equal(t, FromCCM, net.Event.EventName) {
+		sent := &TxArgs{}
+		assert.NoError(t, sent.Deserialization(pcommon.NewZeroCopySource(net.Event.Payload)))
+		assert.Equal(t, &TxArgs{ToAssetHash: []byte("remote_cert"), ToAddress: bob.Addr.Bytes(),
+			TokenId: big.NewInt(1), TokenURI: []byte("ipfs://cert/1")}, sent)
+	}
+	assert.Equal(t, lpAddr, mustOK(t, net.Invoke(testNFTName, owner, "ownerOf", "1")).Payload)
+
+	// only the bound proxy can unlock
+	assert.NotEqual(t, int32(shim.OK), deliverUnlock(net, relayer, []byte("other_proxy"), bob.Addr.Bytes(), 1, "").Status)
+	assert.Equal(t, lpAddr, mustOK(t, net.Invoke(testNFTName, owner, "ownerOf", "1")).Payload)
+
+	// a locked token is released
+	resp := mustOK(t, deliverUnlock(net, relayer, testRemoteProxy, bob.Addr.Bytes(), 1, "ipfs://cert/1"))
+	event := &UnlockEvent{}
+	assert.NoError(t, json.Unmarshal(resp.Payload, event))
+	assert.False(t, event.Minted)
+	assert.Equal(t, uint64(testChainId), event.FromChainId)
+	assert.Equal(t, bob.Addr.Bytes(), mustOK(t, net.Invoke(testNFTName, owner, "ownerOf", "1")).Payload)
+
+	// unknown tokens are minted only for a mintable collection
+	assert.NotEqual(t, int32(shim.OK), deliverUnlock(net, relayer, testRemoteProxy, alice.Addr.Bytes(), 2, "ipfs://cert/2").Status)
+	assert.NotEqual(t, int32(shim.OK), net.Invoke(testProxyName, alice, "setMintable", testNFTName, "true").Status)
+	mustOK(t, net.Invoke(testProxyName, owner, "setMintable", testNFTName, "true"))
+	assert.Equal(t, []byte("true"), mustOK(t, net.Invoke(testProxyName, owner, "isMintable", testNFTName)).Payload)
+
+	// a ccm not upgraded yet passes the args only, a new token is minted
+	ccm.legacy = true
+	resp = mustOK(t, deliverUnlock(net, relayer, testRemoteProxy, alice.Addr.Bytes(), 2, "ipfs://cert/2"))
+	assert.NoError(t, json.Unmarshal(resp.Payload, event))
+	assert.True(t, event.Minted)
+	assert.NotEmpty(t, event.CrossChainId)
+	assert.Equal(t, alice.Addr.Bytes(), mustOK(t, net.Invoke(testNFTName, owner, "ownerOf", "2")).Payload)
+	assert.Equal(t, []byte("ipfs://cert/2"), mustOK(t, net.Invoke(testNFTName, owner, "tokenURI", "2")).Payload)
+	assert.NotEqual(t, int32(shim.OK), deliverUnlock(net, relayer, []byte("other_proxy"), alice.Addr.Bytes(), 3, "").Status)
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/polynetwork/poly/common"
+	pcom "github.com/polynetwork/poly/native/service/cross_chain_manager/common"
+)
+
+// TrustedCCM is a ccm chaincode trusted besides the current one, from ActiveFrom
+// until ExpiresAt. Both are tx timestamps in seconds, zero ExpiresAt never expires.
+type TrustedCCM struct {
+	Name       string `json:"name"`
+	ActiveFrom int64  `json:"active_from"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+func (t *TrustedCCM) Active(now int64) bool {
+	return now >= t.ActiveFrom && (t.ExpiresAt == 0 || now < t.ExpiresAt)
+}
+
+func GetTxTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get tx timestamp: %v", err)
+	}
+	return ts.GetSeconds(), nil
+}
+
+// GetTrustedCCMs reads the trusted ccm list stored under key.
+func GetTrustedCCMs(stub shim.ChaincodeStubInterface, key string) ([]*TrustedCCM, error) {
+	raw, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trusted ccms: %v", err)
+	}
+	list := make([]*TrustedCCM, 0)
+	if len(raw) == 0 {
+		return list, nil
+	}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("failed to decode trusted ccms: %v", err)
+	}
+	return list, nil
+}
+
+// PutTrustedCCMs saves the list dropping the entries expired at now, and returns
+// the entries kept.
+func PutTrustedCCMs(stub shim.ChaincodeStubInterface, key string, list []*TrustedCCM, now int64) ([]*TrustedCCM, error) {
+	kept := make([]*TrustedCCM, 0, len(list))
+	for _, t := range list {
+		if t.ExpiresAt == 0 || now < t.ExpiresAt {
+			kept = append(kept, t)
+		}
+	}
+	raw, err := json.Marshal(kept)
+	if err != nil {
+		return nil, fmt.Errorf("failed to json marshal: %v", err)
+	}
+	if err := stub.PutState(key, raw); err != nil {
+		return nil, fmt.Errorf("failed to put trusted ccms: %v", err)
+	}
+	return kept, nil
+}
+
+// IsTrustedCCM tells if name is active in the list stored under key.
+func IsTrustedCCM(stub shim.ChaincodeStubInterface, key, name string) (bool, error) {
+	list, err := GetTrustedCCMs(stub, key)
+	if err != nil {
+		return false, err
+	}
+	now, err := GetTxTime(stub)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range list {
+		if t.Name == name && t.Active(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetTrustedCCM adds or replaces the entry of t.Name.
+func SetTrustedCCM(list []*TrustedCCM, t *TrustedCCM) []*TrustedCCM {
+	for i, old := range list {
+		if old.Name == t.Name {
+			list[i] = t
+			return list
+		}
+	}
+	return append(list, t)
+}
+
+func RemoveTrustedCCM(list []*TrustedCCM, name string) []*TrustedCCM {
+	kept := make([]*TrustedCCM, 0, len(list))
+	for _, t := range list {
+		if t.Name != name {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// GetVerifiedMerkleValue reads the cross chain message from the proof given to
+// verifyHeaderAndExecuteTx of ccm, the top-level call of this tx. It is for DApps
+// called by a ccm which passes the args of the message only, the caller must
+// make sure the calling chaincode is a trusted ccm.
+func GetVerifiedMerkleValue(stub shim.ChaincodeStubInterface) (*pcom.ToMerkleValue, error) {
+	args, err := GetOriginalInputArgs(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("no proof in the args of ccm")
+	}
+	rawProof, err := hex.DecodeString(string(args[1]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hex proof: %v", err)
+	}
+	value, eof := common.NewZeroCopySource(rawProof).NextVarBytes()
+	if eof {
+		return nil, fmt.Errorf("failed to read merkle value from proof")
+	}
+	merkleValue := new(pcom.ToMerkleValue)
+	if err := merkleValue.Deserialization(common.NewZeroCopySource(value)); err != nil {
+		return nil, fmt.Errorf("deserialize merkleValue error: %v", err)
+	}
+	return merkleValue, nil
+}
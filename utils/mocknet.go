@@ -0,0 +1,536 @@
+/*
+ * Copyright (C) 2020 The poly network Authors
+ * This file is part of The poly network library.
+ *
+ * The  poly network  is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The  poly network  is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The poly network .  If not, see <http://www.gnu.org/licenses/>.
+ */
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pcommon "github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const mockChannel = "mychannel"
+
+var _ shim.ChaincodeStubInterface = &mockStub{}
+
+// MockUser is an identity sending txs to a MockNet, Addr is what
+// GetMsgSenderAddress returns for it.
+type MockUser struct {
+	MspId   string
+	Addr    common.Address
+	creator []byte
+}
+
+// NewMockUser issues a self-signed certificate with the fabric-ca attributes
+// given, e.g. {"lockproxy.compliance": "true"}.
+func NewMockUser(mspId string, attrs map[string]string) (*MockUser, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "user", Organization: []string{mspId}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(attrs) > 0 {
+		raw, err := json.Marshal(map[string]map[string]string{"attrs": attrs})
+		if err != nil {
+			return nil, err
+		}
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: raw}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspId,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MockUser{MspId: mspId, Addr: GetAddrFromRaw(cert.RawSubjectPublicKeyInfo), creator: creator}, nil
+}
+
+// MockNet runs chaincodes in memory like the peers of a channel, so that a test
+// can send a tx through all the chaincodes it calls. Like fabric, a tx reads the
+// committed state only and its writes are dropped if it fails, the signed
+// proposal carries the top-level chaincode and args, and only the event set by
+// the top-level chaincode is kept.
+type MockNet struct {
+	// Time is the timestamp in seconds of the next tx
+	Time int64
+	// Event is the event of the last tx, nil if none
+	Event  *pb.ChaincodeEvent
+	ccs    map[string]shim.Chaincode
+	states map[string]map[string][]byte
+	txNum  int
+}
+
+func NewMockNet() *MockNet {
+	return &MockNet{
+		Time:   time.Now().Unix(),
+		ccs:    make(map[string]shim.Chaincode),
+		states: make(map[string]map[string][]byte),
+	}
+}
+
+// Deploy instantiates cc as chaincode name with the args of Init.
+func (net *MockNet) Deploy(name string, cc shim.Chaincode, user *MockUser, args ...string) pb.Response {
+	net.ccs[name] = cc
+	if _, ok := net.states[name]; !ok {
+		net.states[name] = make(map[string][]byte)
+	}
+	return net.execute(name, user, toBytesArgs(args), true)
+}
+
+// Invoke sends a tx calling chaincode name.
+func (net *MockNet) Invoke(name string, user *MockUser, args ...string) pb.Response {
+	return net.execute(name, user, toBytesArgs(args), false)
+}
+
+// GetState reads the committed state of chaincode name.
+func (net *MockNet) GetState(name, key string) []byte {
+	return net.states[name][key]
+}
+
+// PutState writes the committed state of chaincode name, like state left by an
+// older version of it.
+func (net *MockNet) PutState(name, key string, value []byte) {
+	net.states[name][key] = value
+}
+
+func (net *MockNet) execute(name string, user *MockUser, args [][]byte, init bool) pb.Response {
+	net.Event = nil
+	cc, ok := net.ccs[name]
+	if !ok {
+		return shim.Error(fmt.Sprintf("chaincode %s not deployed", name))
+	}
+	net.txNum++
+	txHash := sha256.Sum256([]byte(fmt.Sprintf("mock tx %d", net.txNum)))
+	tx := &mockTx{
+		net:     net,
+		txId:    hex.EncodeToString(txHash[:]),
+		creator: user.creator,
+		time:    net.Time,
+		writes:  make(map[string]map[string][]byte),
+	}
+	sp, err := tx.signedProposal(name, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tx.proposal = sp
+	stub := &mockStub{tx: tx, name: name, args: args, top: true}
+	var resp pb.Response
+	if init {
+		resp = cc.Init(stub)
+	} else {
+		resp = cc.Invoke(stub)
+	}
+	if resp.Status >= shim.ERRORTHRESHOLD {
+		return resp
+	}
+	tx.commit()
+	net.Event = tx.event
+	return resp
+}
+
+type mockTx struct {
+	net      *MockNet
+	txId     string
+	creator  []byte
+	time     int64
+	proposal *pb.SignedProposal
+	// writes keeps the new value of each key by chaincode, nil for deleted
+	writes map[string]map[string][]byte
+	event  *pb.ChaincodeEvent
+}
+
+func (tx *mockTx) signedProposal(name string, args [][]byte) (*pb.SignedProposal, error) {
+	rawSpec, err := proto.Marshal(&pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{
+		ChaincodeId: &pb.ChaincodeID{Name: name},
+		Input:       &pb.ChaincodeInput{Args: args},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&pb.ChaincodeProposalPayload{Input: rawSpec})
+	if err != nil {
+		return nil, err
+	}
+	chHdr, err := proto.Marshal(&pcommon.ChannelHeader{
+		Type:      int32(pcommon.HeaderType_ENDORSER_TRANSACTION),
+		ChannelId: mockChannel,
+		TxId:      tx.txId,
+		Timestamp: &timestamp.Timestamp{Seconds: tx.time},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sigHdr, err := proto.Marshal(&pcommon.SignatureHeader{Creator: tx.creator})
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := proto.Marshal(&pcommon.Header{ChannelHeader: chHdr, SignatureHeader: sigHdr})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := proto.Marshal(&pb.Proposal{Header: hdr, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SignedProposal{ProposalBytes: raw}, nil
+}
+
+func (tx *mockTx) commit() {
+	for name, writes := range tx.writes {
+		state := tx.net.states[name]
+		for k, v := range writes {
+			if v == nil {
+				delete(state, k)
+			} else {
+				state[k] = v
+			}
+		}
+	}
+}
+
+// mockStub is the stub of one chaincode in a tx of MockNet.
+type mockStub struct {
+	tx   *mockTx
+	name string
+	args [][]byte
+	top  bool
+}
+
+func (stub *mockStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *mockStub) GetStringArgs() []string {
+	args := make([]string, 0, len(stub.args))
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *mockStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (stub *mockStub) GetArgsSlice() ([]byte, error) {
+	res := make([]byte, 0)
+	for _, arg := range stub.args {
+		res = append(res, arg...)
+	}
+	return res, nil
+}
+
+func (stub *mockStub) GetTxID() string {
+	return stub.tx.txId
+}
+
+func (stub *mockStub) GetChannelID() string {
+	return mockChannel
+}
+
+func (stub *mockStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	cc, ok := stub.tx.net.ccs[chaincodeName]
+	if !ok {
+		return shim.Error(fmt.Sprintf("chaincode %s not found", chaincodeName))
+	}
+	return cc.Invoke(&mockStub{tx: stub.tx, name: chaincodeName, args: args})
+}
+
+// GetState reads the committed state, writes of this tx are not seen.
+func (stub *mockStub) GetState(key string) ([]byte, error) {
+	return stub.tx.net.states[stub.name][key], nil
+}
+
+func (stub *mockStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	if len(value) == 0 {
+		return stub.DelState(key)
+	}
+	stub.writes()[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (stub *mockStub) DelState(key string) error {
+	stub.writes()[key] = nil
+	return nil
+}
+
+func (stub *mockStub) writes() map[string][]byte {
+	writes, ok := stub.tx.writes[stub.name]
+	if !ok {
+		writes = make(map[string][]byte)
+		stub.tx.writes[stub.name] = writes
+	}
+	return writes
+}
+
+func (stub *mockStub) SetStateValidationParameter(key string, ep []byte) error {
+	return nil
+}
+
+func (stub *mockStub) GetStateValidationParameter(key string) ([]byte, error) {
+	return nil, nil
+}
+
+// GetStateByRange skips composite keys like fabric when startKey is empty.
+func (stub *mockStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	return stub.rangeQuery(startKey, endKey, 0), nil
+}
+
+func (stub *mockStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32,
+	bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	iter := stub.rangeQuery(startKey, endKey, int(pageSize)+1)
+	return iter.page(pageSize)
+}
+
+func (stub *mockStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return stub.rangeQuery(prefix, prefix+string(utf8.MaxRune), 0), nil
+}
+
+func (stub *mockStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string,
+	pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	startKey := prefix
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	iter := stub.rangeQuery(startKey, prefix+string(utf8.MaxRune), int(pageSize)+1)
+	return iter.page(pageSize)
+}
+
+// rangeQuery returns at most limit committed kvs in [startKey, endKey), no limit if zero.
+func (stub *mockStub) rangeQuery(startKey, endKey string, limit int) *mockIterator {
+	state := stub.tx.net.states[stub.name]
+	keys := make([]string, 0)
+	for k := range state {
+		if k >= startKey && (endKey == "" || k < endKey) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	iter := &mockIterator{kvs: make([]*queryresult.KV, 0, len(keys))}
+	for _, k := range keys {
+		iter.kvs = append(iter.kvs, &queryresult.KV{Namespace: stub.name, Key: k, Value: state[k]})
+	}
+	return iter
+}
+
+func (stub *mockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	if !utf8.ValidString(objectType) || strings.ContainsRune(objectType, 0) {
+		return "", fmt.Errorf("wrong object type %q", objectType)
+	}
+	ck := "\x00" + objectType + "\x00"
+	for _, att := range attributes {
+		if !utf8.ValidString(att) || strings.ContainsRune(att, 0) {
+			return "", fmt.Errorf("wrong attribute %q", att)
+		}
+		ck += att + "\x00"
+	}
+	return ck, nil
+}
+
+func (stub *mockStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, "\x00") || !strings.HasSuffix(compositeKey, "\x00") {
+		return "", nil, fmt.Errorf("not a composite key %q", compositeKey)
+	}
+	parts := strings.Split(compositeKey[1:len(compositeKey)-1], "\x00")
+	return parts[0], parts[1:], nil
+}
+
+func (stub *mockStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("rich query not supported")
+}
+
+func (stub *mockStub) GetQueryResultWithPagination(query string, pageSize int32,
+	bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	return nil, nil, fmt.Errorf("rich query not supported")
+}
+
+func (stub *mockStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("history not supported")
+}
+
+func (stub *mockStub) GetPrivateData(collection, key string) ([]byte, error) {
+	return nil, fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	return nil, fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) PutPrivateData(collection string, key string, value []byte) error {
+	return fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) DelPrivateData(collection, key string) error {
+	return fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) SetPrivateDataValidationParameter(collection, key string, ep []byte) error {
+	return fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) GetPrivateDataValidationParameter(collection, key string) ([]byte, error) {
+	return nil, fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("private data not supported")
+}
+
+func (stub *mockStub) GetCreator() ([]byte, error) {
+	return stub.tx.creator, nil
+}
+
+func (stub *mockStub) GetTransient() (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func (stub *mockStub) GetBinding() ([]byte, error) {
+	return nil, nil
+}
+
+func (stub *mockStub) GetDecorations() map[string][]byte {
+	return map[string][]byte{}
+}
+
+func (stub *mockStub) GetSignedProposal() (*pb.SignedProposal, error) {
+	return stub.tx.proposal, nil
+}
+
+func (stub *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.tx.time}, nil
+}
+
+// SetEvent keeps the event of the top-level chaincode only, as fabric does.
+func (stub *mockStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty string")
+	}
+	if stub.top {
+		stub.tx.event = &pb.ChaincodeEvent{ChaincodeId: stub.name, TxId: stub.tx.txId, EventName: name, Payload: payload}
+	}
+	return nil
+}
+
+type mockIterator struct {
+	kvs []*queryresult.KV
+	pos int
+}
+
+// page keeps pageSize kvs and returns the first key left as bookmark.
+func (iter *mockIterator) page(pageSize int32) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	meta := &pb.QueryResponseMetadata{}
+	if pageSize > 0 && len(iter.kvs) > int(pageSize) {
+		meta.Bookmark = iter.kvs[pageSize].Key
+		iter.kvs = iter.kvs[:pageSize]
+	}
+	meta.FetchedRecordsCount = int32(len(iter.kvs))
+	return iter, meta, nil
+}
+
+func (iter *mockIterator) HasNext() bool {
+	return iter.pos < len(iter.kvs)
+}
+
+func (iter *mockIterator) Next() (*queryresult.KV, error) {
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("no more kv")
+	}
+	kv := iter.kvs[iter.pos]
+	iter.pos++
+	return kv, nil
+}
+
+func (iter *mockIterator) Close() error {
+	return nil
+}
+
+func toBytesArgs(args []string) [][]byte {
+	res := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		res = append(res, []byte(arg))
+	}
+	return res
+}
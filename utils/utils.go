@@ -24,8 +24,12 @@ import (
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/utils"
 	"math/big"
+	"strconv"
 )
 
+// DefaultPageSize is the page size of paginated queries when none is given.
+const DefaultPageSize = 100
+
 func GetMsgSenderAddress(stub shim.ChaincodeStubInterface) (common.Address, error) {
 	cert, err := cid.GetX509Certificate(stub)
 	if err != nil {
@@ -138,3 +142,28 @@ func GetOriginalInputArgs(stub shim.ChaincodeStubInterface) ([][]byte, error) {
 	}
 	return spec.ChaincodeSpec.Input.Args, nil
 }
+
+// PrefixEnd is the end key of a range covering all keys starting with prefix.
+func PrefixEnd(prefix string) string {
+	return prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+}
+
+// ParsePageArgs parses the optional args [page size, bookmark] of a paginated query.
+func ParsePageArgs(args [][]byte) (int32, string, error) {
+	if len(args) > 2 {
+		return 0, "", fmt.Errorf("too many args for pagination")
+	}
+	pageSize := int32(DefaultPageSize)
+	if len(args) > 0 && len(args[0]) > 0 {
+		size, err := strconv.ParseUint(string(args[0]), 10, 31)
+		if err != nil || size == 0 {
+			return 0, "", fmt.Errorf("wrong page size: %s", args[0])
+		}
+		pageSize = int32(size)
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = string(args[1])
+	}
+	return pageSize, bookmark, nil
+}